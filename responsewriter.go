@@ -3,37 +3,70 @@ package traefik_rybbit_feeder
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"time"
 )
 
 // Copied and adapted from https://github.com/safing/plausiblefeeder/blob/master/responsewriter.go
 // Licensed as MIT license
 
 // ResponseWriter is used to wrap given response writers.
+// It records the response and submits the event once the response is complete, see finish.
 type ResponseWriter struct {
 	http.ResponseWriter
 
 	request *http.Request
 	feeder  *UmamiFeeder
+
+	started    time.Time
+	status     int
+	written    int64
+	proxyError bool
+	submitted  bool
+	hijacked   bool // the connection was taken over, e.g. for a websocket
+	untracked  bool // only the bytes written are accounted, see recordBandwidth
 }
 
 // WriteHeader adds custom handling to the wrapped WriterHeader method.
 func (rw *ResponseWriter) WriteHeader(code int) {
-	if rw.feeder.shouldTrackStatus(code) {
-		rw.feeder.submitToFeed(rw.request, code)
+	// Interim responses (e.g. 100 Continue, 103 Early Hints) are followed by the final status, wait for that one.
+	// 101 Switching Protocols is final, the connection is handed over afterward.
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		rw.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	// Only the first final status counts, a handler calling WriteHeader twice must not change the event.
+	if rw.status == 0 {
+		rw.status = code
+		// Traefik's own error pages are recognized by their headers, which may be changed after this call.
+		rw.proxyError = rw.feeder.ignoreProxyErrors && rw.feeder.isProxyError(code, rw.Header())
 	}
 
 	// Continue with the original method.
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Write records the implicit 200 status and the amount of bytes written.
+func (rw *ResponseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+
+	n, err := rw.ResponseWriter.Write(b)
+	rw.written += int64(n)
+	return n, err
+}
+
 func (rw *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
 	if !ok {
 		return nil, nil, fmt.Errorf("%T is not a http.Hijacker", rw.ResponseWriter)
 	}
 
+	rw.hijacked = true
 	return hijacker.Hijack()
 }
 
@@ -42,3 +75,117 @@ func (rw *ResponseWriter) Flush() {
 		flusher.Flush()
 	}
 }
+
+// ReadFrom delegates to the wrapped writer when it implements io.ReaderFrom,
+// so responses such as static files keep using the sendfile fast path.
+func (rw *ResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+
+	if readerFrom, ok := rw.ResponseWriter.(io.ReaderFrom); ok {
+		n, err := readerFrom.ReadFrom(r)
+		rw.written += n
+		return n, err
+	}
+
+	// Hide our own ReadFrom from io.Copy to avoid recursing into it.
+	return io.Copy(writerOnly{rw}, r)
+}
+
+// finish submits the event for the completed response, it is called once the next handler returned.
+func (rw *ResponseWriter) finish() {
+	if rw.submitted {
+		return
+	}
+	rw.submitted = true
+
+	// A connection taken over without a status switched protocols, e.g. a websocket upgrade answered by the handler
+	// itself. Otherwise nothing was written, the server will send an empty 200 response.
+	if rw.status == 0 && rw.hijacked {
+		rw.status = http.StatusSwitchingProtocols
+	} else if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+
+	if rw.feeder.bandwidth != nil {
+		rw.feeder.recordBandwidth(rw.request, rw.written)
+	}
+	if rw.untracked {
+		return
+	}
+
+	if rw.proxyError {
+		rw.feeder.debug("ignoring proxy error %d", rw.status)
+		rw.capture("proxy error", "")
+		return
+	}
+
+	// 5xx errors are counted for spikes regardless of whether they are tracked.
+	if rw.status >= http.StatusInternalServerError && rw.feeder.errorSpikes != nil {
+		rw.feeder.recordError(rw.request)
+	}
+
+	if reported, ok := rw.feeder.statusOverrides[rw.status]; ok {
+		rw.feeder.debug("reporting status %d as %d", rw.status, reported)
+		rw.status = reported
+	}
+
+	// Status events are emitted even for responses whose status is not tracked otherwise.
+	_, hasStatusEvent := rw.feeder.statusEvents[rw.status]
+	trackStatus := rw.feeder.shouldTrackStatus(rw.request.Host, rw.status)
+	if rw.feeder.shadowFilter != nil {
+		rw.feeder.compareShadowStatus(rw.request, rw.status, trackStatus)
+	}
+
+	if trackStatus && rw.feeder.abortRates != nil {
+		rw.feeder.recordAbort(rw.request)
+	}
+
+	if trackStatus || hasStatusEvent {
+		info := responseInfo{
+			status:       rw.status,
+			written:      rw.written,
+			duration:     time.Since(rw.started),
+			header:       rw.Header(),
+			skipPageview: !trackStatus,
+		}
+		if rw.feeder.isDebug {
+			rw.feeder.debug("response %d for %s completed with %d bytes in %v",
+				info.status, rw.request.URL.Path, info.written, info.duration)
+		}
+		payload := rw.feeder.submitToFeed(rw.request, info)
+		rw.capture("", payload)
+	} else {
+		rw.capture("status", "")
+	}
+}
+
+// capture keeps the completed request with the reason it was not tracked or the summary of its events, if
+// captureSize is set.
+func (rw *ResponseWriter) capture(reason string, payload string) {
+	if rw.feeder.captures == nil {
+		return
+	}
+	rw.feeder.capture(rw.request, reason, responseInfo{
+		status:   rw.status,
+		written:  rw.written,
+		duration: time.Since(rw.started),
+	}, payload)
+}
+
+// responseInfo describes the completed response of a tracked request.
+type responseInfo struct {
+	status   int
+	written  int64
+	duration time.Duration
+	header   http.Header
+
+	// skipPageview is set if only derived events, e.g. status events, should be submitted.
+	skipPageview bool
+}
+
+// writerOnly exposes only the Write method of the wrapped writer.
+type writerOnly struct {
+	io.Writer
+}
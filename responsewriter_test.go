@@ -0,0 +1,230 @@
+package traefik_rybbit_feeder
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestWriter(t *testing.T, url string) (*ResponseWriter, *UmamiFeeder) {
+	t.Helper()
+
+	feeder := &UmamiFeeder{
+		websites: map[string]string{"localhost": "1"},
+		queue:    newEventQueue(queueTypeChannel, 10, 1),
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &ResponseWriter{ResponseWriter: httptest.NewRecorder(), request: req, feeder: feeder}, feeder
+}
+
+func TestResponseWriterSubmitsOnce(t *testing.T) {
+	rw, feeder := newTestWriter(t, "http://localhost/")
+
+	rw.WriteHeader(http.StatusOK)
+	rw.WriteHeader(http.StatusOK)
+	rw.finish()
+	rw.finish()
+
+	if feeder.queue.len() != 1 {
+		t.Fatalf("expected 1 event, got %d", feeder.queue.len())
+	}
+}
+
+func TestResponseWriterSkipsInformational(t *testing.T) {
+	rw, feeder := newTestWriter(t, "http://localhost/")
+
+	rw.WriteHeader(http.StatusEarlyHints)
+	rw.WriteHeader(http.StatusNotFound)
+	rw.finish()
+
+	if rw.status != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d", rw.status)
+	}
+	if feeder.queue.len() != 0 {
+		t.Fatalf("expected no event for 404, got %d", feeder.queue.len())
+	}
+}
+
+func TestResponseWriterAbortedRequests(t *testing.T) {
+	for mode, expected := range map[string]string{abortedTrack: "", abortedIgnore: "-", abortedTag: `{"aborted":true}`} {
+		rw, feeder := newTestWriter(t, "http://localhost/")
+		feeder.abortedRequests = mode
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		rw.request = rw.request.WithContext(ctx)
+
+		rw.WriteHeader(http.StatusOK)
+		rw.finish()
+
+		if expected == "-" {
+			if feeder.queue.len() != 0 {
+				t.Fatalf("%s: expected no event, got %d", mode, feeder.queue.len())
+			}
+			continue
+		}
+
+		if feeder.queue.len() != 1 {
+			t.Fatalf("%s: expected 1 event, got %d", mode, feeder.queue.len())
+		}
+		if event := feeder.queue.shards[0].pop(); event.Properties != expected {
+			t.Fatalf("%s: expected properties %q, got %q", mode, expected, event.Properties)
+		}
+	}
+}
+
+func TestResponseWriterIgnoresProxyErrors(t *testing.T) {
+	rw, feeder := newTestWriter(t, "http://localhost/")
+	feeder.trackServerErrors = true
+	feeder.ignoreProxyErrors = true
+
+	rw.WriteHeader(http.StatusBadGateway)
+	rw.finish()
+	if feeder.queue.len() != 0 {
+		t.Fatalf("expected no event for proxy error, got %d", feeder.queue.len())
+	}
+
+	rw, feeder = newTestWriter(t, "http://localhost/")
+	feeder.trackServerErrors = true
+	feeder.ignoreProxyErrors = true
+
+	rw.Header().Set("Content-Type", "text/html")
+	rw.WriteHeader(http.StatusBadGateway)
+	rw.finish()
+	if feeder.queue.len() != 1 {
+		t.Fatalf("expected 1 event for backend error, got %d", feeder.queue.len())
+	}
+}
+
+func TestResponseWriterImplicitStatus(t *testing.T) {
+	rw, feeder := newTestWriter(t, "http://localhost/")
+
+	_, _ = rw.Write([]byte("hello"))
+	_, _ = rw.ReadFrom(strings.NewReader(" world"))
+	rw.finish()
+
+	if rw.status != http.StatusOK || rw.written != 11 {
+		t.Fatalf("expected status 200 with 11 bytes, got %d with %d bytes", rw.status, rw.written)
+	}
+	if feeder.queue.len() != 1 {
+		t.Fatalf("expected 1 event, got %d", feeder.queue.len())
+	}
+}
+
+func TestResponseWriterSampling(t *testing.T) {
+	_, feeder := newTestWriter(t, "http://localhost/")
+	feeder.sampleRate.Store(4)
+
+	for i := 0; i < 8; i++ {
+		rw, _ := newTestWriter(t, "http://localhost/")
+		rw.feeder = feeder
+		rw.finish()
+	}
+
+	if feeder.queue.len() != 2 {
+		t.Fatalf("expected 2 sampled events, got %d", feeder.queue.len())
+	}
+	if event := feeder.queue.shards[0].pop(); event.Properties != `{"sample_rate":4}` {
+		t.Fatalf("expected sample rate property, got %q", event.Properties)
+	}
+}
+
+func TestResponseWriterStatusEvents(t *testing.T) {
+	rw, feeder := newTestWriter(t, "http://localhost/admin")
+	if err := feeder.verifyConfig(&Config{StatusEvents: map[string]string{"401": "auth_failed"}}); err != nil {
+		t.Fatal(err)
+	}
+	rw.request.RemoteAddr = "192.168.0.1:54321"
+
+	rw.WriteHeader(http.StatusUnauthorized)
+	rw.finish()
+
+	if feeder.queue.len() != 1 {
+		t.Fatalf("expected only the status event, got %d events", feeder.queue.len())
+	}
+	event := feeder.queue.shards[0].pop()
+	if event.EventName != "auth_failed" || event.Properties != `{"ip":"192.168.0.1","path":"/admin","status":401}` {
+		t.Fatalf("unexpected event %q %s", event.EventName, event.Properties)
+	}
+}
+
+func TestResponseWriterStatusOverrides(t *testing.T) {
+	rw, feeder := newTestWriter(t, "http://localhost/")
+	feeder.statusOverrides = map[int]int{http.StatusNotFound: http.StatusOK}
+	feeder.statusClass = true
+
+	rw.WriteHeader(http.StatusNotFound)
+	rw.finish()
+
+	event := feeder.queue.shards[0].pop()
+	if event == nil || event.Properties != `{"status_class":"2xx"}` {
+		t.Fatalf("expected the 404 to be reported as 200, got %+v", event)
+	}
+}
+
+// readerFromRecorder is a recorder implementing io.ReaderFrom, like the writers of net/http.
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (r *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFrom = true
+	return r.Body.ReadFrom(src)
+}
+
+func TestResponseWriterReadFrom(t *testing.T) {
+	rw, _ := newTestWriter(t, "http://localhost/")
+	recorder := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rw.ResponseWriter = recorder
+
+	// A LimitedReader does not implement io.WriterTo, so io.Copy uses ReadFrom of the writer.
+	n, err := io.Copy(rw, io.LimitReader(strings.NewReader("hello"), 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !recorder.readFrom || n != 5 || recorder.Body.String() != "hello" {
+		t.Fatalf("expected the copy to reach the wrapped ReadFrom, got %d bytes %q", n, recorder.Body.String())
+	}
+	if rw.status != http.StatusOK || rw.written != 5 {
+		t.Fatalf("expected status 200 and 5 bytes written, got %d and %d", rw.status, rw.written)
+	}
+}
+
+// hijackRecorder is a ResponseRecorder whose connection can be hijacked.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (r *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	server, client := net.Pipe()
+	_ = client.Close()
+	return server, bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)), nil
+}
+
+func TestResponseWriterHijack(t *testing.T) {
+	rw, feeder := newTestWriter(t, "http://localhost/socket")
+	rw.ResponseWriter = &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+
+	conn, _, err := rw.Hijack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	rw.finish()
+
+	if rw.status != http.StatusSwitchingProtocols || feeder.queue.len() != 1 {
+		t.Fatalf("expected the hijacked connection to be reported as 101, got %d", rw.status)
+	}
+}
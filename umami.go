@@ -8,50 +8,418 @@ import (
 	"net/http"
 	"net/netip"
 	"os"
-	"path"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Possible values of Config.AbortedRequests.
+const (
+	abortedTrack  = "track"
+	abortedIgnore = "ignore"
+	abortedTag    = "tag"
+)
+
+// Possible values of Config.FailMode.
+const (
+	failOpen   = "open"
+	failClosed = "closed"
+)
+
+// failureHeader is the response header set while the plugin failed, in the "closed" fail mode.
+const failureHeader = "X-Rybbit-Feeder"
+
+// failureWarnInterval defines how often the failure is logged in the "closed" fail mode.
+const failureWarnInterval = 5 * time.Minute
+
+// Possible values of Config.Dedup.
+const (
+	dedupTag    = "tag"
+	dedupNoJS   = "nojs"
+	dedupCookie = "cookie"
+)
+
+// Possible values of Config.QueryMode.
+const (
+	queryDrop      = "drop"
+	queryKeep      = "keep"
+	queryAllowlist = "allowlist"
+)
+
+// ConversionEvent maps requests to a revenue-style custom event.
+type ConversionEvent struct {
+	// Name is the name of the custom event.
+	Name string `json:"name"`
+	// Method is the HTTP method to match, any method if empty.
+	Method string `json:"method"`
+	// Path is a regular expression the request path has to match.
+	Path string `json:"path"`
+	// Status is the response status to match, any 2xx status if 0.
+	Status int `json:"status"`
+	// AmountHeader is the response header holding the amount, reported in the `amount` property.
+	AmountHeader string `json:"amountHeader"`
+	// Currency is reported in the `currency` property, if set.
+	Currency string `json:"currency"`
+}
+
+// conversionRule is a ConversionEvent with its path compiled.
+type conversionRule struct {
+	ConversionEvent
+	path *regexp.Regexp
+}
+
+// PathEvent reports requests matching a path as a custom event instead of a pageview.
+type PathEvent struct {
+	// Name is the name of the custom event.
+	Name string `json:"name"`
+	// Method is the HTTP method to match, any method if empty.
+	Method string `json:"method"`
+	// Path is a regular expression the request path has to match.
+	Path string `json:"path"`
+	// Properties are static properties attached to the event.
+	Properties map[string]string `json:"properties"`
+}
+
+// pathEventRule is a PathEvent with its path compiled.
+type pathEventRule struct {
+	PathEvent
+	path *regexp.Regexp
+}
+
+// PathRewrite rewrites the reported path of events, e.g. `/users/\d+` to `/users/:id`.
+type PathRewrite struct {
+	// Regex is a regular expression matched against the path.
+	Regex string `json:"regex"`
+	// Replacement replaces the matches of Regex, it may refer to submatches, e.g. `$1`.
+	Replacement string `json:"replacement"`
+}
+
+// pathRewrite is a PathRewrite with its regex compiled.
+type pathRewrite struct {
+	regex       *regexp.Regexp
+	replacement string
+}
+
 // Config the plugin configuration.
 type Config struct {
 	// Disabled disables the plugin.
 	Disabled bool `json:"disabled"`
 	// Debug enables debug logging, be prepared for flooding.
 	Debug bool `json:"debug"`
+	// CaptureSize defines how many of the last requests are kept with their tracking decision while Debug is enabled,
+	// served on StatusPath. 0 disables the capture.
+	CaptureSize int `json:"captureSize"`
+	// FailMode defines how the plugin behaves while it is disabled by a connection or configuration error.
+	// Either "open" (default), passing traffic silently, or "closed", logging the error periodically
+	// and setting the `X-Rybbit-Feeder: disabled` response header, so broken analytics does not go unnoticed.
+	FailMode string `json:"failMode"`
+	// SkipInvalidConfig defines whether an invalid regular expression or CIDR of a filter is skipped with a warning,
+	// so one typo does not stop tracking for all websites. By default, it disables the plugin.
+	SkipInvalidConfig bool `json:"skipInvalidConfig"`
 	// QueueSize defines the size of queue, i.e. the amount of events that are waiting to be submitted to Rybbit.
 	QueueSize int `json:"queueSize"`
-	// BatchSize defines the amount of events that are submitted to Rybbit in one request, should always be 1.
+	// QueueType defines the queue implementation, either "channel" (default) or "ring".
+	// A ring buffer avoids channel overhead and overwrites the oldest events when full, instead of dropping new ones.
+	QueueType string `json:"queueType"`
+	// QueueShards defines the amount of independent queues (each with its own worker) the queue is split into.
+	// Raising it reduces contention at very high request rates.
+	QueueShards int `json:"queueShards"`
+	// MinWorkers defines the amount of workers submitting events from each queue shard.
+	MinWorkers int `json:"minWorkers"`
+	// MaxWorkers defines up to how many workers are started per queue shard while its queue stays filled.
+	// Extra workers are stopped again once the queue is empty. By default, no extra workers are started.
+	MaxWorkers int `json:"maxWorkers"`
+	// LoadShedding enables sampling (keeping 1 in N events) while the queue is saturated, instead of dropping
+	// all events beyond its capacity. The applied rate is reported in the `sample_rate` property.
+	LoadShedding bool `json:"loadShedding"`
+	// BatchSize defines the amount of events that are submitted to Rybbit in one request.
+	// Instances not accepting batches receive the events of a batch one by one.
 	BatchSize int `json:"batchSize"`
-	// BatchMaxWait defines the maximum time to wait before submitting the batch. Should be 1 second.
+	// BatchMaxWait defines the maximum time to wait before submitting an incomplete batch.
 	BatchMaxWait time.Duration `json:"batchMaxWait"`
+	// QuarantineThreshold enables the quarantine of events if set: once Rybbit rejects events of the same site, type,
+	// name and set of fields this many times in a row with the same client error, further such events are dropped for
+	// QuarantineDuration instead of being submitted.
+	QuarantineThreshold int `json:"quarantineThreshold"`
+	// QuarantineDuration is how long events are dropped once quarantined.
+	QuarantineDuration time.Duration `json:"quarantineDuration"`
+	// RollupInterval enables the rollup mode if set: instead of an event per request, requests are counted per
+	// site, path and status, and one `rollup` custom event per combination is emitted every interval.
+	RollupInterval time.Duration `json:"rollupInterval"`
+	// ErrorSpikeThreshold enables the detection of 5xx spikes if set: once a website responds with this many 5xx
+	// errors within ErrorSpikeWindow, a single `error_spike` custom event with the count and top paths is emitted.
+	ErrorSpikeThreshold int `json:"errorSpikeThreshold"`
+	// ErrorSpikeWindow is the time window 5xx errors are counted in for ErrorSpikeThreshold.
+	ErrorSpikeWindow time.Duration `json:"errorSpikeWindow"`
+	// BandwidthInterval enables the bandwidth accounting if set: the bytes served per website and hostname are
+	// summed up, and one `bandwidth` custom event per hostname is emitted every interval.
+	BandwidthInterval time.Duration `json:"bandwidthInterval"`
+	// AbortRateInterval enables counting the tracked requests whose client disconnected before the response was
+	// written if set, and one `abort_rate` custom event per website is emitted every interval.
+	AbortRateInterval time.Duration `json:"abortRateInterval"`
 
 	// Host is the URL of the Rybbit instance.
 	Host string `json:"host"`
 	// APIKey is the API Key generated in Site Settings for a Rybbit Website
 	APIKey string `json:"apiKey"`
 
-	// Websites is a map of domain to site-id, which is required
+	// HealthPath is the path of the Rybbit instances requested to check they are reachable.
+	HealthPath string `json:"healthPath"`
+	// HealthStatus is the status the health check expects, any 2xx status if 0.
+	HealthStatus int `json:"healthStatus"`
+	// HealthBody is a string the response of the health check has to contain, if set.
+	HealthBody string `json:"healthBody"`
+
+	// MaxIdleConns defines the maximum amount of idle (keep-alive) connections to Rybbit.
+	MaxIdleConns int `json:"maxIdleConns"`
+	// MaxConnsPerHost limits the total amount of connections to Rybbit, 0 means no limit.
+	MaxConnsPerHost int `json:"maxConnsPerHost"`
+	// IdleConnTimeout defines how long an idle connection to Rybbit is kept open.
+	IdleConnTimeout time.Duration `json:"idleConnTimeout"`
+	// DisableHTTP2 disables HTTP/2 for connections to Rybbit.
+	DisableHTTP2 bool `json:"disableHTTP2"`
+
+	// MetaSiteID is a site-id of the top-level host the plugin reports its own health to, as `feeder_health`
+	// custom events with sent and dropped events, send errors and queue fill level. Disabled if empty.
+	MetaSiteID string `json:"metaSiteID"`
+	// MetaInterval defines how often the health is reported to MetaSiteID.
+	MetaInterval time.Duration `json:"metaInterval"`
+
+	// CanarySiteID is a secondary site-id receiving CanaryPercent of the events instead of their website,
+	// e.g. to validate a new Rybbit version or filter configuration against real traffic.
+	CanarySiteID string `json:"canarySiteID"`
+	// CanaryPercent defines the percentage (0-100) of events routed to CanarySiteID.
+	CanaryPercent int `json:"canaryPercent"`
+
+	// Websites is a map of domain to site-id, which is required. A domain may be a wildcard, e.g. `*.example.com`,
+	// matching all its subdomains without an entry of their own, or a regular expression starting with `^`,
+	// e.g. `^(app|api)\.corp\.io$`, matching the hostnames of neither an entry nor a wildcard.
 	Websites map[string]string `json:"websites"`
+	// DefaultWebsite is the site-id of the top-level host used for hostnames matching none of the websites,
+	// so one middleware can cover an entire entrypoint, with websites as per-hostname overrides.
+	DefaultWebsite string `json:"defaultWebsite"`
+	// CreateNewWebsites defines whether a website is created in OrganizationID of the top-level host for hostnames
+	// matching none of the websites, so new domains are tracked without changing the configuration.
+	CreateNewWebsites bool `json:"createNewWebsites"`
+	// ResolveWebsites defines whether the websites of OrganizationID are fetched from the top-level host while
+	// connecting, so their domains are tracked without listing them in Websites. Configured websites take precedence.
+	ResolveWebsites bool `json:"resolveWebsites"`
+	// ResolveInterval is the interval the resolved websites are refreshed at, to pick up websites added later.
+	// 0 disables refreshing.
+	ResolveInterval time.Duration `json:"resolveInterval"`
+	// OrganizationID is the Rybbit organization websites are created in and resolved from.
+	OrganizationID string `json:"organizationId"`
+	// AdminAPIKey is the API key used to create and resolve websites, if it differs from APIKey.
+	AdminAPIKey string `json:"adminApiKey"`
+	// Tenants is a list of further Rybbit instances, each with its own API key and websites.
+	Tenants []Tenant `json:"tenants"`
+
+	// ProxyPath enables the first-party proxy if set, e.g. `/r/track`: requests of the client-side tracker to this path
+	// are not passed on, but forwarded to Rybbit with the API key and the real client IP.
+	ProxyPath string `json:"proxyPath"`
+	// ScriptPath enables serving the Rybbit tracking script first-party if set, e.g. `/r/script.js`. The tracker sends
+	// its events next to the script, i.e. to `/r/track`, which ProxyPath should be set to.
+	ScriptPath string `json:"scriptPath"`
+	// ScriptCacheTTL defines how long the tracking script is cached before it is fetched from Rybbit again.
+	ScriptCacheTTL time.Duration `json:"scriptCacheTTL"`
+	// StatusPath serves the Stats and, with CaptureSize, the captured requests as JSON if set, e.g. `/r/status`.
+	// It is served even while the plugin is disabled, and exposes the visited paths, so restrict its access.
+	StatusPath string `json:"statusPath"`
 
-	// TrackErrors defines whether errors (status codes >= 400) should be tracked.
+	// PausedHostnames is a list of hostnames tracking is paused for.
+	PausedHostnames []string `json:"pausedHostnames"`
+	// PauseFile is a file listing further hostnames to pause tracking for, one per line. It is checked for changes
+	// every PauseFileInterval, so tracking of a site can be paused during an incident without reloading Traefik.
+	PauseFile string `json:"pauseFile"`
+	// PauseFileInterval defines how often PauseFile is checked for changes.
+	PauseFileInterval time.Duration `json:"pauseFileInterval"`
+
+	// TrackErrors defines whether errors (status codes >= 400) should be tracked, both client and server errors.
 	TrackErrors bool `json:"trackErrors"`
+	// TrackClientErrors defines whether client errors (status codes 4xx) should be tracked, e.g. without the 404s
+	// of scanners when only TrackServerErrors is set.
+	TrackClientErrors bool `json:"trackClientErrors"`
+	// TrackServerErrors defines whether server errors (status codes >= 500) should be tracked.
+	TrackServerErrors bool `json:"trackServerErrors"`
+	// TrackStatusCodes is a list of the response status codes to track, replacing the rule tracking errors only with
+	// TrackErrors, e.g. `200`, a range `301-308` or a bound `>=500`.
+	TrackStatusCodes []string `json:"trackStatusCodes"`
+	// IgnoreStatusCodes is a list of response status codes to never track, like TrackStatusCodes.
+	IgnoreStatusCodes []string `json:"ignoreStatusCodes"`
+	// IgnoreRedirects defines whether redirects (3xx but 304 Not Modified) should be ignored, so a redirect followed
+	// by the page it leads to is not counted twice.
+	IgnoreRedirects bool `json:"ignoreRedirects"`
+	// ErrorEvent is the name of the custom event tracked errors are reported as instead of pageviews, e.g.
+	// `http_error`, with `path` and `status` properties. Pageviews are reported if empty.
+	ErrorEvent string `json:"errorEvent"`
+	// StatusClass defines whether the `status_class` property (`2xx`, `3xx`, `4xx` or `5xx`) is attached to every event,
+	// regardless of the other status settings, e.g. for availability dashboards.
+	StatusClass bool `json:"statusClass"`
+	// IgnoreProxyErrors defines whether error responses generated by Traefik itself (e.g. 502/504 for dead backends)
+	// should be ignored. These are recognized by the absence of any header a backend would send.
+	IgnoreProxyErrors bool `json:"ignoreProxyErrors"`
+	// AbortedRequests defines how requests are handled whose client disconnected before the response was written.
+	// One of "track" (default), "ignore" or "tag" (tracked with the `aborted` property).
+	AbortedRequests string `json:"abortedRequests"`
+	// Dedup defines how double counting is avoided if the Rybbit client script is used as well. Either "tag", attaching
+	// the `source` property `server` to every event, "nojs", tracking only clients unlikely to run the script,
+	// or "cookie", tracking only clients without DedupCookie, i.e. those blocking the script. Disabled if empty.
+	Dedup string `json:"dedup"`
+	// DedupCookie is a cookie set by the client script, for the "cookie" dedup mode.
+	DedupCookie string `json:"dedupCookie"`
+	// QueryMode defines which query string is reported with events, so Rybbit can extract e.g. UTM parameters.
+	// One of "drop" (default), "keep" or "allowlist", keeping only the parameters in QueryAllowlist.
+	QueryMode string `json:"queryMode"`
+	// QueryAllowlist is the list of query parameters kept in the "allowlist" query mode. A name ending with `*`
+	// matches all parameters starting with it, e.g. `utm_*`.
+	QueryAllowlist []string `json:"queryAllowlist"`
+	// APIEventMode defines whether requests under APIEventPrefixes are reported as custom events
+	// named "{METHOD} {normalized-path}" with status and latency properties, instead of pageviews.
+	APIEventMode bool `json:"apiEventMode"`
+	// APIEventPrefixes is a list of path prefixes considered API requests.
+	APIEventPrefixes []string `json:"apiEventPrefixes"`
+	// SearchParamNames is a list of query parameters holding site-search terms,
+	// the term is attached as the `search_term` property.
+	SearchParamNames []string `json:"searchParamNames"`
+	// SearchEvents defines whether a `site_search` custom event is emitted in addition for requests with a search term.
+	SearchEvents bool `json:"searchEvents"`
+	// VariantHeader is a request header holding an experiment variant, attached to every event as the `variant` property.
+	VariantHeader string `json:"variantHeader"`
+	// VariantCookie is a cookie holding an experiment variant, used if VariantHeader is not set or missing.
+	VariantCookie string `json:"variantCookie"`
+	// TrackClickIDs defines whether ad click ids (`gclid`, `fbclid`, `msclkid`, `ttclid`) are captured from the
+	// query string into properties of the same name, so paid-traffic attribution works without client-side tracking.
+	// They are stripped from the query string reported by QueryMode.
+	TrackClickIDs bool `json:"trackClickIDs"`
+	// TrackUTM defines whether the UTM campaign parameters (`utm_source`, `utm_medium`, `utm_campaign`, `utm_term`,
+	// `utm_content`) are captured from the query string into properties of the same name.
+	TrackUTM bool `json:"trackUTM"`
+	// TrackMiddleware defines whether the name of the middleware instance is attached as the `middleware` property,
+	// attributing events to the router or entrypoint that captured them if several instances are used.
+	TrackMiddleware bool `json:"trackMiddleware"`
+	// TrackScheme defines whether the scheme of the request (`http` or `https`, honoring X-Forwarded-Proto)
+	// is attached as the `scheme` property, e.g. to monitor residual plain-HTTP traffic during an HTTPS migration.
+	TrackScheme bool `json:"trackScheme"`
+	// TrackProtocol defines whether the HTTP version of the request (`HTTP/1.1`, `HTTP/2` or `HTTP/3`)
+	// is attached as the `protocol` property, e.g. to follow the adoption of HTTP/3 per site.
+	TrackProtocol bool `json:"trackProtocol"`
+	// ProtocolAltUsed defines whether requests with an Alt-Used header are considered HTTP/3 for TrackProtocol.
+	// Clients send it when using an alternative service advertised by Alt-Svc, e.g. HTTP/3 terminated by a proxy
+	// in front of Traefik that forwards the request by an older version.
+	ProtocolAltUsed bool `json:"protocolAltUsed"`
+	// TrackFingerprint defines whether a hash of the request header names and Accept values is attached as the
+	// `fingerprint` property, to tell apart families of scripted clients rotating their IPs and user-agents.
+	TrackFingerprint bool `json:"trackFingerprint"`
+	// LanguageCookie is a cookie holding the UI locale of the application, e.g. `locale=de-DE`,
+	// used as the language of the visitor in preference to the Accept-Language header.
+	LanguageCookie string `json:"languageCookie"`
+	// IdentityHeader is a request header holding the identity of the user, e.g. `X-Auth-Request-Email` as set by a
+	// ForwardAuth middleware placed before this one. A salted hash of it is attached as the `identity` property.
+	IdentityHeader string `json:"identityHeader"`
+	// GroupsHeader is a request header holding the comma-separated groups of the user, attached as the `groups` property.
+	GroupsHeader string `json:"groupsHeader"`
+	// EventIDHeader is a request header set to a random ID on tracked requests, e.g. `X-Rybbit-Event-Id`, attached
+	// to their events as the `event_id` property. Traefik's access log can keep it, to join its lines with the events.
+	EventIDHeader string `json:"eventIdHeader"`
+	// ServerTimingMetrics is a list of metrics of the Server-Timing response header, e.g. `db` or `render`, whose
+	// durations in milliseconds are attached as `timing_{name}` properties.
+	ServerTimingMetrics []string `json:"serverTimingMetrics"`
+	// IdentitySalt is mixed into the identity hash, so it can not be reversed by hashing known identities.
+	IdentitySalt string `json:"identitySalt"`
+	// AnonymizeIP defines whether the client IP is anonymized before the event is queued, by zeroing the last octet
+	// of IPv4 addresses and the last 80 bits of IPv6 addresses.
+	AnonymizeIP bool `json:"anonymizeIP"`
+	// SendIP defines whether the client IP is sent to Rybbit. Disable it if Rybbit geolocates visitors by its own
+	// reverse proxy, or no IP is to be forwarded at all.
+	SendIP bool `json:"sendIP"`
+	// HashIP defines whether the client IP is replaced by a salted hash of it, formatted as an IPv6 address,
+	// so Rybbit still distinguishes visitors without ever receiving their address. It takes precedence over AnonymizeIP.
+	HashIP bool `json:"hashIP"`
+	// IPSalt is the salt of hashed IPs. If empty, a random salt rotated every day is used.
+	IPSalt string `json:"ipSalt"`
+	// SendFields is the list of optional event fields sent to Rybbit: `ip`, `user_agent`, `language`, `referrer`
+	// and `properties`. The site-id, type, path, hostname and name of events are always sent.
+	SendFields []string `json:"sendFields"`
+	// StatusEvents maps response status codes to custom events, e.g. `"401": "auth_failed"`, with `ip`, `path` and
+	// `status` properties. They are emitted regardless of TrackErrors.
+	StatusEvents map[string]string `json:"statusEvents"`
+	// StatusOverrides maps response status codes to the status reported instead, e.g. `"204": 200` for a framework
+	// answering page loads with 204. The reported status applies to TrackErrors, StatusEvents and the properties.
+	StatusOverrides map[string]int `json:"statusOverrides"`
+	// ConversionEvents maps requests, e.g. `POST /checkout/complete` returning 200, to revenue-style custom events.
+	ConversionEvents []ConversionEvent `json:"conversionEvents"`
+	// PathRewrites are applied in order to the path before it is reported, each to the result of the previous one,
+	// so high-cardinality paths are grouped, e.g. `/users/\d+` to `/users/:id`. Filters match the original path.
+	PathRewrites []PathRewrite `json:"pathRewrites"`
+	// Events maps requests to custom events reported instead of pageviews, e.g. `GET /downloads/.*\.zip` to
+	// `file_download`. The first matching entry applies, matching requests are tracked regardless of their resource type.
+	Events []PathEvent `json:"events"`
+	// MaxUserAgentLength, MaxReferrerLength and MaxPathLength define the maximum length in bytes of the respective
+	// event fields, longer values are truncated and end with "…". 0 means no limit.
+	MaxUserAgentLength int `json:"maxUserAgentLength"`
+	MaxReferrerLength  int `json:"maxReferrerLength"`
+	MaxPathLength      int `json:"maxPathLength"`
+	// MaxPropertiesLength defines the maximum length in bytes of the encoded properties of an event,
+	// longer properties are replaced by `{"truncated":true}`. 0 means no limit.
+	MaxPropertiesLength int `json:"maxPropertiesLength"`
 	// TrackAllResources defines whether all requests for any resource should be tracked.
 	// By default, only requests that are believed to contain content are tracked.
 	TrackAllResources bool `json:"trackAllResources"`
 	// TrackExtensions defines an alternative list of file extensions that should be tracked.
 	TrackExtensions []string `json:"trackExtensions"`
+	// DecisionCacheSize defines how many tracking decisions by host and path are cached, so sites with many requests
+	// for the same locations, e.g. assets, skip the URL filters and website lookup. 0 disables the cache.
+	DecisionCacheSize int `json:"decisionCacheSize"`
 
 	// IgnoreUserAgents is a list of user agents to ignore.
 	IgnoreUserAgents []string `json:"ignoreUserAgents"`
+	// IgnoreUserAgentsRegex is a list of regular expressions of user agents to ignore, e.g. `(?i)(bot|spider|crawler)`.
+	IgnoreUserAgentsRegex []string `json:"ignoreUserAgentsRegex"`
+	// IgnoreBots defines whether requests of a built-in list of known bots, crawlers, uptime monitors and
+	// HTTP clients are ignored, in addition to IgnoreUserAgents.
+	IgnoreBots bool `json:"ignoreBots"`
 	// IgnoreURLs is a list of request urls to ignore, each string is converted to RegExp and urls matched against it.
 	IgnoreURLs []string `json:"ignoreURLs"`
+	// AllowURLs is a list of request urls to track exclusively, matched like IgnoreURLs. All urls are tracked if empty.
+	AllowURLs []string `json:"allowURLs"`
+	// IgnoreURLsPathOnly defines whether only the request path is matched against ignoreURLs and allowURLs.
+	// By default, the query string is included, i.e. `/path?query`.
+	IgnoreURLsPathOnly bool `json:"ignoreURLsPathOnly"`
+	// TrackMethods is a list of HTTP methods to track exclusively, e.g. `["GET", "HEAD"]`. All methods are tracked if empty.
+	TrackMethods []string `json:"trackMethods"`
+	// IgnoreMethods is a list of HTTP methods to ignore, e.g. `["OPTIONS"]` for CORS preflights.
+	IgnoreMethods []string `json:"ignoreMethods"`
+	// WebsiteFilters overrides IgnoreURLs, AllowURLs, TrackErrors, TrackAllResources and TrackExtensions per
+	// websites entry, by the same key as in Websites, e.g. to track PDFs on one website only.
+	WebsiteFilters map[string]WebsiteFilter `json:"websiteFilters"`
+	// ShadowFilter is a proposed replacement of the filters WebsiteFilters can override, evaluated alongside the
+	// active ones without being applied. How many events it would add or remove is logged every minute.
+	ShadowFilter *WebsiteFilter `json:"shadowFilter"`
 	// IgnoreIPs is a list of IPs or CIDRs to ignore.
 	IgnoreIPs []string `json:"ignoreIPs"`
+	// IgnoreIPv6PrefixLength defines the prefix length applied to bare IPv6 addresses of IgnoreIPs, so the whole
+	// network of a visitor is ignored, as residential IPv6 addresses rotate within a /64. 0 matches the exact address.
+	IgnoreIPv6PrefixLength int `json:"ignoreIPv6PrefixLength"`
+	// RespectDoNotTrack defines whether requests with the `DNT: 1` or `Sec-GPC: 1` header are ignored.
+	RespectDoNotTrack bool `json:"respectDoNotTrack"`
+	// MinBotScore ignores requests with a Cloudflare bot score (1 = bot, 99 = human) below it, 0 disables the check.
+	// Requires the bot score header, e.g. added by the "Add bot protection headers" managed transform.
+	MinBotScore int `json:"minBotScore"`
+	// IgnoreVerifiedBots ignores requests Cloudflare marks as coming from a verified bot, e.g. search engine crawlers.
+	IgnoreVerifiedBots bool `json:"ignoreVerifiedBots"`
+	// BotScoreHeader is the request header holding the Cloudflare bot score.
+	BotScoreHeader string `json:"botScoreHeader"`
+	// VerifiedBotHeader is the request header holding whether Cloudflare verified the request as coming from a bot.
+	VerifiedBotHeader string `json:"verifiedBotHeader"`
 	// headerIp Header associated to real IP
 	HeaderIp string `json:"headerIp"`
+	// TrustedProxies is a list of IP addresses or CIDR ranges of proxies in front of Traefik. If set, the client IP
+	// is the first hop of the X-Forwarded-For chain, read from the right, that is not a trusted proxy, and headerIp
+	// is not used.
+	TrustedProxies []string `json:"trustedProxies"`
 }
 
 // CreateConfig creates the default plugin configuration.
@@ -59,23 +427,141 @@ func CreateConfig() *Config {
 	return &Config{
 		Disabled:     false,
 		Debug:        false,
+		CaptureSize:  0,
+		FailMode:     failOpen,
 		QueueSize:    1000,
+		QueueType:    queueTypeChannel,
+		QueueShards:  1,
+		MinWorkers:   1,
+		MaxWorkers:   1,
+		LoadShedding: false,
 		BatchSize:    20,
 		BatchMaxWait: 5 * time.Second,
 		TrackErrors:  false,
+		ErrorEvent:   "",
+		StatusClass:  false,
+
+		TrackClientErrors: false,
+		TrackServerErrors: false,
+		TrackStatusCodes:  []string{},
+		IgnoreStatusCodes: []string{},
+		IgnoreRedirects:   false,
+		SkipInvalidConfig: false,
+
+		RollupInterval:      0,
+		ErrorSpikeThreshold: 0,
+		ErrorSpikeWindow:    time.Minute,
+		BandwidthInterval:   0,
+		AbortRateInterval:   0,
+		QuarantineThreshold: 0,
+		QuarantineDuration:  time.Hour,
+
+		AbortedRequests: abortedTrack,
+		Dedup:           "",
+		DedupCookie:     "",
+		QueryMode:       queryDrop,
+		QueryAllowlist:  []string{},
 
 		Host:   "",
 		APIKey: "",
 
-		Websites: map[string]string{},
+		HealthPath:   "/api/script.js",
+		HealthStatus: 0,
+		HealthBody:   "",
+
+		MaxIdleConns:    100,
+		MaxConnsPerHost: 0,
+		IdleConnTimeout: 90 * time.Second,
+		DisableHTTP2:    false,
+
+		MetaSiteID:   "",
+		MetaInterval: time.Minute,
+
+		CanarySiteID:  "",
+		CanaryPercent: 0,
+
+		Websites:       map[string]string{},
+		DefaultWebsite: "",
+		Tenants:        []Tenant{},
+
+		CreateNewWebsites: false,
+		OrganizationID:    "",
+		AdminAPIKey:       "",
+
+		ResolveWebsites: false,
+		ResolveInterval: 5 * time.Minute,
+
+		ProxyPath:      "",
+		ScriptPath:     "",
+		ScriptCacheTTL: time.Hour,
+		StatusPath:     "",
+
+		PausedHostnames:   []string{},
+		PauseFile:         "",
+		PauseFileInterval: 10 * time.Second,
+
+		APIEventMode:     false,
+		APIEventPrefixes: []string{"/api/"},
+
+		SearchParamNames: []string{"q", "s", "query"},
+		SearchEvents:     false,
+
+		VariantHeader:    "",
+		VariantCookie:    "",
+		TrackClickIDs:    false,
+		TrackUTM:         false,
+		TrackMiddleware:  false,
+		TrackScheme:      false,
+		TrackProtocol:    false,
+		ProtocolAltUsed:  false,
+		TrackFingerprint: false,
+		LanguageCookie:   "",
+		IdentityHeader:   "",
+		GroupsHeader:     "",
+		EventIDHeader:    "",
+		IdentitySalt:     "",
+		AnonymizeIP:      false,
+		SendIP:           true,
+		HashIP:           false,
+		IPSalt:           "",
+		StatusEvents:     map[string]string{},
+		StatusOverrides:  map[string]int{},
+		ConversionEvents: []ConversionEvent{},
+		PathRewrites:     []PathRewrite{},
+		Events:           []PathEvent{},
+
+		ServerTimingMetrics: []string{},
+		SendFields:          []string{fieldIP, fieldUserAgent, fieldLanguage, fieldReferrer, fieldProperties},
+
+		MaxUserAgentLength:  512,
+		MaxReferrerLength:   1024,
+		MaxPathLength:       1024,
+		MaxPropertiesLength: 2048,
 
 		TrackAllResources: false,
 		TrackExtensions:   []string{},
+		DecisionCacheSize: 0,
 
 		IgnoreUserAgents: []string{},
+		IgnoreBots:       false,
 		IgnoreURLs:       []string{},
+		AllowURLs:        []string{},
+		TrackMethods:     []string{},
+		IgnoreMethods:    []string{},
+		WebsiteFilters:   map[string]WebsiteFilter{},
+		ShadowFilter:     nil,
 		IgnoreIPs:        []string{},
 		HeaderIp:         "X-Real-Ip",
+
+		IgnoreUserAgentsRegex:  []string{},
+		TrustedProxies:         []string{},
+		IgnoreIPv6PrefixLength: 64,
+
+		RespectDoNotTrack:  false,
+		MinBotScore:        0,
+		IgnoreVerifiedBots: false,
+		BotScoreHeader:     "Cf-Bot-Score",
+		VerifiedBotHeader:  "Cf-Verified-Bot",
 	}
 }
 
@@ -84,63 +570,427 @@ type UmamiFeeder struct {
 	next       http.Handler
 	name       string
 	isDebug    bool
-	isDisabled bool
+	captures   *captureBuffer
+	isDisabled atomic.Bool // written by the connection goroutine, read on every request
+	failMode   string
+	failure    atomic.Value // string, the error disabling the plugin, empty once connected
 	logHandler *log.Logger
-	queue      chan *RybbitEvent
+	queue      *eventQueue
+
+	loadShedding  bool
+	sampleRate    atomic.Uint32 // 1 in sampleRate events are kept, adjusted by adjustSampling
+	sampleCounter atomic.Uint32
 
-	batchSize    int
-	batchMaxWait time.Duration
+	rollupInterval time.Duration // rollup mode is enabled if set
+	rollup         *intervalCounter
+	errorSpikes    *errorSpikes     // nil unless ErrorSpikeThreshold is set
+	bandwidth      *intervalCounter // nil unless BandwidthInterval is set
+	abortRates     *intervalCounter // nil unless AbortRateInterval is set
 
 	host              string
 	apiKey            string
+	client            *http.Client
+	healthPath        string
+	healthStatus      int
+	healthBody        string
+	tenants           []*tenant // the top-level host first, if configured
 	websites          map[string]string
+	defaultWebsite    string
+	websiteTenants    map[string]*tenant // websites of the configured tenants, the others belong to the top-level host
 	websitesMutex     sync.RWMutex
+	hasWildcards      bool             // any of the websites is a wildcard, e.g. `*.example.com`
+	websitePatterns   []*regexp.Regexp // websites given as regular expressions, sorted by pattern
 	createNewWebsites bool
 
-	trackErrors       bool
+	organizationID  string
+	adminAPIKey     string
+	createdWebsites int                  // websites created or being created, guarded by websitesMutex
+	pendingWebsites map[string]struct{}  // hostnames being created, guarded by websitesMutex
+	failedWebsites  map[string]time.Time // hostnames whose creation failed, guarded by websitesMutex
+
+	resolveWebsites  bool
+	resolveInterval  time.Duration
+	resolvedWebsites map[string]struct{} // websites fetched from the organization, guarded by websitesMutex
+
+	proxyPath      string
+	scriptPath     string
+	scriptCacheTTL time.Duration
+	scripts        map[string]*cachedScript // by tenant host
+	scriptsMutex   sync.Mutex
+	statusPath     string
+
+	paused            atomic.Value // map[string]struct{} of the hostnames tracking is paused for
+	pausedHostnames   []string
+	pauseFile         string
+	pauseFileInterval time.Duration
+
+	reported     Stats // the snapshot of the last health report, only used by healthEvent
+	metaSiteID   string
+	metaInterval time.Duration
+
+	canarySiteID  string
+	canaryPercent int
+
+	trackClientErrors bool
+	trackServerErrors bool
+	trackStatusCodes  []statusRange
+	ignoreStatusCodes []statusRange
+	ignoreRedirects   bool
+	errorEvent        string
+	statusClass       bool
+	ignoreProxyErrors bool
+	abortedRequests   string
+	dedup             string
+	dedupCookie       string
+	queryMode         string
+	queryAllowlist    []string
+	apiEventPrefixes  []string // only set in APIEventMode
+	searchParamNames  []string
+	searchEvents      bool
+	variantHeader     string
+	variantCookie     string
+	trackClickIDs     bool
+	trackUTM          bool
+	trackMiddleware   bool
+	trackScheme       bool
+	trackProtocol     bool
+	protocolAltUsed   bool
+	trackFingerprint  bool
+	languageCookie    string
+	identityHeader    string
+	groupsHeader      string
+	eventIDHeader     string
+	serverTiming      []string
+	identitySalt      string
+	anonymizeIP       bool
+	omitIP            bool
+	hashIP            bool
+	ipSalt            string
+	statusEvents      map[int]string
+	statusOverrides   map[int]int
+	conversionRules   []conversionRule
+	pathRewrites      []pathRewrite
+	pathEvents        []pathEventRule
+
+	omitUserAgent  bool // the optional event fields excluded by SendFields, see stripFields
+	omitLanguage   bool
+	omitReferrer   bool
+	omitProperties bool
+
+	maxUserAgentLength  int
+	maxReferrerLength   int
+	maxPathLength       int
+	maxPropertiesLength int
+
 	trackAllResources bool
 	trackExtensions   []string
+	decisions         *decisionCache // nil unless DecisionCacheSize is set
 
-	ignoreUserAgents []string
-	ignoreRegexps    []regexp.Regexp
+	hasFilters       bool           // any of the ignore filters below, except the URL filters, is configured
+	ignoreUserAgents *regexp.Regexp // all ignoreUserAgents and ignoreUserAgentsRegex combined into one alternation
+	ignoreBots       *botMatcher    // knownBots, if IgnoreBots is enabled
+	ignoreRegexp     *regexp.Regexp // all ignoreURLs combined into one alternation
+	allowRegexp      *regexp.Regexp // all allowURLs combined into one alternation
+	trackMethods     map[string]bool
+	ignoreMethods    map[string]bool
+	urlsPathOnly     bool
+	websiteFilters   map[string]*websiteFilter // filter overrides by websites entry
+	shadowFilter     *websiteFilter            // evaluated, but not applied, if ShadowFilter is set
+	shadowStats      shadowStats
 	ignorePrefixes   []netip.Prefix
 	headerIp         string
+
+	respectDoNotTrack  bool
+	trustedProxies     []netip.Prefix
+	minBotScore        int
+	ignoreVerifiedBots bool
+	botScoreHeader     string
+	verifiedBotHeader  string
 }
 
+// Upper bounds of the batching parameters, anything above is considered a configuration mistake.
+const (
+	maxQueueSize    = 1_000_000
+	maxQueueShards  = 256
+	maxWorkers      = 64
+	maxBatchSize    = 1000
+	maxBatchMaxWait = 10 * time.Minute
+
+	maxRollupInterval = 24 * time.Hour
+	minFieldLength    = 32
+)
+
 // New created a new Demo plugin.
 func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
+	if config.QueueSize <= 0 || config.QueueSize > maxQueueSize {
+		return nil, fmt.Errorf("invalid queueSize %d, expected a value between 1 and %d", config.QueueSize, maxQueueSize)
+	}
+	if config.MaxIdleConns < 0 || config.MaxConnsPerHost < 0 || config.IdleConnTimeout < 0 {
+		return nil, fmt.Errorf("invalid transport configuration, maxIdleConns, maxConnsPerHost and idleConnTimeout must not be negative")
+	}
+	if config.QueueType != "" && config.QueueType != queueTypeChannel && config.QueueType != queueTypeRing {
+		return nil, fmt.Errorf("invalid queueType %s, expected one of: %s, %s", config.QueueType, queueTypeChannel, queueTypeRing)
+	}
+	if config.QueueShards <= 0 || config.QueueShards > maxQueueShards || config.QueueShards > config.QueueSize {
+		return nil, fmt.Errorf("invalid queueShards %d, expected a value between 1 and %d, not exceeding queueSize",
+			config.QueueShards, maxQueueShards)
+	}
+	if config.MinWorkers <= 0 || config.MinWorkers > maxWorkers {
+		return nil, fmt.Errorf("invalid minWorkers %d, expected a value between 1 and %d", config.MinWorkers, maxWorkers)
+	}
+	if config.MaxWorkers < config.MinWorkers || config.MaxWorkers > maxWorkers {
+		return nil, fmt.Errorf("invalid maxWorkers %d, expected a value between minWorkers %d and %d",
+			config.MaxWorkers, config.MinWorkers, maxWorkers)
+	}
+	if config.BatchSize <= 0 || config.BatchSize > maxBatchSize {
+		return nil, fmt.Errorf("invalid batchSize %d, expected a value between 1 and %d", config.BatchSize, maxBatchSize)
+	}
+	if config.BatchSize > config.QueueSize {
+		return nil, fmt.Errorf("invalid batchSize %d, should not exceed queueSize %d", config.BatchSize, config.QueueSize)
+	}
+	if config.BatchMaxWait <= 0 || config.BatchMaxWait > maxBatchMaxWait {
+		return nil, fmt.Errorf("invalid batchMaxWait %v, expected a value between 0s and %v", config.BatchMaxWait, maxBatchMaxWait)
+	}
+	if config.RollupInterval < 0 || config.RollupInterval > maxRollupInterval {
+		return nil, fmt.Errorf("invalid rollupInterval %v, expected a value between 0s and %v", config.RollupInterval, maxRollupInterval)
+	}
+	if config.BandwidthInterval < 0 || config.BandwidthInterval > maxRollupInterval {
+		return nil, fmt.Errorf("invalid bandwidthInterval %v, expected a value between 0s and %v", config.BandwidthInterval, maxRollupInterval)
+	}
+	if config.AbortRateInterval < 0 || config.AbortRateInterval > maxRollupInterval {
+		return nil, fmt.Errorf("invalid abortRateInterval %v, expected a value between 0s and %v", config.AbortRateInterval, maxRollupInterval)
+	}
+	if config.QuarantineThreshold < 0 || config.QuarantineThreshold > 0 && config.QuarantineDuration <= 0 {
+		return nil, fmt.Errorf("invalid quarantineThreshold %d or quarantineDuration %v, expected positive values",
+			config.QuarantineThreshold, config.QuarantineDuration)
+	}
+	if config.ErrorSpikeThreshold < 0 || config.ErrorSpikeThreshold > 0 && config.ErrorSpikeWindow <= 0 {
+		return nil, fmt.Errorf("invalid errorSpikeThreshold %d or errorSpikeWindow %v, expected positive values",
+			config.ErrorSpikeThreshold, config.ErrorSpikeWindow)
+	}
+	if config.DefaultWebsite != "" && config.Host == "" {
+		return nil, fmt.Errorf("defaultWebsite requires host to be set")
+	}
+	if config.CreateNewWebsites && (config.Host == "" || config.OrganizationID == "" || config.DefaultWebsite != "") {
+		return nil, fmt.Errorf("createNewWebsites requires host and organizationId to be set, and no defaultWebsite")
+	}
+	if config.ResolveWebsites && (config.Host == "" || config.OrganizationID == "" || config.ResolveInterval < 0) {
+		return nil, fmt.Errorf("resolveWebsites requires host and organizationId to be set, and a resolveInterval of at least 0s")
+	}
+	if config.MetaSiteID != "" && (config.Host == "" || config.MetaInterval <= 0) {
+		return nil, fmt.Errorf("metaSiteID requires host to be set and a positive metaInterval")
+	}
+	if config.CanaryPercent < 0 || config.CanaryPercent > 100 || config.CanaryPercent > 0 && config.CanarySiteID == "" {
+		return nil, fmt.Errorf("invalid canaryPercent %d, expected a value between 0 and 100 and canarySiteID to be set", config.CanaryPercent)
+	}
+	for name, length := range map[string]int{
+		"maxUserAgentLength":  config.MaxUserAgentLength,
+		"maxReferrerLength":   config.MaxReferrerLength,
+		"maxPathLength":       config.MaxPathLength,
+		"maxPropertiesLength": config.MaxPropertiesLength,
+	} {
+		if length != 0 && length < minFieldLength {
+			return nil, fmt.Errorf("invalid %s %d, expected 0 (no limit) or at least %d", name, length, minFieldLength)
+		}
+	}
+	if !strings.HasPrefix(config.HealthPath, "/") || config.HealthStatus < 0 || config.HealthStatus > 599 {
+		return nil, fmt.Errorf("invalid healthPath %s or healthStatus %d, expected an absolute path and a status code",
+			config.HealthPath, config.HealthStatus)
+	}
+	if config.FailMode != "" && config.FailMode != failOpen && config.FailMode != failClosed {
+		return nil, fmt.Errorf("invalid failMode %s, expected one of: %s, %s", config.FailMode, failOpen, failClosed)
+	}
+	if config.ProxyPath != "" && !strings.HasPrefix(config.ProxyPath, "/") {
+		return nil, fmt.Errorf("invalid proxyPath %s, expected an absolute path", config.ProxyPath)
+	}
+	if config.ScriptPath != "" && (!strings.HasPrefix(config.ScriptPath, "/") || config.ScriptCacheTTL <= 0) {
+		return nil, fmt.Errorf("invalid scriptPath %s, expected an absolute path and a positive scriptCacheTTL", config.ScriptPath)
+	}
+	if config.StatusPath != "" && !strings.HasPrefix(config.StatusPath, "/") {
+		return nil, fmt.Errorf("invalid statusPath %s, expected an absolute path", config.StatusPath)
+	}
+	if config.PauseFile != "" && config.PauseFileInterval <= 0 {
+		return nil, fmt.Errorf("invalid pauseFileInterval %v, expected a positive duration", config.PauseFileInterval)
+	}
+	if config.CaptureSize < 0 || config.CaptureSize > maxCaptureSize {
+		return nil, fmt.Errorf("invalid captureSize %d, expected a value between 0 and %d", config.CaptureSize, maxCaptureSize)
+	}
+	if config.AbortedRequests != "" && config.AbortedRequests != abortedTrack && config.AbortedRequests != abortedIgnore &&
+		config.AbortedRequests != abortedTag {
+		return nil, fmt.Errorf("invalid abortedRequests %s, expected one of: %s, %s, %s",
+			config.AbortedRequests, abortedTrack, abortedIgnore, abortedTag)
+	}
+	if config.QueryMode != "" && config.QueryMode != queryDrop && config.QueryMode != queryKeep && config.QueryMode != queryAllowlist {
+		return nil, fmt.Errorf("invalid queryMode %s, expected one of: %s, %s, %s", config.QueryMode, queryDrop, queryKeep, queryAllowlist)
+	}
+	if config.QueryMode == queryAllowlist && len(config.QueryAllowlist) == 0 {
+		return nil, fmt.Errorf("queryMode %s requires queryAllowlist to be set", queryAllowlist)
+	}
+	if config.Dedup != "" && config.Dedup != dedupTag && config.Dedup != dedupNoJS && config.Dedup != dedupCookie {
+		return nil, fmt.Errorf("invalid dedup %s, expected one of: %s, %s, %s", config.Dedup, dedupTag, dedupNoJS, dedupCookie)
+	}
+	if config.Dedup == dedupCookie && config.DedupCookie == "" {
+		return nil, fmt.Errorf("dedup %s requires dedupCookie to be set", dedupCookie)
+	}
+	if config.IgnoreIPv6PrefixLength < 0 || config.IgnoreIPv6PrefixLength > 128 {
+		return nil, fmt.Errorf("invalid ignoreIPv6PrefixLength %d, expected a value between 0 and 128", config.IgnoreIPv6PrefixLength)
+	}
+	if config.MinBotScore < 0 || config.MinBotScore > 99 {
+		return nil, fmt.Errorf("invalid minBotScore %d, expected a value between 0 and 99", config.MinBotScore)
+	}
+	if config.MinBotScore > 0 && config.BotScoreHeader == "" || config.IgnoreVerifiedBots && config.VerifiedBotHeader == "" {
+		return nil, fmt.Errorf("minBotScore and ignoreVerifiedBots require botScoreHeader and verifiedBotHeader to be set")
+	}
+
 	// construct
 	h := &UmamiFeeder{
 		next:       next,
 		name:       name,
 		isDebug:    config.Debug,
-		isDisabled: config.Disabled,
+		failMode:   config.FailMode,
 		logHandler: log.New(os.Stdout, "", 0),
 
-		queue:        make(chan *RybbitEvent, config.QueueSize),
-		batchSize:    config.BatchSize,
-		batchMaxWait: 1 * time.Second,
+		loadShedding: config.LoadShedding,
+
+		rollupInterval: config.RollupInterval,
+
+		host:           config.Host,
+		apiKey:         config.APIKey,
+		client:         newHTTPClient(config),
+		healthPath:     config.HealthPath,
+		healthStatus:   config.HealthStatus,
+		healthBody:     config.HealthBody,
+		defaultWebsite: config.DefaultWebsite,
+		websiteTenants: map[string]*tenant{},
+		websitesMutex:  sync.RWMutex{},
+		metaSiteID:     config.MetaSiteID,
+		metaInterval:   config.MetaInterval,
+		canarySiteID:   config.CanarySiteID,
+		canaryPercent:  config.CanaryPercent,
 
-		host:          config.Host,
-		apiKey:        config.APIKey,
-		websites:      config.Websites,
-		websitesMutex: sync.RWMutex{},
+		createNewWebsites: config.CreateNewWebsites,
+		organizationID:    config.OrganizationID,
+		adminAPIKey:       config.AdminAPIKey,
 
-		trackErrors:       config.TrackErrors,
+		resolveWebsites: config.ResolveWebsites,
+		resolveInterval: config.ResolveInterval,
+
+		proxyPath:      config.ProxyPath,
+		scriptPath:     config.ScriptPath,
+		scriptCacheTTL: config.ScriptCacheTTL,
+		scripts:        map[string]*cachedScript{},
+		statusPath:     config.StatusPath,
+
+		pausedHostnames:   config.PausedHostnames,
+		pauseFile:         config.PauseFile,
+		pauseFileInterval: config.PauseFileInterval,
+
+		trackClientErrors: config.TrackErrors || config.TrackClientErrors,
+		trackServerErrors: config.TrackErrors || config.TrackServerErrors,
+		ignoreRedirects:   config.IgnoreRedirects,
+		errorEvent:        config.ErrorEvent,
+		statusClass:       config.StatusClass,
+		ignoreProxyErrors: config.IgnoreProxyErrors,
+		abortedRequests:   config.AbortedRequests,
+		dedup:             config.Dedup,
+		dedupCookie:       config.DedupCookie,
+		queryMode:         config.QueryMode,
+		queryAllowlist:    config.QueryAllowlist,
+		searchParamNames:  config.SearchParamNames,
+		searchEvents:      config.SearchEvents,
+		variantHeader:     config.VariantHeader,
+		variantCookie:     config.VariantCookie,
+		trackClickIDs:     config.TrackClickIDs,
+		trackUTM:          config.TrackUTM,
+		trackMiddleware:   config.TrackMiddleware,
+		trackScheme:       config.TrackScheme,
+		trackProtocol:     config.TrackProtocol,
+		protocolAltUsed:   config.ProtocolAltUsed,
+		trackFingerprint:  config.TrackFingerprint,
+		languageCookie:    config.LanguageCookie,
+		identityHeader:    config.IdentityHeader,
+		groupsHeader:      config.GroupsHeader,
+		eventIDHeader:     config.EventIDHeader,
+		serverTiming:      config.ServerTimingMetrics,
+		identitySalt:      config.IdentitySalt,
+		anonymizeIP:       config.AnonymizeIP,
+		omitIP:            !config.SendIP,
+		hashIP:            config.HashIP,
+		ipSalt:            config.IPSalt,
 		trackAllResources: config.TrackAllResources,
 		trackExtensions:   config.TrackExtensions,
+		decisions:         newDecisionCache(config.DecisionCacheSize),
 
-		ignoreUserAgents: config.IgnoreUserAgents,
-		ignoreRegexps:    []regexp.Regexp{},
-		ignorePrefixes:   []netip.Prefix{},
-		headerIp:         config.HeaderIp,
+		maxUserAgentLength:  config.MaxUserAgentLength,
+		maxReferrerLength:   config.MaxReferrerLength,
+		maxPathLength:       config.MaxPathLength,
+		maxPropertiesLength: config.MaxPropertiesLength,
+
+		urlsPathOnly:   config.IgnoreURLsPathOnly,
+		ignorePrefixes: []netip.Prefix{},
+		headerIp:       config.HeaderIp,
+	}
+	if config.Debug {
+		h.captures = newCaptureBuffer(config.CaptureSize)
 	}
 
-	if !h.isDisabled {
-		h.isDisabled = true
-		h.debug("batchSize %d", h.batchSize)
-		h.debug("batchMaxWait %v", h.batchMaxWait)
+	if err := h.setupTenants(ctx, config); err != nil {
+		return nil, err
+	}
+
+	if err := h.loadPaused(); err != nil {
+		return nil, fmt.Errorf("failed to read pauseFile: %w", err)
+	}
+
+	sendFields := map[string]bool{}
+	for _, field := range config.SendFields {
+		switch field {
+		case fieldIP, fieldUserAgent, fieldLanguage, fieldReferrer, fieldProperties:
+			sendFields[field] = true
+		default:
+			return nil, fmt.Errorf("invalid sendFields entry %s, expected any of: %s, %s, %s, %s, %s",
+				field, fieldIP, fieldUserAgent, fieldLanguage, fieldReferrer, fieldProperties)
+		}
+	}
+	h.omitIP = h.omitIP || !sendFields[fieldIP]
+	h.omitUserAgent, h.omitLanguage = !sendFields[fieldUserAgent], !sendFields[fieldLanguage]
+	h.omitReferrer, h.omitProperties = !sendFields[fieldReferrer], !sendFields[fieldProperties]
+
+	h.isDisabled.Store(true)
+	h.sampleRate.Store(1)
+	if h.adminAPIKey == "" {
+		h.adminAPIKey = h.apiKey
+	}
+	if h.rollupInterval > 0 {
+		h.rollup = newRollup(h.rollupInterval)
+	}
+	if config.ErrorSpikeThreshold > 0 {
+		h.errorSpikes = newErrorSpikes(config.ErrorSpikeThreshold, config.ErrorSpikeWindow)
+	}
+	if config.BandwidthInterval > 0 {
+		h.bandwidth = newBandwidth(config.BandwidthInterval)
+	}
+	if config.AbortRateInterval > 0 {
+		h.abortRates = newAbortRates(config.AbortRateInterval)
+	}
+	if config.APIEventMode {
+		h.apiEventPrefixes = config.APIEventPrefixes
+	}
+
+	if !config.Disabled {
+		h.debug("queueShards %d", len(h.queue.shards))
+		h.debug("batchSize %d", config.BatchSize)
+		h.debug("batchMaxWait %v", config.BatchMaxWait)
+		if h.rollup != nil {
+			h.debug("rollupInterval %v", h.rollupInterval)
+		}
 		go h.retryConnection(ctx, config)
+		if h.failMode == failClosed {
+			go h.warnFailure(ctx)
+		}
+		if h.pauseFile != "" {
+			go h.watchPauseFile(ctx)
+		}
 	}
 
 	return h, nil
@@ -172,18 +1022,46 @@ func (h *UmamiFeeder) retryConnection(ctx context.Context, config *Config) {
 
 				err = h.verifyConfig(config)
 				if err == nil {
-					h.debug("Configuration verified. Enabling plugin and starting worker.")
-					h.isDisabled = false
-					go h.startWorker(ctx)
+					h.debug("Configuration verified. Enabling plugin and starting workers for %d tenant(s) with %d queue shard(s).",
+						len(h.tenants), len(h.queue.shards))
+					h.isDisabled.Store(false)
+					h.failure.Store("")
+					for _, t := range h.tenants {
+						h.startWorkers(t)
+					}
+					if h.loadShedding {
+						go h.adjustSampling(ctx)
+					}
+					if h.rollup != nil {
+						go h.emitIntervals(ctx, h.rollup, h.flushRollup)
+					}
+					if h.bandwidth != nil {
+						go h.emitIntervals(ctx, h.bandwidth, h.flushBandwidth)
+					}
+					if h.abortRates != nil {
+						go h.emitIntervals(ctx, h.abortRates, h.flushAbortRates)
+					}
+					if h.metaSiteID != "" {
+						go h.emitHealth(ctx)
+					}
+					if h.resolveWebsites && h.resolveInterval > 0 {
+						go h.refreshWebsites(ctx)
+					}
+					if h.shadowFilter != nil {
+						go h.reportShadow(ctx)
+					}
 					return // Successfully connected and configured, exit retry goroutine
 				}
 
 				h.error("configuration error, the plugin is disabled: " + err.Error())
-				h.isDisabled = true
+				h.failure.Store("configuration error: " + err.Error())
+				h.isDisabled.Store(true)
+				h.sampleRate.Store(1)
 				return // Exit retry goroutine, plugin remains disabled.
 			}
 
 			h.error("Failed to reconnect to Rybbit: " + err.Error())
+			h.failure.Store("failed to connect to Rybbit: " + err.Error())
 		case <-ctx.Done():
 			h.debug("Context cancelled during retryConnection, stopping connection retries.")
 			return
@@ -191,162 +1069,545 @@ func (h *UmamiFeeder) retryConnection(ctx context.Context, config *Config) {
 	}
 }
 
+// warnFailure logs the error disabling the plugin every failureWarnInterval, until ctx is canceled.
+func (h *UmamiFeeder) warnFailure(ctx context.Context) {
+	ticker := time.NewTicker(failureWarnInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if failure, _ := h.failure.Load().(string); failure != "" && h.isDisabled.Load() {
+				h.error("ANALYTICS DISABLED, no events are tracked: " + failure)
+			}
+		}
+	}
+}
+
 func (h *UmamiFeeder) connect(ctx context.Context, config *Config) error {
-	if h.host == "" {
+	if h.host == "" && len(config.Tenants) == 0 {
 		return fmt.Errorf("`host` is not set")
 	}
 
-	if h.apiKey == "" {
+	if h.host != "" && h.apiKey == "" {
 		return fmt.Errorf("`apiKey` should be set")
 	}
 
-	if len(h.websites) == 0 {
+	if h.resolveWebsites {
+		if err := h.loadWebsites(ctx); err != nil {
+			return fmt.Errorf("failed to resolve websites: %w", err)
+		}
+	}
+
+	h.websitesMutex.RLock()
+	websiteCount := len(h.websites)
+	h.websitesMutex.RUnlock()
+	if websiteCount == 0 && h.defaultWebsite == "" {
 		return fmt.Errorf("`websites` should not be empty")
 	}
 
-	_, err := sendRequest(ctx, h.host+"/api/script.js", nil, nil)
-	if err != nil {
-		return fmt.Errorf("Failed to get health for rybbit: %w", err)
+	for i, t := range h.tenants {
+		// Instances sharing the tenant with the same expectations share a check in flight, see checkHealth.
+		err := h.checkHealth(ctx, t)
+		if err == nil {
+			continue
+		}
+
+		// The top-level host is required, tenants are isolated and only affect their own websites.
+		if i == 0 && h.host != "" {
+			return fmt.Errorf("Failed to get health for rybbit: %w", err)
+		}
+		h.error(fmt.Sprintf("Failed to get health for rybbit tenant %s: %v", t.host, err))
 	}
 
 	return nil
 }
 
 func (h *UmamiFeeder) verifyConfig(config *Config) error {
-	if len(config.IgnoreIPs) > 0 {
-		for _, ignoreIp := range config.IgnoreIPs {
-			network, err := netip.ParsePrefix(ignoreIp)
-			if err != nil {
-				network, err = netip.ParsePrefix(ignoreIp + "/32")
-			}
+	for _, method := range config.TrackMethods {
+		if h.trackMethods == nil {
+			h.trackMethods = map[string]bool{}
+		}
+		h.trackMethods[strings.ToUpper(method)] = true
+	}
 
-			if err != nil || !network.IsValid() {
-				return fmt.Errorf("invalid ignoreIp given %s: %w", ignoreIp, err)
+	for _, method := range config.IgnoreMethods {
+		if h.ignoreMethods == nil {
+			h.ignoreMethods = map[string]bool{}
+		}
+		h.ignoreMethods[strings.ToUpper(method)] = true
+	}
+
+	// Skips invalid entries of filters with a warning, if skipInvalidConfig is set.
+	skipInvalid := func(err error) error {
+		if !config.SkipInvalidConfig {
+			return err
+		}
+		h.warn(err.Error() + ", skipping it")
+		return nil
+	}
+
+	for _, ignoreIp := range config.IgnoreIPs {
+		network, err := parseIgnoreIP(ignoreIp, config.IgnoreIPv6PrefixLength)
+		if err != nil {
+			if err := skipInvalid(fmt.Errorf("invalid ignoreIp given %s, expected an IPv4 or IPv6 address or CIDR: %w", ignoreIp, err)); err != nil {
+				return err
 			}
+			continue
+		}
+
+		h.ignorePrefixes = append(h.ignorePrefixes, network)
+	}
 
-			h.ignorePrefixes = append(h.ignorePrefixes, network)
+	for _, trustedProxy := range config.TrustedProxies {
+		network, err := parseIgnoreIP(trustedProxy, 0)
+		if err != nil {
+			if err := skipInvalid(fmt.Errorf("invalid trustedProxy given %s, expected an IPv4 or IPv6 address or CIDR: %w", trustedProxy, err)); err != nil {
+				return err
+			}
+			continue
 		}
+
+		h.trustedProxies = append(h.trustedProxies, network)
 	}
 
-	if len(config.IgnoreURLs) > 0 {
-		for _, location := range config.IgnoreURLs {
-			r, err := regexp.Compile(location)
+	if len(config.IgnoreUserAgents) > 0 || len(config.IgnoreUserAgentsRegex) > 0 {
+		patterns := make([]string, 0, len(config.IgnoreUserAgents)+len(config.IgnoreUserAgentsRegex))
+		for _, userAgent := range config.IgnoreUserAgents {
+			patterns = append(patterns, regexp.QuoteMeta(userAgent))
+		}
+		// Combined with the literals, so a user-agent is still matched in one pass.
+		patterns = append(patterns, config.IgnoreUserAgentsRegex...)
+		if config.SkipInvalidConfig {
+			patterns = h.validPatterns("ignoreUserAgentsRegex", patterns)
+		}
+
+		if len(patterns) > 0 {
+			ignoreUserAgents, err := compileAlternation(patterns)
 			if err != nil {
-				return fmt.Errorf("failed to compile ignoreURL %s: %w", location, err)
+				return fmt.Errorf("failed to compile ignoreUserAgents %w", err)
 			}
 
-			h.ignoreRegexps = append(h.ignoreRegexps, *r)
+			h.ignoreUserAgents = ignoreUserAgents
+		}
+	}
+
+	ignoreURLs, allowURLs := config.IgnoreURLs, config.AllowURLs
+	if config.SkipInvalidConfig {
+		ignoreURLs, allowURLs = h.validPatterns("ignoreURLs", ignoreURLs), h.validPatterns("allowURLs", allowURLs)
+	}
+
+	if len(ignoreURLs) > 0 {
+		ignoreRegexp, err := compileAlternation(ignoreURLs)
+		if err != nil {
+			return fmt.Errorf("failed to compile ignoreURL %w", err)
 		}
+
+		h.ignoreRegexp = ignoreRegexp
 	}
 
+	if len(allowURLs) > 0 {
+		allowRegexp, err := compileAlternation(allowURLs)
+		if err != nil {
+			return fmt.Errorf("failed to compile allowURL %w", err)
+		}
+
+		h.allowRegexp = allowRegexp
+	}
+
+	if err := h.setupWebsiteFilters(config); err != nil {
+		return err
+	}
+
+	for status, eventName := range config.StatusEvents {
+		code, err := strconv.Atoi(status)
+		if err != nil || code < 100 || code > 599 || eventName == "" {
+			return fmt.Errorf("invalid statusEvent %s: %s", status, eventName)
+		}
+
+		if h.statusEvents == nil {
+			h.statusEvents = map[int]string{}
+		}
+		h.statusEvents[code] = eventName
+	}
+
+	for status, reported := range config.StatusOverrides {
+		code, err := strconv.Atoi(status)
+		if err != nil || code < 100 || code > 599 || reported < 100 || reported > 599 {
+			return fmt.Errorf("invalid statusOverride %s: %d", status, reported)
+		}
+
+		if h.statusOverrides == nil {
+			h.statusOverrides = map[int]int{}
+		}
+		h.statusOverrides[code] = reported
+	}
+
+	var err error
+	if h.trackStatusCodes, err = parseStatusRanges("trackStatusCodes", config.TrackStatusCodes); err != nil {
+		return err
+	}
+	if h.ignoreStatusCodes, err = parseStatusRanges("ignoreStatusCodes", config.IgnoreStatusCodes); err != nil {
+		return err
+	}
+
+	for _, conversion := range config.ConversionEvents {
+		if conversion.Name == "" {
+			return fmt.Errorf("conversionEvents require a name")
+		}
+
+		r, err := regexp.Compile(conversion.Path)
+		if err != nil {
+			if err := skipInvalid(fmt.Errorf("failed to compile conversionEvent path %s: %w", conversion.Path, err)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		h.conversionRules = append(h.conversionRules, conversionRule{ConversionEvent: conversion, path: r})
+	}
+
+	for _, pathEvent := range config.Events {
+		if pathEvent.Name == "" {
+			return fmt.Errorf("events require a name")
+		}
+
+		r, err := regexp.Compile(pathEvent.Path)
+		if err != nil {
+			if err := skipInvalid(fmt.Errorf("failed to compile event path %s: %w", pathEvent.Path, err)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		h.pathEvents = append(h.pathEvents, pathEventRule{PathEvent: pathEvent, path: r})
+	}
+
+	for _, rewrite := range config.PathRewrites {
+		r, err := regexp.Compile(rewrite.Regex)
+		if err != nil {
+			if err := skipInvalid(fmt.Errorf("failed to compile pathRewrite regex %s: %w", rewrite.Regex, err)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		h.pathRewrites = append(h.pathRewrites, pathRewrite{regex: r, replacement: rewrite.Replacement})
+	}
+
+	h.minBotScore, h.ignoreVerifiedBots = config.MinBotScore, config.IgnoreVerifiedBots
+	h.respectDoNotTrack = config.RespectDoNotTrack
+	h.botScoreHeader, h.verifiedBotHeader = config.BotScoreHeader, config.VerifiedBotHeader
+
+	if config.IgnoreBots {
+		h.ignoreBots = newBotMatcher(knownBots)
+	}
+
+	h.hasFilters = h.trackMethods != nil || h.ignoreMethods != nil || len(h.ignorePrefixes) > 0 ||
+		h.ignoreUserAgents != nil || h.ignoreBots != nil || h.minBotScore > 0 || h.ignoreVerifiedBots
+
 	return nil
 }
 
+// validPatterns returns the patterns which compile, logging a warning for each that does not.
+func (h *UmamiFeeder) validPatterns(name string, patterns []string) []string {
+	valid := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			h.warn(fmt.Sprintf("failed to compile %s %s: %v, skipping it", name, pattern, err))
+			continue
+		}
+		valid = append(valid, pattern)
+	}
+	return valid
+}
+
+// trackedKey marks the context of a request that is already tracked by an instance of the plugin,
+// e.g. when it is attached to an entrypoint and a router alike.
+type trackedKey struct{}
+
 func (h *UmamiFeeder) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	if !h.isDisabled && h.shouldTrack(req) {
-		// If the resource should be reported, we wrap the response writer and check the status code before reporting
+	if req.Context().Value(trackedKey{}) != nil {
+		h.debug("request already tracked by an outer middleware %s", req.URL.Path)
+		h.next.ServeHTTP(rw, req)
+		return
+	}
+
+	if h.failMode == failClosed && h.isDisabled.Load() {
+		if failure, _ := h.failure.Load().(string); failure != "" {
+			rw.Header().Set(failureHeader, "disabled")
+		}
+	}
+
+	if h.statusPath != "" && req.URL.Path == h.statusPath {
+		h.serveStatus(rw, req)
+		return
+	}
+	if h.proxyPath != "" && req.URL.Path == h.proxyPath && !h.isDisabled.Load() {
+		h.serveProxy(rw, req)
+		return
+	}
+	if h.scriptPath != "" && req.URL.Path == h.scriptPath && !h.isDisabled.Load() {
+		h.serveScript(rw, req)
+		return
+	}
+
+	reason := "disabled"
+	if !h.isDisabled.Load() {
+		reason = h.ignoreReason(req)
+	}
+	if reason == "" {
+		// Set before the access log records the request, any value sent by the client is replaced.
+		if h.eventIDHeader != "" {
+			req.Header.Set(h.eventIDHeader, newEventID())
+		}
+		req = req.WithContext(context.WithValue(req.Context(), trackedKey{}, h.name))
+
+		// If the resource should be reported, we wrap the response writer and report once the response is complete
 		wrappedResponseWriter := &ResponseWriter{
 			ResponseWriter: rw,
 			request:        req,
 			feeder:         h,
+			started:        time.Now(),
 		}
 
+		// Deferred, as a reverse proxy panics with http.ErrAbortHandler once the client disconnected mid-response.
+		defer wrappedResponseWriter.finish()
+
 		// Continue with next handler.
 		h.next.ServeHTTP(wrappedResponseWriter, req)
 		return
 	}
 
+	if h.captures != nil {
+		h.capture(req, reason, responseInfo{}, "")
+	}
+
+	// The bytes served are accounted for requests which are not tracked, too.
+	if h.bandwidth != nil && !h.isDisabled.Load() {
+		wrappedResponseWriter := &ResponseWriter{ResponseWriter: rw, request: req, feeder: h, untracked: true}
+		defer wrappedResponseWriter.finish()
+		h.next.ServeHTTP(wrappedResponseWriter, req)
+		return
+	}
+
 	h.next.ServeHTTP(rw, req)
 }
 
+// shouldTrack reports whether the request is tracked, see ignoreReason.
 func (h *UmamiFeeder) shouldTrack(req *http.Request) bool {
+	return h.ignoreReason(req) == ""
+}
+
+// ignoreReason returns why the request is not tracked, e.g. `bot` or `resource`, or "" if it is.
+func (h *UmamiFeeder) ignoreReason(req *http.Request) string {
+	// Skip header lookups and IP parsing entirely when no filters are configured.
+	if h.hasFilters {
+		if reason := h.filterReason(req); reason != "" {
+			return reason
+		}
+	}
+
+	if h.respectDoNotTrack && (req.Header.Get("DNT") == "1" || req.Header.Get("Sec-GPC") == "1") {
+		h.debug("ignoring request opting out of tracking %s", req.URL.Path)
+		return "do not track"
+	}
+
+	if h.dedup == dedupNoJS && runsScripts(req) {
+		h.debug("ignoring client tracked by the script %s", req.UserAgent())
+		return "script client"
+	}
+
+	if h.dedup == dedupCookie {
+		if _, err := req.Cookie(h.dedupCookie); err == nil {
+			h.debug("ignoring client tracked by the script, %s cookie is set", h.dedupCookie)
+			return "dedup cookie"
+		}
+	}
+
+	requestURL := h.filteredURL(req)
+	reason := h.cachedLocationReason(req.Host, requestURL)
+	if h.shadowFilter != nil {
+		h.compareShadow(req.Host, requestURL, reason == "")
+	}
+	return reason
+}
+
+// filteredURL returns the request URL matched by the URL filters: the path and the query string unless urlsPathOnly
+// is set, preceded by the scheme and host of absolute URLs like URL.String() would. The path of the usual requests is
+// matched directly, building the full URL would allocate on every request.
+func (h *UmamiFeeder) filteredURL(req *http.Request) string {
+	requestURL := req.URL.Path
+	if req.URL.Scheme != "" {
+		requestURL = req.URL.Scheme + "://" + req.URL.Host + requestURL
+	}
+	if !h.urlsPathOnly && req.URL.RawQuery != "" {
+		requestURL += "?" + req.URL.RawQuery
+	}
+	return requestURL
+}
+
+// cachedLocationReason returns the decision of locationReason. It only depends on the host and the URL,
+// so it is cached if decisionCacheSize is set.
+func (h *UmamiFeeder) cachedLocationReason(host string, requestURL string) string {
+	if h.decisions == nil {
+		return h.locationReason(host, requestURL)
+	}
+
+	key := host + " " + requestURL
+	if reason, ok := h.decisions.get(key); ok {
+		return reason
+	}
+	generation := h.decisions.currentGeneration()
+	reason := h.locationReason(host, requestURL)
+	h.decisions.add(key, reason, generation)
+	return reason
+}
+
+// locationReason checks the host and the requestURL, see filteredURL,
+// against the URL filters, the tracked resources and the configured websites, and returns why it is not tracked,
+// or "" if it is.
+func (h *UmamiFeeder) locationReason(host string, requestURL string) string {
+	hostname := parseDomainFromHost(host)
+
+	if reason := h.filterURL(h.activeFilter(hostname), requestURL); reason != "" {
+		h.debug("ignoring %s %s", reason, requestURL)
+		return reason
+	}
+
+	if h.isPaused(hostname) {
+		h.debug("tracking paused for domain %s", hostname)
+		return "paused"
+	}
+
+	if !h.isWebsite(hostname) {
+		h.debug("ignoring domain %s", hostname)
+		return "domain"
+	}
+	return ""
+}
+
+// isWebsite reports whether hostname belongs to a website, or one is created for it if createNewWebsites is set.
+func (h *UmamiFeeder) isWebsite(hostname string) bool {
+	if h.createNewWebsites {
+		return true
+	}
+	_, ok := h.lookupWebsite(hostname)
+	return ok
+}
+
+// filterReason checks the request against the configured methods, ignoreIPs, ignoreUserAgents and bot filters,
+// and returns the filter excluding it, or "" if it passes.
+func (h *UmamiFeeder) filterReason(req *http.Request) string {
+	if h.trackMethods != nil && !h.trackMethods[req.Method] || h.ignoreMethods[req.Method] {
+		h.debug("ignoring method %s", req.Method)
+		return "method"
+	}
+
 	if len(h.ignorePrefixes) > 0 {
-		requestIp := req.Header.Get(h.headerIp)
-		if requestIp == "" {
+		var requestIp string
+		if len(h.trustedProxies) > 0 {
+			requestIp = h.clientIP(req)
+		} else if requestIp = req.Header.Get(h.headerIp); requestIp == "" {
 			requestIp = req.RemoteAddr
 		}
 
-		ip, err := netip.ParseAddr(requestIp)
+		ip, err := parseIP(requestIp)
 		if err != nil {
 			h.debug("invalid IP %s", requestIp)
-			return false
+			return "invalid IP"
 		}
 
 		for _, prefix := range h.ignorePrefixes {
 			if prefix.Contains(ip) {
 				h.debug("ignoring IP %s", ip)
-				return false
+				return "IP"
 			}
 		}
 	}
 
-	if len(h.ignoreUserAgents) > 0 {
+	if h.ignoreUserAgents != nil {
 		userAgent := req.UserAgent()
-		for _, disabledUserAgent := range h.ignoreUserAgents {
-			if strings.Contains(userAgent, disabledUserAgent) {
-				h.debug("ignoring user-agent %s", userAgent)
-				return false
-			}
+		if h.ignoreUserAgents.MatchString(userAgent) {
+			h.debug("ignoring user-agent %s", userAgent)
+			return "user-agent"
 		}
 	}
 
-	if len(h.ignoreRegexps) > 0 {
-		requestURL := req.URL.String()
-		for _, r := range h.ignoreRegexps {
-			if r.MatchString(requestURL) {
-				h.debug("ignoring location %s", requestURL)
-				return false
-			}
-		}
+	if h.ignoreBots != nil && h.ignoreBots.match(req.UserAgent()) {
+		h.debug("ignoring bot %s", req.UserAgent())
+		return "bot"
 	}
 
-	if !h.shouldTrackResource(req.URL.Path) {
-		h.debug("ignoring resource %s", req.URL.Path)
-		return false
+	// Requests without the Cloudflare headers, e.g. not proxied by Cloudflare, pass.
+	if h.minBotScore > 0 {
+		if score, err := strconv.Atoi(req.Header.Get(h.botScoreHeader)); err == nil && score < h.minBotScore {
+			h.debug("ignoring bot score %d", score)
+			return "bot score"
+		}
 	}
 
-	if h.createNewWebsites {
-		return true
+	if h.ignoreVerifiedBots && strings.EqualFold(req.Header.Get(h.verifiedBotHeader), "true") {
+		h.debug("ignoring verified bot %s", req.UserAgent())
+		return "verified bot"
 	}
 
-	hostname := parseDomainFromHost(req.Host)
-	if _, ok := h.websites[hostname]; ok {
-		return true
+	return ""
+}
+
+// lookupWebsite returns the site-id configured for hostname, or for a wildcard or pattern matching it,
+// or else the defaultWebsite if set.
+func (h *UmamiFeeder) lookupWebsite(hostname string) (string, bool) {
+	h.websitesMutex.RLock()
+	defer h.websitesMutex.RUnlock()
+
+	websiteId, ok := h.websites[h.websiteKey(hostname)]
+	if !ok && h.defaultWebsite != "" {
+		return h.defaultWebsite, true
 	}
+	return websiteId, ok
+}
 
-	h.debug("ignoring domain %s", hostname)
+// isAPIRequest reports whether the path is under one of the apiEventPrefixes.
+func (h *UmamiFeeder) isAPIRequest(path string) bool {
+	for _, prefix := range h.apiEventPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
 	return false
 }
 
 func (h *UmamiFeeder) shouldTrackResource(url string) bool {
-	if h.trackAllResources {
-		return true
-	}
-
-	pathExt := path.Ext(url)
+	return isTrackedResource(url, h.trackAllResources, h.trackExtensions)
+}
 
-	// If a custom file extension list is defined, check if the resource matches it. If not, do not report.
-	if len(h.trackExtensions) > 0 {
-		for _, suffix := range h.trackExtensions {
-			if suffix == pathExt {
-				return true
-			}
-		}
+// shouldTrackStatus reports whether responses with statusCode are tracked for host: none of ignoreStatusCodes nor
+// redirects if ignoreRedirects is set, and those of trackStatusCodes if set, else client and server errors only if
+// trackClientErrors or trackServerErrors is set globally or for its website.
+func (h *UmamiFeeder) shouldTrackStatus(host string, statusCode int) (report bool) {
+	if matchStatus(h.ignoreStatusCodes, statusCode) {
+		h.debug("ignoring status %d", statusCode)
 		return false
 	}
-
-	// Check if the suffix is regarded to be "content".
-	switch pathExt {
-	case "", ".htm", ".html", ".xhtml", ".jsf", ".md", ".php", ".rss", ".rtf", ".txt", ".xml", ".pdf":
-		return true
+	// A 304 answers a conditional request for a page the visitor views again, it does not lead elsewhere.
+	if h.ignoreRedirects && statusCode >= 300 && statusCode < 400 && statusCode != http.StatusNotModified {
+		h.debug("ignoring redirect %d", statusCode)
+		return false
 	}
+	if len(h.trackStatusCodes) > 0 {
+		if matchStatus(h.trackStatusCodes, statusCode) {
+			return true
+		}
 
-	return false
-}
+		h.debug("not reporting status %d", statusCode)
+		return false
+	}
 
-func (h *UmamiFeeder) shouldTrackStatus(statusCode int) (report bool) {
 	if statusCode >= 400 {
-		if h.trackErrors {
+		if h.activeFilter(parseDomainFromHost(host)).tracksError(statusCode) {
 			return true
 		}
 
@@ -356,6 +1617,26 @@ func (h *UmamiFeeder) shouldTrackStatus(statusCode int) (report bool) {
 	return true
 }
 
+// backendHeaders are headers any real backend response carries, but that are missing from Traefik's own error pages.
+var backendHeaders = []string{"Content-Type", "Content-Length", "Date", "Server"}
+
+// isProxyError reports whether the response is an error page produced by Traefik instead of the backend.
+func (h *UmamiFeeder) isProxyError(statusCode int, header http.Header) bool {
+	switch statusCode {
+	case http.StatusNotFound, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+	default:
+		return false
+	}
+
+	for _, name := range backendHeaders {
+		if header.Get(name) != "" {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (h *UmamiFeeder) error(message string) {
 	if h.logHandler != nil {
 		now := time.Now().Format("2006-01-02T15:04:05Z")
@@ -363,6 +1644,20 @@ func (h *UmamiFeeder) error(message string) {
 	}
 }
 
+func (h *UmamiFeeder) info(message string) {
+	if h.logHandler != nil {
+		now := time.Now().Format("2006-01-02T15:04:05Z")
+		h.logHandler.Printf("%s INF middlewareName=%s msg=\"%s\"", now, h.name, message)
+	}
+}
+
+func (h *UmamiFeeder) warn(message string) {
+	if h.logHandler != nil {
+		now := time.Now().Format("2006-01-02T15:04:05Z")
+		h.logHandler.Printf("%s WRN middlewareName=%s msg=\"%s\"", now, h.name, message)
+	}
+}
+
 // Arguments are handled in the manner of [fmt.Printf].
 func (h *UmamiFeeder) debug(format string, v ...any) {
 	if h.logHandler != nil && h.isDebug {
@@ -0,0 +1,56 @@
+package traefik_rybbit_feeder
+
+import (
+	"net/http"
+	"time"
+)
+
+// abortRateEventName is the name of the custom events reporting the rate of aborted requests per website.
+const abortRateEventName = "abort_rate"
+
+// newAbortRates returns the counter of the tracked requests and of those whose client disconnected before the
+// response was written, per website between two emissions. A high rate hints at pages too slow for visitors to
+// wait for. Websites are configured, so their amount is bounded.
+func newAbortRates(interval time.Duration) *intervalCounter {
+	return newIntervalCounter(interval, 0, nil)
+}
+
+// recordAbort counts the completed tracked request, and whether its client disconnected.
+func (h *UmamiFeeder) recordAbort(req *http.Request) {
+	websiteId, ok := h.lookupWebsite(parseDomainFromHost(req.Host))
+	if !ok {
+		return
+	}
+	var aborted int64
+	if req.Context().Err() != nil {
+		aborted = 1
+	}
+	h.abortRates.add(websiteId, aborted)
+}
+
+// flushAbortRates enqueues one custom event with `requests`, `aborted`, `abort_rate_pct` and `interval_s`
+// properties per website with requests.
+func (h *UmamiFeeder) flushAbortRates() {
+	sites := h.abortRates.take()
+	if len(sites) == 0 {
+		return
+	}
+	h.debug("emitting %d abort rate events", len(sites))
+
+	for siteID, counted := range sites {
+		event := acquireEvent()
+		*event = RybbitEvent{
+			SiteID:    siteID.(string),
+			Type:      eventTypeCustom,
+			Pathname:  "/",
+			EventName: abortRateEventName,
+			Properties: h.encodeProperties(map[string]any{
+				"requests":       counted.count,
+				"aborted":        counted.sum,
+				"abort_rate_pct": float64(counted.sum*1000/int64(counted.count)) / 10,
+				"interval_s":     int(h.abortRates.interval.Seconds()),
+			}),
+		}
+		h.enqueue(event)
+	}
+}
@@ -0,0 +1,81 @@
+package traefik_rybbit_feeder
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAbortRates(t *testing.T) {
+	feeder := &UmamiFeeder{
+		next:       http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+		websites:   map[string]string{"localhost": "1"},
+		queue:      newEventQueue(queueTypeChannel, 10, 1),
+		abortRates: newAbortRates(time.Minute),
+	}
+
+	aborted, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, ctx := range []context.Context{context.Background(), context.Background(), context.Background(), aborted} {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/", nil)
+		feeder.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	// Requests of an untracked status are not counted.
+	feeder.next = http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusNotFound)
+	})
+	req, _ := http.NewRequestWithContext(aborted, http.MethodGet, "http://localhost/missing", nil)
+	feeder.ServeHTTP(httptest.NewRecorder(), req)
+	for feeder.queue.len() > 0 {
+		feeder.queue.shards[0].pop()
+	}
+
+	feeder.flushAbortRates()
+	event := feeder.queue.shards[0].pop()
+	if event == nil || event.EventName != abortRateEventName || event.SiteID != "1" ||
+		event.Properties != `{"abort_rate_pct":25,"aborted":1,"interval_s":60,"requests":4}` {
+		t.Fatalf("unexpected abort rate event %+v", event)
+	}
+
+	feeder.flushAbortRates()
+	if feeder.queue.len() != 0 {
+		t.Fatalf("expected counts to be reset, got %d events", feeder.queue.len())
+	}
+}
+
+func TestAbortRatesAbortHandler(t *testing.T) {
+	aborted, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// A reverse proxy panics once the client disconnected mid-response.
+	feeder := &UmamiFeeder{
+		next: http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			rw.WriteHeader(http.StatusOK)
+			panic(http.ErrAbortHandler)
+		}),
+		websites:   map[string]string{"localhost": "1"},
+		queue:      newEventQueue(queueTypeChannel, 10, 1),
+		abortRates: newAbortRates(time.Minute),
+	}
+
+	req, _ := http.NewRequestWithContext(aborted, http.MethodGet, "http://localhost/", nil)
+	func() {
+		defer func() {
+			if recovered := recover(); recovered != http.ErrAbortHandler {
+				t.Fatalf("expected the panic to be propagated, got %v", recovered)
+			}
+		}()
+		feeder.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	for feeder.queue.len() > 0 {
+		feeder.queue.shards[0].pop()
+	}
+
+	feeder.flushAbortRates()
+	event := feeder.queue.shards[0].pop()
+	if event == nil || event.Properties != `{"abort_rate_pct":100,"aborted":1,"interval_s":60,"requests":1}` {
+		t.Fatalf("expected the aborted request to be counted, got %+v", event)
+	}
+}
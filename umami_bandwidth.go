@@ -0,0 +1,70 @@
+package traefik_rybbit_feeder
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// bandwidthEventName is the name of the custom events reporting the bytes served per hostname.
+const bandwidthEventName = "bandwidth"
+
+// maxBandwidthHosts bounds the distinct hostnames counted per interval, as the Host header is chosen by clients.
+// Further hostnames are counted for their website with an empty hostname.
+const maxBandwidthHosts = 1000
+
+type bandwidthKey struct {
+	siteID   string
+	hostname string
+}
+
+// newBandwidth returns the counter of the bytes served per website and hostname between two emissions.
+func newBandwidth(interval time.Duration) *intervalCounter {
+	return newIntervalCounter(interval, maxBandwidthHosts, func(key any, full bool) any {
+		bandwidth := key.(bandwidthKey)
+		if full {
+			bandwidth.hostname = ""
+		} else {
+			// The hostname outlives the request.
+			bandwidth.hostname = strings.Clone(bandwidth.hostname)
+		}
+		return bandwidth
+	})
+}
+
+// recordBandwidth accounts the bytes written for the response to req, if its hostname belongs to a website.
+func (h *UmamiFeeder) recordBandwidth(req *http.Request, written int64) {
+	hostname := parseDomainFromHost(req.Host)
+	websiteId, ok := h.lookupWebsite(hostname)
+	if !ok {
+		return
+	}
+	h.bandwidth.add(bandwidthKey{siteID: websiteId, hostname: hostname}, written)
+}
+
+// flushBandwidth enqueues one custom event with `bytes`, `requests` and `interval_s` properties per hostname.
+func (h *UmamiFeeder) flushBandwidth() {
+	usage := h.bandwidth.take()
+	if len(usage) == 0 {
+		return
+	}
+	h.debug("emitting %d bandwidth events", len(usage))
+
+	for key, counted := range usage {
+		bandwidth := key.(bandwidthKey)
+		event := acquireEvent()
+		*event = RybbitEvent{
+			SiteID:    bandwidth.siteID,
+			Type:      eventTypeCustom,
+			Pathname:  "/",
+			Hostname:  bandwidth.hostname,
+			EventName: bandwidthEventName,
+			Properties: h.encodeProperties(map[string]any{
+				"bytes":      counted.sum,
+				"requests":   counted.count,
+				"interval_s": int(h.bandwidth.interval.Seconds()),
+			}),
+		}
+		h.enqueue(event)
+	}
+}
@@ -0,0 +1,52 @@
+package traefik_rybbit_feeder
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBandwidth(t *testing.T) {
+	feeder := &UmamiFeeder{
+		next: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			_, _ = rw.Write([]byte(strings.Repeat("x", 100)))
+		}),
+		websites:  map[string]string{"localhost": "1"},
+		queue:     newEventQueue(queueTypeChannel, 10, 1),
+		bandwidth: newBandwidth(time.Minute),
+	}
+
+	// The stylesheet is not tracked, but its bytes are accounted.
+	for _, url := range []string{"http://localhost/", "http://localhost/style.css", "http://unknown/"} {
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
+		feeder.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if event := feeder.queue.shards[0].pop(); event == nil || event.Type != eventTypePageview {
+		t.Fatalf("expected the pageview of the tracked request, got %+v", event)
+	}
+
+	feeder.flushBandwidth()
+	event := feeder.queue.shards[0].pop()
+	if event == nil || event.EventName != bandwidthEventName || event.Hostname != "localhost" ||
+		event.Properties != `{"bytes":200,"interval_s":60,"requests":2}` {
+		t.Fatalf("unexpected bandwidth event %+v", event)
+	}
+	if feeder.queue.len() != 0 {
+		t.Fatalf("expected a single bandwidth event, got %d more", feeder.queue.len())
+	}
+}
+
+func TestBandwidthBoundsHosts(t *testing.T) {
+	b := newBandwidth(time.Minute)
+	for i := 0; i < maxBandwidthHosts+10; i++ {
+		b.add(bandwidthKey{siteID: "1", hostname: strings.Repeat("a", i+1)}, 1)
+	}
+
+	usage := b.take()
+	if len(usage) != maxBandwidthHosts+1 || usage[bandwidthKey{siteID: "1"}].count != 10 {
+		t.Fatalf("expected further hostnames to be counted without hostname, got %d keys", len(usage))
+	}
+}
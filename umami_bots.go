@@ -0,0 +1,119 @@
+package traefik_rybbit_feeder
+
+import (
+	"strings"
+)
+
+// knownBots are user-agent fragments of common crawlers, SEO tools, monitoring services and HTTP clients,
+// ignored with IgnoreBots. They are matched case-insensitively.
+var knownBots = []string{
+	// search engines
+	"Googlebot", "Google-InspectionTool", "GoogleOther", "Storebot-Google", "AdsBot-Google", "Mediapartners-Google",
+	"bingbot", "BingPreview", "msnbot", "DuckDuckBot", "YandexBot", "YandexImages", "Baiduspider", "Applebot",
+	"Sogou", "Exabot", "SeznamBot", "PetalBot", "Qwantify", "MojeekBot",
+	// SEO and marketing tools
+	"AhrefsBot", "SemrushBot", "MJ12bot", "DotBot", "rogerbot", "BLEXBot", "DataForSeoBot", "serpstatbot",
+	"Screaming Frog",
+	// AI crawlers
+	"GPTBot", "ChatGPT-User", "OAI-SearchBot", "ClaudeBot", "Claude-Web", "anthropic-ai", "PerplexityBot",
+	"CCBot", "Bytespider", "Amazonbot", "Google-Extended", "cohere-ai", "Diffbot",
+	// social previews
+	"facebookexternalhit", "Facebot", "Twitterbot", "LinkedInBot", "Slackbot", "Discordbot", "TelegramBot",
+	"WhatsApp", "Pinterestbot", "redditbot", "SkypeUriPreview", "Embedly",
+	// uptime monitors
+	"UptimeRobot", "Uptime-Kuma", "Pingdom", "StatusCake", "Site24x7", "BetterUptime", "Better Uptime",
+	"HetrixTools", "Freshping", "NewRelicPinger", "Datadog", "GoogleStackdriverMonitoring", "updown.io",
+	// HTTP clients and libraries
+	"curl/", "Wget/", "python-requests", "python-urllib", "aiohttp", "httpx", "Go-http-client", "okhttp",
+	"Apache-HttpClient", "Java/", "libwww-perl", "axios/", "node-fetch", "undici", "PostmanRuntime", "insomnia",
+	// headless browsers and generic markers
+	"HeadlessChrome", "PhantomJS", "Lighthouse", "Chrome-Lighthouse", "crawler", "spider", "scraper",
+}
+
+// botMatcher matches user-agents case-insensitively against fragments, in a single pass over the user-agent.
+// It is an Aho-Corasick automaton: a case-insensitive regexp of that many alternatives is orders of magnitude
+// slower, and so is a search for every fragment.
+type botMatcher struct {
+	classes [256]uint8 // the column of every byte in next, 0 for bytes in none of the fragments
+	columns int
+	next    []int32 // the state following a state and a byte class, at state*columns+class
+	matched []bool  // whether a fragment ends at a state
+}
+
+func newBotMatcher(fragments []string) *botMatcher {
+	m := &botMatcher{columns: 1}
+	for _, fragment := range fragments {
+		for _, c := range []byte(strings.ToLower(fragment)) {
+			if m.classes[c] == 0 {
+				m.classes[c] = uint8(m.columns)
+				m.columns++
+			}
+		}
+	}
+
+	// Build the trie of the fragments, a missing transition is -1.
+	m.addState()
+	for _, fragment := range fragments {
+		state := int32(0)
+		for _, c := range []byte(strings.ToLower(fragment)) {
+			i := int(state)*m.columns + int(m.classes[c])
+			if m.next[i] < 0 {
+				m.next[i] = m.addState()
+			}
+			state = m.next[i]
+		}
+		m.matched[state] = true
+	}
+
+	// Complete the transitions breadth-first: a missing transition continues from the longest suffix of the
+	// state which is a prefix of a fragment, i.e. its fallback state.
+	fallback := make([]int32, len(m.matched))
+	queue := []int32{0}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for class := 0; class < m.columns; class++ {
+			i := int(state)*m.columns + class
+			child := m.next[i]
+			if child < 0 {
+				// The root stays in place, and its fallback is itself.
+				m.next[i] = 0
+				if state != 0 {
+					m.next[i] = m.next[int(fallback[state])*m.columns+class]
+				}
+				continue
+			}
+			if state != 0 {
+				fallback[child] = m.next[int(fallback[state])*m.columns+class]
+			}
+			m.matched[child] = m.matched[child] || m.matched[fallback[child]]
+			queue = append(queue, child)
+		}
+	}
+	return m
+}
+
+// addState appends a state without transitions, and returns it.
+func (m *botMatcher) addState() int32 {
+	m.matched = append(m.matched, false)
+	for class := 0; class < m.columns; class++ {
+		m.next = append(m.next, -1)
+	}
+	return int32(len(m.matched) - 1)
+}
+
+// match reports whether userAgent contains any of the fragments.
+func (m *botMatcher) match(userAgent string) bool {
+	state := int32(0)
+	for i := 0; i < len(userAgent); i++ {
+		c := userAgent[i]
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		state = m.next[int(state)*m.columns+int(m.classes[c])]
+		if m.matched[state] {
+			return true
+		}
+	}
+	return false
+}
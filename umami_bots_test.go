@@ -0,0 +1,60 @@
+package traefik_rybbit_feeder
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestShouldTrackIgnoreBots(t *testing.T) {
+	feeder := UmamiFeeder{createNewWebsites: true}
+	err := feeder.verifyConfig(&Config{
+		IgnoreUserAgents: []string{"InternalProbe"},
+		IgnoreBots:       true,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertIgnoreUa(t, &feeder, true, "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36")
+	assertIgnoreUa(t, &feeder, false, "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)")
+	assertIgnoreUa(t, &feeder, false, "Mozilla/5.0 (compatible; AhrefsBot/7.0; +http://ahrefs.com/robot/)")
+	assertIgnoreUa(t, &feeder, false, "Uptime-Kuma/1.23.1")
+	assertIgnoreUa(t, &feeder, false, "curl/8.5.0")
+	assertIgnoreUa(t, &feeder, false, "GOOGLEBOT")
+	assertIgnoreUa(t, &feeder, false, "InternalProbe/1.0")
+	// ignoreUserAgents stay case-sensitive.
+	assertIgnoreUa(t, &feeder, true, "internalprobe/1.0")
+}
+
+func TestBotMatcher(t *testing.T) {
+	m := newBotMatcher([]string{"abcd", "BC", "bot"})
+
+	tests := map[string]bool{
+		"xabcx":                          true, // "bc" within a partial "abcd"
+		"ABCD":                           true,
+		"abbot":                          true,
+		"acbd":                           false,
+		"":                               false,
+		strings.Repeat("x", 600) + "Bot": true, // long user-agents are matched in full
+	}
+	for userAgent, expected := range tests {
+		if m.match(userAgent) != expected {
+			t.Errorf("expected %v for %.20q", expected, userAgent)
+		}
+	}
+}
+
+func BenchmarkIgnoreBots(b *testing.B) {
+	feeder := UmamiFeeder{}
+	if err := feeder.verifyConfig(&Config{IgnoreBots: true}); err != nil {
+		b.Fatal(err)
+	}
+	userAgent := "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36"
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		feeder.ignoreBots.match(userAgent)
+	}
+}
@@ -0,0 +1,154 @@
+package traefik_rybbit_feeder
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCaptureSize bounds the requests kept by captureSize.
+const maxCaptureSize = 1000
+
+// CapturedRequest is a request seen by the plugin with its tracking decision, see CapturedRequests.
+type CapturedRequest struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	Host   string    `json:"host"`
+	Path   string    `json:"path"`
+	// Tracked is set if an event was submitted for the request, Reason tells why not otherwise,
+	// e.g. `resource`, `bot` or `status`.
+	Tracked bool   `json:"tracked"`
+	Reason  string `json:"reason,omitempty"`
+	// Status, Written and Duration describe the response of a request passing the request filters,
+	// they are empty for requests ignored before the response.
+	Status   int           `json:"status,omitempty"`
+	Written  int64         `json:"written,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+	// Payload summarizes the events submitted for a tracked request, one per line, see summarizeEvents.
+	Payload string `json:"payload,omitempty"`
+}
+
+// captureBuffer is a ring buffer of the last captured requests.
+type captureBuffer struct {
+	mutex    sync.Mutex
+	requests []CapturedRequest
+	next     int // the position of the next request, the oldest once the buffer is full
+	full     bool
+}
+
+// newCaptureBuffer returns a buffer holding up to size requests, or nil if size is 0.
+func newCaptureBuffer(size int) *captureBuffer {
+	if size <= 0 {
+		return nil
+	}
+	return &captureBuffer{requests: make([]CapturedRequest, size)}
+}
+
+// add keeps request, replacing the oldest one once the buffer is full.
+func (c *captureBuffer) add(request CapturedRequest) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.requests[c.next] = request
+	c.next++
+	if c.next == len(c.requests) {
+		c.next = 0
+		c.full = true
+	}
+}
+
+// list returns a copy of the kept requests, oldest first.
+func (c *captureBuffer) list() []CapturedRequest {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.full {
+		return append([]CapturedRequest(nil), c.requests[:c.next]...)
+	}
+	requests := make([]CapturedRequest, 0, len(c.requests))
+	requests = append(requests, c.requests[c.next:]...)
+	return append(requests, c.requests[:c.next]...)
+}
+
+// CapturedRequests returns the last captureSize requests with their tracking decision, oldest first, to tell
+// why a request was tracked or not from the live state. It returns nothing unless debug and captureSize are set.
+// The requests are served on statusPath, see serveStatus.
+func (h *UmamiFeeder) CapturedRequests() []CapturedRequest {
+	if h.captures == nil {
+		return nil
+	}
+	return h.captures.list()
+}
+
+// capture keeps the request with the reason it was not tracked, "" if it was, and its response and the summary of
+// its events if known.
+func (h *UmamiFeeder) capture(req *http.Request, reason string, resp responseInfo, payload string) {
+	// The strings of the request are copied, they outlive it.
+	h.captures.add(CapturedRequest{
+		Time:     time.Now(),
+		Method:   strings.Clone(req.Method),
+		Host:     strings.Clone(req.Host),
+		Path:     strings.Clone(req.URL.Path),
+		Tracked:  reason == "",
+		Reason:   reason,
+		Status:   resp.status,
+		Written:  resp.written,
+		Duration: resp.duration,
+		Payload:  payload,
+	})
+}
+
+// summarizeEvents describes the events submitted for a request, one per line: type, name, site-id, URL and
+// properties, e.g. `pageview site=1 example.com/about {"status_class":"2xx"}`. Nil events are skipped.
+func summarizeEvents(events ...*RybbitEvent) string {
+	var summary strings.Builder
+	for _, event := range events {
+		if event == nil {
+			continue
+		}
+		if summary.Len() > 0 {
+			summary.WriteByte('\n')
+		}
+		summary.WriteString(event.Type)
+		if event.EventName != "" {
+			fmt.Fprintf(&summary, " %q", event.EventName)
+		}
+		fmt.Fprintf(&summary, " site=%s %s%s%s", event.SiteID, event.Hostname, event.Pathname, event.Query)
+		if event.Properties != "" {
+			summary.WriteString(" " + event.Properties)
+		}
+	}
+	return summary.String()
+}
+
+// statusResponse is the document served on statusPath.
+type statusResponse struct {
+	Stats    Stats             `json:"stats"`
+	Requests []CapturedRequest `json:"requests"`
+}
+
+// serveStatus serves the stats and the captured requests of the plugin as JSON, so they can be inspected in a
+// deployment, where no code can call Stats or CapturedRequests.
+func (h *UmamiFeeder) serveStatus(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := json.Marshal(statusResponse{Stats: h.Stats(), Requests: h.CapturedRequests()})
+	if err != nil {
+		h.error("failed to encode status: " + err.Error())
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	if req.Method == http.MethodGet {
+		_, _ = rw.Write(body)
+	}
+}
@@ -0,0 +1,112 @@
+package traefik_rybbit_feeder
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCaptureBuffer(t *testing.T) {
+	buffer := newCaptureBuffer(2)
+	for _, path := range []string{"/a", "/b", "/c"} {
+		buffer.add(CapturedRequest{Path: path})
+	}
+
+	requests := buffer.list()
+	if len(requests) != 2 || requests[0].Path != "/b" || requests[1].Path != "/c" {
+		t.Fatalf("expected the last 2 requests oldest first, got %+v", requests)
+	}
+
+	if newCaptureBuffer(0) != nil {
+		t.Fatal("expected no buffer for size 0")
+	}
+}
+
+func TestCapturedRequests(t *testing.T) {
+	feeder := &UmamiFeeder{
+		next: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/missing" {
+				rw.WriteHeader(http.StatusNotFound)
+			}
+		}),
+		websites: map[string]string{"localhost": "1"},
+		queue:    newEventQueue(queueTypeChannel, 10, 1),
+		captures: newCaptureBuffer(10),
+	}
+
+	for _, url := range []string{"http://localhost/", "http://localhost/style.css", "http://localhost/missing", "http://unknown/"} {
+		feeder.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, url, nil))
+	}
+
+	expected := []struct {
+		path    string
+		tracked bool
+		reason  string
+		status  int
+	}{
+		{"/", true, "", http.StatusOK},
+		{"/style.css", false, "resource", 0},
+		{"/missing", false, "status", http.StatusNotFound},
+		{"/", false, "domain", 0},
+	}
+	requests := feeder.CapturedRequests()
+	if len(requests) != len(expected) {
+		t.Fatalf("expected %d captured requests, got %+v", len(expected), requests)
+	}
+	for i, request := range requests {
+		if request.Path != expected[i].path || request.Tracked != expected[i].tracked ||
+			request.Reason != expected[i].reason || request.Status != expected[i].status {
+			t.Errorf("unexpected captured request #%d %+v", i+1, request)
+		}
+	}
+	if payload := requests[0].Payload; payload != "pageview site=1 localhost/" {
+		t.Errorf("unexpected payload %q", payload)
+	}
+}
+
+func TestServeStatus(t *testing.T) {
+	feeder := &UmamiFeeder{
+		next:       http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+		websites:   map[string]string{"localhost": "1"},
+		queue:      newEventQueue(queueTypeChannel, 10, 1),
+		captures:   newCaptureBuffer(10),
+		statusPath: "/r/status",
+	}
+	feeder.isDisabled.Store(true)
+	feeder.failure.Store("unreachable")
+
+	feeder.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/", nil))
+	recorder := httptest.NewRecorder()
+	feeder.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://localhost/r/status", nil))
+
+	var status statusResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Header().Get("Content-Type") != "application/json" || status.Stats.Enabled ||
+		status.Stats.Failure != "unreachable" {
+		t.Fatalf("expected the stats of the disabled plugin, got %+v", status.Stats)
+	}
+	if len(status.Requests) != 1 || status.Requests[0].Reason != "disabled" {
+		t.Fatalf("expected the captured request, got %+v", status.Requests)
+	}
+
+	recorder = httptest.NewRecorder()
+	feeder.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "http://localhost/r/status", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", recorder.Code)
+	}
+}
+
+func TestSummarizeEvents(t *testing.T) {
+	pageview := &RybbitEvent{SiteID: "1", Type: "pageview", Hostname: "example.com", Pathname: "/search", Query: "?q=go"}
+	search := &RybbitEvent{SiteID: "1", Type: "custom_event", EventName: "site_search", Hostname: "example.com",
+		Pathname: "/search", Properties: `{"search_term":"go"}`}
+
+	expected := "pageview site=1 example.com/search?q=go\n" +
+		`custom_event "site_search" site=1 example.com/search {"search_term":"go"}`
+	if summary := summarizeEvents(pageview, nil, search); summary != expected {
+		t.Fatalf("expected %q, got %q", expected, summary)
+	}
+}
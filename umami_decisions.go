@@ -0,0 +1,87 @@
+package traefik_rybbit_feeder
+
+import (
+	"container/list"
+	"sync"
+)
+
+// decisionCache is a least recently used cache of tracking decisions by host and path, so repeatedly requested
+// locations, e.g. assets, skip the URL filters, resource checks and website lookup.
+type decisionCache struct {
+	mutex      sync.Mutex
+	size       int
+	entries    map[string]*list.Element
+	order      *list.List // most recently used first
+	generation uint64     // incremented by reset, decisions computed before are not cached
+}
+
+type decision struct {
+	key    string
+	reason string // why the location is not tracked, "" if it is
+}
+
+// newDecisionCache returns a cache holding up to size decisions, or nil if size is 0.
+func newDecisionCache(size int) *decisionCache {
+	if size <= 0 {
+		return nil
+	}
+	return &decisionCache{size: size, entries: make(map[string]*list.Element, size), order: list.New()}
+}
+
+// get returns the cached decision for key.
+func (c *decisionCache) get(key string) (reason string, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*decision).reason, true
+}
+
+// currentGeneration returns the generation to add the decisions computed from now on with.
+func (c *decisionCache) currentGeneration() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.generation
+}
+
+// add caches the decision for key, evicting the least recently used decision once the cache is full.
+// A decision of an older generation is dropped, the cache was reset while it was computed.
+func (c *decisionCache) add(key string, reason string, generation uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*decision).reason = reason
+		c.order.MoveToFront(element)
+		return
+	}
+
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*decision).key)
+	}
+	c.entries[key] = c.order.PushFront(&decision{key: key, reason: reason})
+}
+
+// reset drops all decisions, once any of the settings they depend on changed.
+func (c *decisionCache) reset() {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries = make(map[string]*list.Element, c.size)
+	c.order.Init()
+	c.generation++
+}
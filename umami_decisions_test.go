@@ -0,0 +1,83 @@
+package traefik_rybbit_feeder
+
+import (
+	"testing"
+)
+
+func TestDecisionCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newDecisionCache(2)
+	cache.add("a", "", 0)
+	cache.add("b", "resource", 0)
+	if _, ok := cache.get("a"); !ok {
+		t.Fatal("expected a to be cached")
+	}
+
+	cache.add("c", "", 0)
+	if _, ok := cache.get("b"); ok {
+		t.Fatal("expected b to be evicted")
+	}
+	if reason, ok := cache.get("a"); !ok || reason != "" {
+		t.Fatal("expected a to be kept")
+	}
+	if reason, ok := cache.get("c"); !ok || reason != "" {
+		t.Fatal("expected c to be cached")
+	}
+
+	generation := cache.currentGeneration()
+	cache.reset()
+	if _, ok := cache.get("a"); ok {
+		t.Fatal("expected the cache to be empty after a reset")
+	}
+
+	// A decision computed before the reset is not cached.
+	cache.add("a", "resource", generation)
+	if _, ok := cache.get("a"); ok {
+		t.Fatal("expected the decision of an older generation to be dropped")
+	}
+}
+
+func TestDecisionCacheDisabled(t *testing.T) {
+	if newDecisionCache(0) != nil {
+		t.Fatal("expected no cache for size 0")
+	}
+	// Resetting a disabled cache is a no-op.
+	var cache *decisionCache
+	cache.reset()
+}
+
+func TestShouldTrackCachesDecisions(t *testing.T) {
+	feeder := UmamiFeeder{
+		websites:  map[string]string{"example.com": "1"},
+		decisions: newDecisionCache(10),
+	}
+	if err := feeder.verifyConfig(&Config{IgnoreURLs: []string{"^/admin"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := feeder.loadPaused(); err != nil {
+		t.Fatal(err)
+	}
+
+	shouldTrack := func(url string) bool {
+		return feeder.shouldTrack(newServerRequest("example.com", url))
+	}
+
+	for i := 0; i < 2; i++ {
+		if !shouldTrack("/blog") {
+			t.Fatal("expected /blog to be tracked")
+		}
+		if shouldTrack("/admin") {
+			t.Fatal("expected /admin to be ignored")
+		}
+	}
+	if _, ok := feeder.decisions.get("example.com /blog"); !ok {
+		t.Fatal("expected the decision for /blog to be cached")
+	}
+
+	feeder.pausedHostnames = []string{"example.com"}
+	if err := feeder.loadPaused(); err != nil {
+		t.Fatal(err)
+	}
+	if shouldTrack("/blog") {
+		t.Fatal("expected the cached decision to be dropped once example.com is paused")
+	}
+}
@@ -0,0 +1,185 @@
+package traefik_rybbit_feeder
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// WebsiteFilter overrides the filters of a website, unset filters fall back to the global ones.
+type WebsiteFilter struct {
+	// IgnoreURLs replaces the global IgnoreURLs for the website, if set.
+	IgnoreURLs []string `json:"ignoreURLs"`
+	// AllowURLs replaces the global AllowURLs for the website, if set.
+	AllowURLs []string `json:"allowURLs"`
+	// TrackErrors replaces the global TrackErrors for the website, if set.
+	TrackErrors *bool `json:"trackErrors"`
+	// TrackClientErrors replaces the global TrackClientErrors and TrackErrors for client errors, if set.
+	TrackClientErrors *bool `json:"trackClientErrors"`
+	// TrackServerErrors replaces the global TrackServerErrors and TrackErrors for server errors, if set.
+	TrackServerErrors *bool `json:"trackServerErrors"`
+	// TrackAllResources replaces the global TrackAllResources for the website, if set.
+	TrackAllResources *bool `json:"trackAllResources"`
+	// TrackExtensions replaces the global TrackExtensions for the website, if set.
+	TrackExtensions []string `json:"trackExtensions"`
+}
+
+// websiteFilter holds the filters of a website with an override, the global ones where it sets none.
+type websiteFilter struct {
+	ignoreRegexp      *regexp.Regexp
+	allowRegexp       *regexp.Regexp
+	trackClientErrors bool
+	trackServerErrors bool
+	trackAllResources bool
+	trackExtensions   []string
+}
+
+// setupWebsiteFilters compiles the filter overrides of the websites, once the global filters are set up.
+// They are keyed like the websites, so a wildcard or pattern entry applies to all hostnames it matches.
+func (h *UmamiFeeder) setupWebsiteFilters(config *Config) error {
+	h.websiteFilters = make(map[string]*websiteFilter, len(config.WebsiteFilters))
+	for hostname, override := range config.WebsiteFilters {
+		filter, err := h.newWebsiteFilter("website "+hostname, override, !config.SkipInvalidConfig)
+		if err != nil {
+			return err
+		}
+		h.websiteFilters[websiteHostname(hostname)] = filter
+	}
+
+	if config.ShadowFilter != nil {
+		filter, err := h.newWebsiteFilter("shadowFilter", *config.ShadowFilter, !config.SkipInvalidConfig)
+		if err != nil {
+			return err
+		}
+		h.shadowFilter = filter
+	}
+	return nil
+}
+
+// newWebsiteFilter compiles override on top of the global filters. Invalid patterns are skipped unless strict.
+func (h *UmamiFeeder) newWebsiteFilter(name string, override WebsiteFilter, strict bool) (*websiteFilter, error) {
+	filter := h.globalFilter()
+
+	ignoreURLs, allowURLs := override.IgnoreURLs, override.AllowURLs
+	if !strict {
+		ignoreURLs, allowURLs = h.validPatterns("ignoreURLs", ignoreURLs), h.validPatterns("allowURLs", allowURLs)
+	}
+	if len(ignoreURLs) > 0 {
+		ignoreRegexp, err := compileAlternation(ignoreURLs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile ignoreURL of %s %w", name, err)
+		}
+		filter.ignoreRegexp = ignoreRegexp
+	}
+	if len(allowURLs) > 0 {
+		allowRegexp, err := compileAlternation(allowURLs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile allowURL of %s %w", name, err)
+		}
+		filter.allowRegexp = allowRegexp
+	}
+
+	if override.TrackErrors != nil {
+		filter.trackClientErrors, filter.trackServerErrors = *override.TrackErrors, *override.TrackErrors
+	}
+	if override.TrackClientErrors != nil {
+		filter.trackClientErrors = *override.TrackClientErrors
+	}
+	if override.TrackServerErrors != nil {
+		filter.trackServerErrors = *override.TrackServerErrors
+	}
+	if override.TrackAllResources != nil {
+		filter.trackAllResources = *override.TrackAllResources
+	}
+	if len(override.TrackExtensions) > 0 {
+		filter.trackExtensions = override.TrackExtensions
+	}
+	return &filter, nil
+}
+
+// globalFilter returns the global filters, which apply to websites without an override.
+func (h *UmamiFeeder) globalFilter() websiteFilter {
+	return websiteFilter{
+		ignoreRegexp:      h.ignoreRegexp,
+		allowRegexp:       h.allowRegexp,
+		trackClientErrors: h.trackClientErrors,
+		trackServerErrors: h.trackServerErrors,
+		trackAllResources: h.trackAllResources,
+		trackExtensions:   h.trackExtensions,
+	}
+}
+
+// tracksError reports whether the filter tracks the error statusCode, a client or a server error.
+func (f websiteFilter) tracksError(statusCode int) bool {
+	if statusCode >= 500 {
+		return f.trackServerErrors
+	}
+	return f.trackClientErrors
+}
+
+// activeFilter returns the filters applied to hostname, the override of its website or else the global filters.
+func (h *UmamiFeeder) activeFilter(hostname string) websiteFilter {
+	if filter := h.filterFor(hostname); filter != nil {
+		return *filter
+	}
+	return h.globalFilter()
+}
+
+// filterURL returns why filter excludes requestURL by its URL filters or tracked resources, or "" if it passes.
+func (h *UmamiFeeder) filterURL(filter websiteFilter, requestURL string) string {
+	if filter.ignoreRegexp != nil && filter.ignoreRegexp.MatchString(requestURL) {
+		return "location"
+	}
+	if filter.allowRegexp != nil && !filter.allowRegexp.MatchString(requestURL) {
+		return "location not allowed"
+	}
+
+	// API requests and events are tracked regardless of their resource type, e.g. `/api/data.json`.
+	urlPath, _, _ := strings.Cut(requestURL, "?")
+	if !h.isAPIRequest(urlPath) && !h.isEventPath(urlPath) && !isTrackedResource(urlPath, filter.trackAllResources, filter.trackExtensions) {
+		return "resource"
+	}
+	return ""
+}
+
+// filterFor returns the filter override of the website hostname belongs to, or nil if it has none.
+func (h *UmamiFeeder) filterFor(hostname string) *websiteFilter {
+	if len(h.websiteFilters) == 0 {
+		return nil
+	}
+
+	h.websitesMutex.RLock()
+	key := h.websiteKey(hostname)
+	h.websitesMutex.RUnlock()
+
+	return h.websiteFilters[key]
+}
+
+// isTrackedResource reports whether url is a resource to track, i.e. any if trackAll is set, else one of
+// the extensions if given, or else one believed to contain content.
+func isTrackedResource(url string, trackAll bool, extensions []string) bool {
+	if trackAll {
+		return true
+	}
+
+	pathExt := path.Ext(url)
+
+	// If a custom file extension list is defined, check if the resource matches it. If not, do not report.
+	if len(extensions) > 0 {
+		for _, suffix := range extensions {
+			if suffix == pathExt {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Check if the suffix is regarded to be "content".
+	switch pathExt {
+	case "", ".htm", ".html", ".xhtml", ".jsf", ".md", ".php", ".rss", ".rtf", ".txt", ".xml", ".pdf":
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,84 @@
+package traefik_rybbit_feeder
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestWebsiteFilters(t *testing.T) {
+	trackAll, trackErrors := true, true
+	feeder := &UmamiFeeder{
+		websites: map[string]string{"blog.example.com": "1", "app.example.com": "2", "www.example.com": "3"},
+	}
+	err := feeder.setupWebsiteFilters(&Config{
+		WebsiteFilters: map[string]WebsiteFilter{
+			"blog.example.com": {TrackAllResources: &trackAll},
+			"APP.example.com":  {IgnoreURLs: []string{"^/admin"}, TrackErrors: &trackErrors},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		host     string
+		url      string
+		expected string
+	}{
+		{"blog.example.com", "/files/report.zip", ""},
+		{"www.example.com", "/files/report.zip", "resource"},
+		{"app.example.com", "/admin/users", "location"},
+		{"app.example.com", "/dashboard", ""},
+		{"www.example.com", "/admin/users", ""},
+	} {
+		if reason := feeder.locationReason(test.host, test.url); reason != test.expected {
+			t.Errorf("%s%s: expected %q, got %q", test.host, test.url, test.expected, reason)
+		}
+	}
+
+	if !feeder.shouldTrackStatus("app.example.com", http.StatusNotFound) {
+		t.Error("expected errors to be tracked for app.example.com")
+	}
+	if feeder.shouldTrackStatus("www.example.com", http.StatusNotFound) {
+		t.Error("expected errors not to be tracked for www.example.com")
+	}
+}
+
+func TestTrackClientAndServerErrors(t *testing.T) {
+	trackClientErrors := true
+	feeder := &UmamiFeeder{
+		websites:          map[string]string{"example.com": "1", "app.example.com": "2"},
+		trackServerErrors: true,
+	}
+	err := feeder.setupWebsiteFilters(&Config{
+		WebsiteFilters: map[string]WebsiteFilter{"app.example.com": {TrackClientErrors: &trackClientErrors}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		host     string
+		status   int
+		expected bool
+	}{
+		{"example.com", http.StatusNotFound, false},
+		{"example.com", http.StatusInternalServerError, true},
+		{"app.example.com", http.StatusNotFound, true},
+		{"app.example.com", http.StatusBadGateway, true},
+	} {
+		if track := feeder.shouldTrackStatus(test.host, test.status); track != test.expected {
+			t.Errorf("%s %d: expected %v, got %v", test.host, test.status, test.expected, track)
+		}
+	}
+}
+
+func TestWebsiteFiltersInvalid(t *testing.T) {
+	feeder := &UmamiFeeder{}
+	err := feeder.setupWebsiteFilters(&Config{
+		WebsiteFilters: map[string]WebsiteFilter{"example.com": {IgnoreURLs: []string{"("}}},
+	})
+	if err == nil {
+		t.Fatal("expected an error for an invalid ignoreURL")
+	}
+}
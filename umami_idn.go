@@ -0,0 +1,128 @@
+package traefik_rybbit_feeder
+
+import (
+	"errors"
+	"math"
+	"strings"
+)
+
+// Parameters of the Punycode encoding of internationalized domain names, see RFC 3492.
+const (
+	punycodeBase        = 36
+	punycodeTMin        = 1
+	punycodeTMax        = 26
+	punycodeSkew        = 38
+	punycodeDamp        = 700
+	punycodeInitialBias = 72
+	punycodeInitialN    = 128
+	punycodePrefix      = "xn--"
+)
+
+var errInvalidPunycode = errors.New("invalid punycode")
+
+// normalizeIDN returns the lower-cased hostname with its Punycode labels (`xn--`) decoded, so internationalized
+// domain names are looked up and reported in their Unicode form, however they are requested or configured.
+// Labels which are not valid Punycode are kept as they are.
+func normalizeIDN(hostname string) string {
+	if !strings.Contains(hostname, punycodePrefix) {
+		return hostname
+	}
+
+	labels := strings.Split(hostname, ".")
+	for i, label := range labels {
+		if !strings.HasPrefix(label, punycodePrefix) {
+			continue
+		}
+		if decoded, err := decodePunycode(label[len(punycodePrefix):]); err == nil {
+			labels[i] = strings.ToLower(decoded)
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// decodePunycode decodes a Punycode label without its `xn--` prefix.
+func decodePunycode(encoded string) (string, error) {
+	var output []rune
+	if b := strings.LastIndexByte(encoded, '-'); b >= 0 {
+		for _, r := range encoded[:b] {
+			if r >= 0x80 {
+				return "", errInvalidPunycode
+			}
+			output = append(output, r)
+		}
+		encoded = encoded[b+1:]
+	}
+	// A label of basic code points only is not an internationalized domain name.
+	if encoded == "" {
+		return "", errInvalidPunycode
+	}
+
+	n, i, bias := punycodeInitialN, 0, punycodeInitialBias
+	for pos := 0; pos < len(encoded); {
+		oldI, w := i, 1
+		for k := punycodeBase; ; k += punycodeBase {
+			if pos == len(encoded) {
+				return "", errInvalidPunycode
+			}
+			digit, ok := punycodeDigit(encoded[pos])
+			pos++
+			if !ok || digit > (math.MaxInt32-i)/w {
+				return "", errInvalidPunycode
+			}
+			i += digit * w
+
+			t := k - bias
+			if t < punycodeTMin {
+				t = punycodeTMin
+			} else if t > punycodeTMax {
+				t = punycodeTMax
+			}
+			if digit < t {
+				break
+			}
+			w *= punycodeBase - t
+		}
+
+		bias = adaptPunycodeBias(i-oldI, len(output)+1, oldI == 0)
+		n += i / (len(output) + 1)
+		i %= len(output) + 1
+		if n > 0x10FFFF {
+			return "", errInvalidPunycode
+		}
+
+		output = append(output, 0)
+		copy(output[i+1:], output[i:])
+		output[i] = rune(n)
+		i++
+	}
+
+	return string(output), nil
+}
+
+func punycodeDigit(c byte) (int, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c-'0') + 26, true
+	case c >= 'a' && c <= 'z':
+		return int(c - 'a'), true
+	case c >= 'A' && c <= 'Z':
+		return int(c - 'A'), true
+	}
+	return 0, false
+}
+
+func adaptPunycodeBias(delta int, numPoints int, first bool) int {
+	if first {
+		delta /= punycodeDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+
+	k := 0
+	for delta > ((punycodeBase-punycodeTMin)*punycodeTMax)/2 {
+		delta /= punycodeBase - punycodeTMin
+		k += punycodeBase
+	}
+	return k + (punycodeBase-punycodeTMin+1)*delta/(delta+punycodeSkew)
+}
@@ -0,0 +1,26 @@
+package traefik_rybbit_feeder
+
+import (
+	"testing"
+)
+
+func TestNormalizeIDN(t *testing.T) {
+	tests := map[string]string{
+		"example.com":                "example.com",
+		"xn--mnchen-3ya.de":          "münchen.de",
+		"shop.xn--bcher-kva.example": "shop.bücher.example",
+		"xn--fa-hia.de":              "faß.de",
+		"xn--r8jz45g.jp":             "例え.jp",
+		"xn--eckwd4c7cu47r2wf.jp":    "ドメイン名例.jp",
+		"xn--d1abbgf6aiiy.xn--p1ai":  "президент.рф",
+		"xn--invalid-.com":           "xn--invalid-.com",
+		"xn--ab9.com":                "xn--ab9.com",
+		"xn--99999999999999.com":     "xn--99999999999999.com",
+	}
+
+	for hostname, expected := range tests {
+		if actual := normalizeIDN(hostname); actual != expected {
+			t.Errorf("expected %q for %q, got %q", expected, hostname, actual)
+		}
+	}
+}
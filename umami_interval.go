@@ -0,0 +1,73 @@
+package traefik_rybbit_feeder
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// intervalCount is what was counted for a key during an interval.
+type intervalCount struct {
+	count int   // amount of values added
+	sum   int64 // sum of the values added
+}
+
+// intervalCounter counts values per key between two emissions of the events emitted every interval, i.e. the
+// rollup, bandwidth and abort rate events. Keys must be comparable.
+type intervalCounter struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	counts   map[any]*intervalCount
+
+	// admit returns the key to count instead of a key not counted yet, given whether maxKeys keys are counted
+	// already, e.g. a catch-all key. Keys are counted as they are if admit is nil.
+	maxKeys int
+	admit   func(key any, full bool) any
+}
+
+func newIntervalCounter(interval time.Duration, maxKeys int, admit func(key any, full bool) any) *intervalCounter {
+	return &intervalCounter{interval: interval, counts: map[any]*intervalCount{}, maxKeys: maxKeys, admit: admit}
+}
+
+func (c *intervalCounter) add(key any, value int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	count, ok := c.counts[key]
+	if !ok && c.admit != nil {
+		key = c.admit(key, len(c.counts) >= c.maxKeys)
+		count, ok = c.counts[key]
+	}
+	if !ok {
+		count = &intervalCount{}
+		c.counts[key] = count
+	}
+	count.count++
+	count.sum += value
+}
+
+// take returns the counts since the last call and starts counting anew.
+func (c *intervalCounter) take() map[any]*intervalCount {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	counts := c.counts
+	c.counts = make(map[any]*intervalCount, len(counts))
+	return counts
+}
+
+// emitIntervals calls flush every interval of counter, and once more when ctx is canceled.
+func (h *UmamiFeeder) emitIntervals(ctx context.Context, counter *intervalCounter, flush func()) {
+	ticker := time.NewTicker(counter.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flush()
+			return
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
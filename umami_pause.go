@@ -0,0 +1,86 @@
+package traefik_rybbit_feeder
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+// isPaused reports whether tracking is paused for hostname, by pausedHostnames or the pause file.
+func (h *UmamiFeeder) isPaused(hostname string) bool {
+	paused, _ := h.paused.Load().(map[string]struct{})
+	_, ok := paused[hostname]
+	return ok
+}
+
+// loadPaused sets the paused hostnames to pausedHostnames and those listed in the pause file, if any.
+// A missing pause file pauses nothing beyond pausedHostnames.
+func (h *UmamiFeeder) loadPaused() error {
+	paused := make(map[string]struct{}, len(h.pausedHostnames))
+	for _, hostname := range h.pausedHostnames {
+		paused[parseDomainFromHost(hostname)] = struct{}{}
+	}
+
+	if h.pauseFile != "" {
+		file, err := os.Open(h.pauseFile)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err == nil {
+			// One hostname per line, `#` starts a comment.
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				line, _, _ := strings.Cut(scanner.Text(), "#")
+				if hostname := parseDomainFromHost(line); hostname != "" {
+					paused[hostname] = struct{}{}
+				}
+			}
+			err = scanner.Err()
+			_ = file.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	h.paused.Store(paused)
+	// Cached decisions depend on the paused hostnames.
+	h.decisions.reset()
+	return nil
+}
+
+// watchPauseFile reloads the paused hostnames every pauseFileInterval once the pause file changed, until ctx is canceled.
+func (h *UmamiFeeder) watchPauseFile(ctx context.Context) {
+	ticker := time.NewTicker(h.pauseFileInterval)
+	defer ticker.Stop()
+
+	var lastModified time.Time
+	var lastSize int64 = -1
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			modified, size := time.Time{}, int64(-1)
+			if info, err := os.Stat(h.pauseFile); err == nil {
+				modified, size = info.ModTime(), info.Size()
+			}
+			if modified.Equal(lastModified) && size == lastSize {
+				continue
+			}
+			lastModified, lastSize = modified, size
+
+			if err := h.loadPaused(); err != nil {
+				h.error("failed to read pauseFile: " + err.Error())
+				continue
+			}
+			paused, _ := h.paused.Load().(map[string]struct{})
+			h.debug("tracking paused for %d hostname(s)", len(paused))
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package traefik_rybbit_feeder
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadPaused(t *testing.T) {
+	pauseFile := filepath.Join(t.TempDir(), "paused")
+	feeder := &UmamiFeeder{
+		websites:        map[string]string{"static.com": "1", "incident.com": "2", "other.com": "3"},
+		pausedHostnames: []string{"static.com"},
+		pauseFile:       pauseFile,
+	}
+
+	// A missing file pauses nothing beyond pausedHostnames.
+	if err := feeder.loadPaused(); err != nil {
+		t.Fatal(err)
+	}
+	if !feeder.isPaused("static.com") || feeder.isPaused("incident.com") {
+		t.Fatal("expected only static.com to be paused")
+	}
+
+	if err := os.WriteFile(pauseFile, []byte("# incident 42\nIncident.com\n\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := feeder.loadPaused(); err != nil {
+		t.Fatal(err)
+	}
+
+	for hostname, paused := range map[string]bool{"static.com": true, "incident.com": true, "other.com": false} {
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://"+hostname+"/", nil)
+		if feeder.shouldTrack(req) == paused {
+			t.Fatalf("%s: expected paused %v", hostname, paused)
+		}
+	}
+}
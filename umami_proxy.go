@@ -0,0 +1,176 @@
+package traefik_rybbit_feeder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxProxyBodySize bounds the tracker payloads accepted by the proxy, they are a few hundred bytes usually.
+const maxProxyBodySize = 64 << 10
+
+// tenantFor returns the tenant the website hostname belongs to.
+func (h *UmamiFeeder) tenantFor(hostname string) *tenant {
+	h.websitesMutex.RLock()
+	defer h.websitesMutex.RUnlock()
+
+	if t, ok := h.websiteTenants[h.websiteKey(hostname)]; ok {
+		return t
+	}
+	// Websites without a tenant belong to the top-level host, which is the first tenant.
+	return h.tenants[0]
+}
+
+// serveProxy forwards a request of the client-side tracker to the Rybbit instance of the website,
+// authenticated with its API key and with the client IP injected, so the tracker can be used first-party.
+// Only events for the site-id of the requested hostname are forwarded.
+func (h *UmamiFeeder) serveProxy(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	hostname := parseDomainFromHost(req.Host)
+	websiteId, ok := h.lookupWebsite(hostname)
+	if !ok {
+		http.Error(rw, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	var payload map[string]any
+	if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxProxyBodySize)).Decode(&payload); err != nil {
+		h.debug("invalid tracker payload: %v", err)
+		http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// The tracker may send the site-id as a number.
+	if siteId := fmt.Sprint(payload["site_id"]); siteId != websiteId {
+		h.debug("rejecting tracker payload for site-id %s on %s", siteId, hostname)
+		http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if ip := h.eventIP(req); ip != "" {
+		payload["ip_address"] = ip
+	} else {
+		delete(payload, "ip_address")
+	}
+	if _, ok := payload["user_agent"]; !ok {
+		payload["user_agent"] = req.UserAgent()
+	}
+	for field, omit := range map[string]bool{
+		"user_agent": h.omitUserAgent, "language": h.omitLanguage, "referrer": h.omitReferrer, "properties": h.omitProperties,
+	} {
+		if omit {
+			delete(payload, field)
+		}
+	}
+
+	t := h.tenantFor(hostname)
+	headers := map[string][]string{
+		"Authorization": {"Bearer " + t.apiKey},
+	}
+	resp, err := sendRequest(req.Context(), h.client, t.host+"/api/track", payload, headers)
+	// The response of Rybbit is passed through, so the tracker sees why an event was rejected.
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		h.debug("tracking proxied to %s returned %d: %s", t.host, statusErr.status, statusErr.message)
+		rw.WriteHeader(statusErr.status)
+		_, _ = io.WriteString(rw, statusErr.message)
+		return
+	}
+	if err != nil {
+		h.error("failed to proxy tracking to " + t.host + ": " + err.Error())
+		http.Error(rw, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		rw.Header().Set("Content-Type", contentType)
+	}
+	rw.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(rw, resp.Body)
+}
+
+// cachedScript is the tracking script of a Rybbit instance, served by serveScript.
+type cachedScript struct {
+	body    []byte
+	fetched time.Time
+}
+
+// serveScript serves the tracking script of the Rybbit instance of the website, fetched at most every scriptCacheTTL.
+// A stale script is served if it can not be fetched again.
+func (h *UmamiFeeder) serveScript(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	hostname := parseDomainFromHost(req.Host)
+	if _, ok := h.lookupWebsite(hostname); !ok {
+		http.Error(rw, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	t := h.tenantFor(hostname)
+
+	h.scriptsMutex.Lock()
+	script := h.scripts[t.host]
+	h.scriptsMutex.Unlock()
+
+	if script == nil || time.Since(script.fetched) > h.scriptCacheTTL {
+		// The fetch is shared by concurrent requests, it must not be canceled along with one of them.
+		fetched, err := h.fetchScript(context.WithoutCancel(req.Context()), t)
+		if err != nil {
+			h.error("failed to fetch script from " + t.host + ": " + err.Error())
+		} else {
+			script = fetched
+		}
+	}
+	if script == nil {
+		http.Error(rw, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	rw.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(h.scriptCacheTTL.Seconds())))
+	http.ServeContent(rw, req, "script.js", script.fetched, bytes.NewReader(script.body))
+}
+
+// fetchScript downloads the tracking script of the tenant and caches it.
+func (h *UmamiFeeder) fetchScript(ctx context.Context, t *tenant) (*cachedScript, error) {
+	script, err := rybbitFlights.do("script:"+t.host, func() (any, error) {
+		resp, err := sendRequest(ctx, h.client, t.host+"/api/script.js", nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &cachedScript{body: body, fetched: time.Now()}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	h.scriptsMutex.Lock()
+	h.scripts[t.host] = script.(*cachedScript)
+	h.scriptsMutex.Unlock()
+
+	return script.(*cachedScript), nil
+}
@@ -0,0 +1,131 @@
+package traefik_rybbit_feeder
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeProxy(t *testing.T) {
+	var received map[string]any
+	var authorization string
+	rybbit := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		authorization = req.Header.Get("Authorization")
+		_ = json.NewDecoder(req.Body).Decode(&received)
+		rw.Header().Set("Content-Type", "application/json")
+		_, _ = rw.Write([]byte(`{"success":true}`))
+	}))
+	defer rybbit.Close()
+
+	feeder := &UmamiFeeder{
+		next:      http.HandlerFunc(func(http.ResponseWriter, *http.Request) { t.Fatal("proxied request passed on") }),
+		client:    rybbit.Client(),
+		websites:  map[string]string{"localhost": "1"},
+		tenants:   []*tenant{{host: rybbit.URL, apiKey: "secret"}},
+		proxyPath: "/r/track",
+	}
+
+	for body, expected := range map[string]int{
+		`{"site_id":"1","type":"pageview","pathname":"/"}`: http.StatusOK,
+		`{"site_id":1,"type":"pageview","pathname":"/"}`:   http.StatusOK,
+		`{"site_id":"2","type":"pageview","pathname":"/"}`: http.StatusForbidden,
+		`not json`: http.StatusBadRequest,
+	} {
+		received = nil
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/r/track", strings.NewReader(body))
+		req.RemoteAddr = "192.168.0.1:54321"
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		rec := httptest.NewRecorder()
+		feeder.ServeHTTP(rec, req)
+
+		if rec.Code != expected {
+			t.Fatalf("%s: expected status %d, got %d", body, expected, rec.Code)
+		}
+		if expected != http.StatusOK {
+			if received != nil {
+				t.Fatalf("%s: expected the payload not to be forwarded", body)
+			}
+			continue
+		}
+		if authorization != "Bearer secret" || received["ip_address"] != "192.168.0.1" || received["user_agent"] != "Mozilla/5.0" {
+			t.Fatalf("%s: unexpected forwarded payload %v (%s)", body, received, authorization)
+		}
+	}
+}
+
+func TestServeProxyPassesThroughRejections(t *testing.T) {
+	rybbit := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.Error(rw, `{"error":"invalid pathname"}`, http.StatusUnprocessableEntity)
+	}))
+
+	feeder := &UmamiFeeder{
+		client:    rybbit.Client(),
+		websites:  map[string]string{"localhost": "1"},
+		tenants:   []*tenant{{host: rybbit.URL, apiKey: "secret"}},
+		proxyPath: "/r/track",
+	}
+	body := `{"site_id":"1","type":"pageview"}`
+
+	rec := httptest.NewRecorder()
+	feeder.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "http://localhost/r/track", strings.NewReader(body)))
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "invalid pathname") {
+		t.Fatalf("expected the rejection of Rybbit, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	// Only an unreachable instance is a bad gateway.
+	rybbit.Close()
+	rec = httptest.NewRecorder()
+	feeder.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "http://localhost/r/track", strings.NewReader(body)))
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("expected %d, got %d", http.StatusBadGateway, rec.Code)
+	}
+}
+
+func TestServeScript(t *testing.T) {
+	fetches := 0
+	rybbit := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/script.js" {
+			t.Fatalf("unexpected request for %s", req.URL.Path)
+		}
+		fetches++
+		_, _ = rw.Write([]byte("console.log('rybbit')"))
+	}))
+
+	feeder := &UmamiFeeder{
+		next:           http.HandlerFunc(func(http.ResponseWriter, *http.Request) { t.Fatal("script request passed on") }),
+		client:         rybbit.Client(),
+		websites:       map[string]string{"localhost": "1"},
+		tenants:        []*tenant{{host: rybbit.URL}},
+		scriptPath:     "/r/script.js",
+		scriptCacheTTL: time.Hour,
+		scripts:        map[string]*cachedScript{},
+	}
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		feeder.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://localhost/r/script.js", nil))
+
+		if rec.Code != http.StatusOK || rec.Body.String() != "console.log('rybbit')" {
+			t.Fatalf("unexpected response %d %s", rec.Code, rec.Body.String())
+		}
+		if !strings.Contains(rec.Header().Get("Content-Type"), "javascript") {
+			t.Fatalf("unexpected content type %s", rec.Header().Get("Content-Type"))
+		}
+	}
+	if fetches != 1 {
+		t.Fatalf("expected the script to be fetched once, got %d", fetches)
+	}
+
+	// A stale script is served while Rybbit is unreachable.
+	rybbit.Close()
+	feeder.scripts[rybbit.URL].fetched = time.Now().Add(-2 * time.Hour)
+
+	rec := httptest.NewRecorder()
+	feeder.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://localhost/r/script.js", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the stale script, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,156 @@
+package traefik_rybbit_feeder
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxQuarantineShapes bounds the event shapes whose rejections are counted, further shapes are not quarantined.
+const maxQuarantineShapes = 1000
+
+// quarantineKey is the shape of an event: its site, type, name and the optional fields it sets, so only events
+// with the payload Rybbit rejected are quarantined.
+type quarantineKey struct {
+	siteID    string
+	eventType string
+	eventName string
+	fields    uint8
+}
+
+// quarantine drops the events of a shape Rybbit rejected with the same client error threshold times in a row,
+// for duration, instead of submitting events bound to fail. An accepted event of the shape resets the count.
+type quarantine struct {
+	mutex      sync.Mutex
+	threshold  int
+	duration   time.Duration
+	rejections map[quarantineKey]*rejection
+	counted    atomic.Int32 // amount of shapes with rejections, so accepted events skip the lock while there is none
+	size       atomic.Int32 // amount of quarantined shapes, so events skip the lock while there is none
+}
+
+// rejection counts the identical rejections of a shape, it is quarantined if until is set.
+type rejection struct {
+	err   string
+	count int
+	until time.Time
+}
+
+func newQuarantine(threshold int, duration time.Duration) *quarantine {
+	return &quarantine{threshold: threshold, duration: duration, rejections: map[quarantineKey]*rejection{}}
+}
+
+func quarantineKeyOf(event *RybbitEvent) quarantineKey {
+	var fields uint8
+	for i, value := range []string{event.Query, event.Hostname, event.IP, event.UserAgent, event.Language,
+		event.Referrer, event.Properties} {
+		if value != "" {
+			fields |= 1 << i
+		}
+	}
+	return quarantineKey{siteID: event.SiteID, eventType: event.Type, eventName: event.EventName, fields: fields}
+}
+
+// reject counts a rejection of the shape with err, and reports whether it quarantined the shape.
+// A different error starts counting anew.
+func (q *quarantine) reject(key quarantineKey, err string, now time.Time) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	r, ok := q.rejections[key]
+	if !ok {
+		if len(q.rejections) >= maxQuarantineShapes {
+			return false
+		}
+		r = &rejection{}
+		q.rejections[key] = r
+		q.counted.Add(1)
+	}
+	if r.err != err {
+		r.err, r.count = err, 0
+	}
+	r.count++
+
+	if r.count < q.threshold || !r.until.IsZero() {
+		return false
+	}
+	r.until = now.Add(q.duration)
+	q.size.Add(1)
+	return true
+}
+
+// contains reports whether the shape is quarantined, releasing it once its quarantine expired.
+func (q *quarantine) contains(key quarantineKey, now time.Time) bool {
+	if q.size.Load() == 0 {
+		return false
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	r, ok := q.rejections[key]
+	if !ok || r.until.IsZero() {
+		return false
+	}
+	if now.Before(r.until) {
+		return true
+	}
+	delete(q.rejections, key)
+	q.counted.Add(-1)
+	q.size.Add(-1)
+	return false
+}
+
+// accept resets the rejections of a shape which is not quarantined, once Rybbit accepted an event of it.
+func (q *quarantine) accept(key quarantineKey) {
+	if q.counted.Load() == 0 {
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if r, ok := q.rejections[key]; ok && r.until.IsZero() {
+		delete(q.rejections, key)
+		q.counted.Add(-1)
+	}
+}
+
+// isRejection reports whether err is a client error of Rybbit rejecting the payload, not a transient failure
+// nor a rejected API key, which affects all events alike.
+func isRejection(err error) (*statusError, bool) {
+	var statusErr *statusError
+	if !errors.As(err, &statusErr) || statusErr.status < 400 || statusErr.status >= 500 {
+		return nil, false
+	}
+	switch statusErr.status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		return nil, false
+	}
+	return statusErr, true
+}
+
+// rejectEvent counts the rejection of event by the tenant, and logs once its shape is quarantined.
+func (h *UmamiFeeder) rejectEvent(t *tenant, event *RybbitEvent, err *statusError) {
+	key := quarantineKeyOf(event)
+	if !t.quarantine.reject(key, err.Error(), time.Now()) {
+		h.error("event rejected by " + t.host + ": " + err.Error())
+		return
+	}
+	h.warn(fmt.Sprintf("quarantining %s events %q of site %s for %v after %d identical rejections: %s",
+		key.eventType, key.eventName, key.siteID, t.quarantine.duration, t.quarantine.threshold, err.Error()))
+}
+
+// dropQuarantined drops the event if its shape is quarantined by the tenant, before it is submitted.
+// The quarantine applies to the events of all instances sharing the tenant.
+func (h *UmamiFeeder) dropQuarantined(t *tenant, event *RybbitEvent) bool {
+	if t.quarantine == nil || !t.quarantine.contains(quarantineKeyOf(event), time.Now()) {
+		return false
+	}
+	releaseEvent(event)
+	t.stats.quarantined.Add(1)
+	return true
+}
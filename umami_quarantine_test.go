@@ -0,0 +1,105 @@
+package traefik_rybbit_feeder
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuarantine(t *testing.T) {
+	q := newQuarantine(2, time.Minute)
+	key := quarantineKey{siteID: "1", eventType: eventTypeCustom, eventName: "signup"}
+	now := time.Now()
+
+	if q.reject(key, "invalid name", now) || q.reject(key, "invalid site", now) {
+		t.Fatal("expected different errors not to quarantine the shape")
+	}
+	if !q.reject(key, "invalid site", now) {
+		t.Fatal("expected 2 identical errors to quarantine the shape")
+	}
+	if !q.contains(key, now) || q.contains(quarantineKey{siteID: "1", eventType: eventTypePageview}, now) {
+		t.Fatal("expected only the rejected shape to be quarantined")
+	}
+
+	if q.contains(key, now.Add(time.Minute)) || q.size.Load() != 0 {
+		t.Fatal("expected the quarantine to expire")
+	}
+
+	// Only rejections in a row count.
+	q.reject(key, "invalid site", now)
+	q.accept(key)
+	if q.reject(key, "invalid site", now) {
+		t.Fatal("expected an accepted event to reset the rejections")
+	}
+}
+
+func TestQuarantineKeyOf(t *testing.T) {
+	event := &RybbitEvent{SiteID: "1", Type: eventTypeCustom, EventName: "signup"}
+	withProperties := &RybbitEvent{SiteID: "1", Type: eventTypeCustom, EventName: "signup", Properties: "{}"}
+	if quarantineKeyOf(event) == quarantineKeyOf(withProperties) {
+		t.Fatal("expected events with other fields to have another shape")
+	}
+	if quarantineKeyOf(event) != quarantineKeyOf(&RybbitEvent{SiteID: "1", Type: eventTypeCustom, EventName: "signup"}) {
+		t.Fatal("expected events with the same fields to have the same shape")
+	}
+}
+
+func TestIsRejection(t *testing.T) {
+	tests := map[int]bool{
+		http.StatusBadRequest:          true,
+		http.StatusUnprocessableEntity: true,
+		http.StatusUnauthorized:        false,
+		http.StatusForbidden:           false,
+		http.StatusTooManyRequests:     false,
+		http.StatusBadGateway:          false,
+	}
+	for status, expected := range tests {
+		if _, ok := isRejection(&statusError{status: status}); ok != expected {
+			t.Errorf("isRejection(%d) = %v, expected %v", status, ok, expected)
+		}
+	}
+}
+
+func TestReportEventsQuarantine(t *testing.T) {
+	rybbit := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if strings.Contains(string(body), `"event_name":"broken"`) {
+			http.Error(rw, "invalid event", http.StatusBadRequest)
+		}
+	}))
+	defer rybbit.Close()
+
+	tn := &tenant{
+		host:       rybbit.URL,
+		apiKey:     "key",
+		queue:      newEventQueue(queueTypeChannel, 10, 1),
+		client:     rybbit.Client(),
+		batchSize:  10,
+		quarantine: newQuarantine(2, time.Hour),
+	}
+	tn.batchRetry.Store(time.Now().Add(time.Hour).UnixNano())
+	feeder := &UmamiFeeder{queue: tn.queue, tenants: []*tenant{tn}}
+
+	var batch []*SendBody
+	for _, name := range []string{"broken", "", "broken"} {
+		batch = append(batch, &SendBody{Payload: &RybbitEvent{SiteID: "1", Type: eventTypeCustom, EventName: name}, ApiKey: "key"})
+	}
+	feeder.reportEventsToUmami(context.Background(), tn, batch)
+
+	// Events enqueued by any instance sharing the tenant are dropped before they are submitted.
+	other := &UmamiFeeder{queue: tn.queue, tenants: []*tenant{tn}}
+	other.enqueue(&RybbitEvent{SiteID: "1", Type: eventTypeCustom, EventName: "broken"})
+	other.enqueue(&RybbitEvent{SiteID: "1", Type: eventTypeCustom, EventName: "signup"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	feeder.drain(ctx, tn, tn.queue.shards[0], nil)
+
+	stats := feeder.Stats()
+	if stats.Sent != 2 || stats.SendErrors != 2 || stats.Quarantined != 1 || stats.QuarantinedShapes != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
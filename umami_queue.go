@@ -0,0 +1,225 @@
+package traefik_rybbit_feeder
+
+import (
+	"sync/atomic"
+)
+
+// Possible values of Config.QueueType.
+const (
+	queueTypeChannel = "channel"
+	queueTypeRing    = "ring"
+)
+
+// eventQueue holds the events waiting to be submitted to Rybbit.
+// It is split into shards, each consumed by its own worker, so enqueueing at high request rates
+// does not contend on a single channel.
+type eventQueue struct {
+	shards  []*queueShard
+	next    atomic.Uint32
+	dropped atomic.Uint64 // events the queue could not hold
+}
+
+// queueShard is a single queue consumed by one worker, backed by either a channel or a ring buffer.
+type queueShard struct {
+	// events is the channel of the default queue type, nil for ring buffers.
+	events chan *RybbitEvent
+
+	// ring is the buffer of the ring queue type, which overwrites the oldest event when full.
+	// ready receives a signal when events have been pushed to it.
+	ring  *ringBuffer
+	ready chan struct{}
+}
+
+// newEventQueue creates a queue holding up to size events, spread evenly over the given amount of shards.
+func newEventQueue(queueType string, size int, shards int) *eventQueue {
+	shardSize := (size + shards - 1) / shards
+
+	q := &eventQueue{shards: make([]*queueShard, shards)}
+	for i := range q.shards {
+		if queueType == queueTypeRing {
+			q.shards[i] = &queueShard{ring: newRingBuffer(shardSize), ready: make(chan struct{}, 1)}
+		} else {
+			q.shards[i] = &queueShard{events: make(chan *RybbitEvent, shardSize)}
+		}
+	}
+	return q
+}
+
+// push adds the event to the next shard in round-robin order, it returns false if that shard is full.
+func (q *eventQueue) push(event *RybbitEvent) bool {
+	shard := q.shards[0]
+	if len(q.shards) > 1 {
+		shard = q.shards[q.next.Add(1)%uint32(len(q.shards))]
+	}
+
+	return shard.push(event)
+}
+
+// len returns the amount of events waiting in all shards.
+func (q *eventQueue) len() int {
+	total := 0
+	for _, shard := range q.shards {
+		total += shard.len()
+	}
+	return total
+}
+
+// cap returns the amount of events all shards can hold.
+func (q *eventQueue) cap() int {
+	total := 0
+	for _, shard := range q.shards {
+		total += shard.cap()
+	}
+	return total
+}
+
+// moveTo moves the waiting events to dst, events dst cannot hold are dropped. It returns the amount of moved events.
+func (q *eventQueue) moveTo(dst *eventQueue) int {
+	moved := 0
+	for _, shard := range q.shards {
+		for event := shard.pop(); event != nil; event = shard.pop() {
+			if !dst.push(event) {
+				releaseEvent(event)
+				continue
+			}
+			moved++
+		}
+	}
+	return moved
+}
+
+// push adds the event to the shard. A full channel rejects the event, a full ring buffer drops its oldest one instead.
+func (s *queueShard) push(event *RybbitEvent) bool {
+	if s.ring == nil {
+		select {
+		case s.events <- event:
+			return true
+		default:
+			return false
+		}
+	}
+
+	for !s.ring.push(event) {
+		if oldest := s.ring.pop(); oldest != nil {
+			releaseEvent(oldest)
+		}
+	}
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// pop takes the next event out of the shard without blocking, it returns nil if the shard is empty.
+func (s *queueShard) pop() *RybbitEvent {
+	if s.ring != nil {
+		return s.ring.pop()
+	}
+
+	select {
+	case event := <-s.events:
+		return event
+	default:
+		return nil
+	}
+}
+
+func (s *queueShard) len() int {
+	if s.ring != nil {
+		return s.ring.len()
+	}
+	return len(s.events)
+}
+
+func (s *queueShard) cap() int {
+	if s.ring != nil {
+		return len(s.ring.cells)
+	}
+	return cap(s.events)
+}
+
+// ringBuffer is a fixed-size lock-free multi-producer multi-consumer queue,
+// see https://www.1024cores.net/home/lock-free-algorithms/queues/bounded-mpmc-queue.
+type ringBuffer struct {
+	cells   []ringCell
+	mask    uint64
+	enqueue atomic.Uint64
+	dequeue atomic.Uint64
+}
+
+type ringCell struct {
+	sequence atomic.Uint64
+	event    *RybbitEvent
+}
+
+// newRingBuffer creates a ring buffer for at least size events, rounded up to the next power of two.
+func newRingBuffer(size int) *ringBuffer {
+	capacity := 1
+	for capacity < size {
+		capacity <<= 1
+	}
+
+	r := &ringBuffer{cells: make([]ringCell, capacity), mask: uint64(capacity - 1)}
+	for i := range r.cells {
+		r.cells[i].sequence.Store(uint64(i))
+	}
+	return r
+}
+
+// push adds the event, it returns false if the buffer is full.
+func (r *ringBuffer) push(event *RybbitEvent) bool {
+	pos := r.enqueue.Load()
+	for {
+		cell := &r.cells[pos&r.mask]
+		diff := int64(cell.sequence.Load()) - int64(pos)
+
+		switch {
+		case diff == 0:
+			if r.enqueue.CompareAndSwap(pos, pos+1) {
+				cell.event = event
+				cell.sequence.Store(pos + 1)
+				return true
+			}
+			pos = r.enqueue.Load()
+		case diff < 0:
+			return false
+		default:
+			pos = r.enqueue.Load()
+		}
+	}
+}
+
+// pop takes the oldest event, it returns nil if the buffer is empty.
+func (r *ringBuffer) pop() *RybbitEvent {
+	pos := r.dequeue.Load()
+	for {
+		cell := &r.cells[pos&r.mask]
+		diff := int64(cell.sequence.Load()) - int64(pos+1)
+
+		switch {
+		case diff == 0:
+			if r.dequeue.CompareAndSwap(pos, pos+1) {
+				event := cell.event
+				cell.event = nil
+				cell.sequence.Store(pos + r.mask + 1)
+				return event
+			}
+			pos = r.dequeue.Load()
+		case diff < 0:
+			return nil
+		default:
+			pos = r.dequeue.Load()
+		}
+	}
+}
+
+// len returns the approximate amount of events in the buffer.
+func (r *ringBuffer) len() int {
+	n := int64(r.enqueue.Load()) - int64(r.dequeue.Load())
+	if n < 0 {
+		return 0
+	}
+	return int(n)
+}
@@ -0,0 +1,90 @@
+package traefik_rybbit_feeder
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestEventQueueShards(t *testing.T) {
+	q := newEventQueue(queueTypeChannel, 10, 3)
+
+	if len(q.shards) != 3 || cap(q.shards[0].events) != 4 {
+		t.Fatalf("expected 3 shards of 4 events, got %d shards of %d", len(q.shards), cap(q.shards[0].events))
+	}
+
+	for i := 0; i < 12; i++ {
+		if !q.push(&RybbitEvent{}) {
+			t.Fatalf("push %d failed", i)
+		}
+	}
+
+	if q.len() != 12 {
+		t.Fatalf("expected 12 events, got %d", q.len())
+	}
+	for _, shard := range q.shards {
+		if shard.len() != 4 {
+			t.Fatalf("expected events to be spread evenly, got %d in a shard", shard.len())
+		}
+	}
+
+	if q.push(&RybbitEvent{}) {
+		t.Fatal("expected push to a full queue to fail")
+	}
+}
+
+func TestEventQueueRingOverwritesOldest(t *testing.T) {
+	q := newEventQueue(queueTypeRing, 3, 1)
+	shard := q.shards[0]
+
+	if len(shard.ring.cells) != 4 {
+		t.Fatalf("expected capacity to be rounded up to 4, got %d", len(shard.ring.cells))
+	}
+
+	for _, path := range []string{"/1", "/2", "/3", "/4", "/5", "/6"} {
+		if !q.push(&RybbitEvent{Pathname: path}) {
+			t.Fatalf("push %s failed", path)
+		}
+	}
+
+	select {
+	case <-shard.ready:
+	default:
+		t.Fatal("expected the shard to signal readiness")
+	}
+
+	for _, expected := range []string{"/3", "/4", "/5", "/6"} {
+		event := shard.pop()
+		if event == nil || event.Pathname != expected {
+			t.Fatalf("expected %s, got %+v", expected, event)
+		}
+	}
+
+	if event := shard.pop(); event != nil {
+		t.Fatalf("expected an empty buffer, got %+v", event)
+	}
+}
+
+func TestRingBufferConcurrent(t *testing.T) {
+	r := newRingBuffer(1024)
+
+	var wg sync.WaitGroup
+	for p := 0; p < 4; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 256; i++ {
+				for !r.push(&RybbitEvent{}) {
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	popped := 0
+	for r.pop() != nil {
+		popped++
+	}
+	if popped != 1024 {
+		t.Fatalf("expected 1024 events, got %d", popped)
+	}
+}
@@ -0,0 +1,61 @@
+package traefik_rybbit_feeder
+
+import (
+	"time"
+)
+
+// rollupEventName is the name of the custom events emitted in rollup mode.
+const rollupEventName = "rollup"
+
+// maxRollupKeys bounds the distinct paths counted per interval, further paths are counted as rollupOtherPath.
+const (
+	maxRollupKeys   = 10_000
+	rollupOtherPath = "/(other)"
+)
+
+type rollupKey struct {
+	siteID   string
+	hostname string
+	path     string
+	status   int
+}
+
+// newRollup returns the counter of requests per site, path and status between two emissions.
+func newRollup(interval time.Duration) *intervalCounter {
+	return newIntervalCounter(interval, maxRollupKeys, func(key any, full bool) any {
+		if full {
+			rollup := key.(rollupKey)
+			rollup.path = rollupOtherPath
+			return rollup
+		}
+		return key
+	})
+}
+
+// flushRollup enqueues one custom event with `path`, `status`, `count` and `interval_s` properties per counted key.
+func (h *UmamiFeeder) flushRollup() {
+	counts := h.rollup.take()
+	if len(counts) == 0 {
+		return
+	}
+	h.debug("emitting %d rollup events", len(counts))
+
+	for key, counted := range counts {
+		rollup := key.(rollupKey)
+		event := acquireEvent()
+		*event = RybbitEvent{
+			SiteID:    rollup.siteID,
+			Type:      eventTypeCustom,
+			Pathname:  rollup.path,
+			Hostname:  rollup.hostname,
+			EventName: rollupEventName,
+			Properties: h.encodeProperties(map[string]any{
+				"path":       rollup.path,
+				"status":     rollup.status,
+				"count":      counted.count,
+				"interval_s": int(h.rollup.interval.Seconds()),
+			}),
+		}
+		h.enqueue(event)
+	}
+}
@@ -0,0 +1,62 @@
+package traefik_rybbit_feeder
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRollup(t *testing.T) {
+	feeder := &UmamiFeeder{
+		websites:       map[string]string{"localhost": "1"},
+		queue:          newEventQueue(queueTypeChannel, 10, 1),
+		rollupInterval: time.Minute,
+		rollup:         newRollup(time.Minute),
+	}
+
+	for _, status := range []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusNotModified} {
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/page", nil)
+		feeder.submitToFeed(req, responseInfo{status: status})
+	}
+	if feeder.queue.len() != 0 {
+		t.Fatalf("expected no events before the interval, got %d", feeder.queue.len())
+	}
+
+	feeder.flushRollup()
+	if feeder.queue.len() != 2 {
+		t.Fatalf("expected 2 rollup events, got %d", feeder.queue.len())
+	}
+
+	expected := map[string]bool{
+		`{"count":3,"interval_s":60,"path":"/page","status":200}`: true,
+		`{"count":1,"interval_s":60,"path":"/page","status":304}`: true,
+	}
+	for i := 0; i < 2; i++ {
+		event := feeder.queue.shards[0].pop()
+		if event.EventName != rollupEventName || event.Type != eventTypeCustom || !expected[event.Properties] {
+			t.Fatalf("unexpected event %q %s", event.EventName, event.Properties)
+		}
+	}
+
+	feeder.flushRollup()
+	if feeder.queue.len() != 0 {
+		t.Fatalf("expected counts to be reset, got %d events", feeder.queue.len())
+	}
+}
+
+func TestRollupBoundsKeys(t *testing.T) {
+	r := newRollup(time.Minute)
+	for i := 0; i < maxRollupKeys+5; i++ {
+		r.add(rollupKey{siteID: "1", path: "/" + strconv.Itoa(i)}, 1)
+	}
+
+	counts := r.take()
+	if len(counts) != maxRollupKeys+1 {
+		t.Fatalf("expected %d keys, got %d", maxRollupKeys+1, len(counts))
+	}
+	if other := counts[rollupKey{siteID: "1", path: rollupOtherPath}]; other == nil || other.count != 5 {
+		t.Fatalf("expected 5 requests counted as other, got %+v", other)
+	}
+}
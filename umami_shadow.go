@@ -0,0 +1,75 @@
+package traefik_rybbit_feeder
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// shadowReportInterval is how often the differences of the shadow filter are logged.
+const shadowReportInterval = time.Minute
+
+// shadowStats counts the events the shadow filter would add or remove since the last report.
+type shadowStats struct {
+	added   atomic.Uint64
+	removed atomic.Uint64
+}
+
+// compareShadow evaluates the shadow filter for a request passing all filters but those of the location, and counts
+// whether it would add or remove the event compared to track, the decision of the active filters.
+func (h *UmamiFeeder) compareShadow(host string, requestURL string, track bool) {
+	shadow := h.filterURL(*h.shadowFilter, requestURL) == ""
+	if shadow == track {
+		return
+	}
+
+	if track {
+		h.shadowStats.removed.Add(1)
+		h.debug("shadow filter would ignore %s%s", host, requestURL)
+		return
+	}
+
+	// The active filters may have ignored the request for its host rather than its location.
+	hostname := parseDomainFromHost(host)
+	if h.filterURL(h.activeFilter(hostname), requestURL) == "" || h.isPaused(hostname) || !h.isWebsite(hostname) {
+		return
+	}
+	h.shadowStats.added.Add(1)
+	h.debug("shadow filter would track %s%s", host, requestURL)
+}
+
+// compareShadowStatus counts whether the shadow filter would add or remove the event of a tracked request with
+// an error status, due to its trackClientErrors and trackServerErrors settings. Errors of requests ignored by the
+// active filters are not known, compareShadow counts them regardless of their status.
+func (h *UmamiFeeder) compareShadowStatus(req *http.Request, statusCode int, track bool) {
+	if statusCode < 400 || h.shadowFilter.tracksError(statusCode) == track || h.filterURL(*h.shadowFilter, h.filteredURL(req)) != "" {
+		return
+	}
+
+	if track {
+		h.shadowStats.removed.Add(1)
+		h.debug("shadow filter would ignore %d error for %s%s", statusCode, req.Host, req.URL.Path)
+		return
+	}
+	h.shadowStats.added.Add(1)
+	h.debug("shadow filter would track %d error for %s%s", statusCode, req.Host, req.URL.Path)
+}
+
+// reportShadow logs the events the shadow filter would have added and removed every shadowReportInterval,
+// until ctx is canceled.
+func (h *UmamiFeeder) reportShadow(ctx context.Context) {
+	ticker := time.NewTicker(shadowReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.info(fmt.Sprintf("shadow filter would have added %d and removed %d events in the last %v",
+				h.shadowStats.added.Swap(0), h.shadowStats.removed.Swap(0), shadowReportInterval))
+		}
+	}
+}
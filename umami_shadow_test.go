@@ -0,0 +1,36 @@
+package traefik_rybbit_feeder
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestShadowFilter(t *testing.T) {
+	trackErrors := true
+	feeder := &UmamiFeeder{websites: map[string]string{"example.com": "1"}}
+	feeder.ignoreRegexp, _ = compileAlternation([]string{"^/old"})
+	err := feeder.setupWebsiteFilters(&Config{
+		ShadowFilter: &WebsiteFilter{IgnoreURLs: []string{"^/admin"}, TrackErrors: &trackErrors},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/", "/admin", "/old", "/admin"} {
+		if track := feeder.shouldTrack(newServerRequest("example.com", path)); track != (path != "/old") {
+			t.Errorf("%s: expected the active filters to be applied, got %v", path, track)
+		}
+	}
+
+	// Requests of unknown hostnames are ignored by both.
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://other.com/old", nil)
+	feeder.shouldTrack(req)
+
+	req, _ = http.NewRequestWithContext(context.Background(), http.MethodGet, "http://example.com/missing", nil)
+	feeder.compareShadowStatus(req, http.StatusNotFound, feeder.shouldTrackStatus(req.Host, http.StatusNotFound))
+
+	if added, removed := feeder.shadowStats.added.Load(), feeder.shadowStats.removed.Load(); added != 2 || removed != 2 {
+		t.Fatalf("expected 2 added and 2 removed events, got %d added and %d removed", added, removed)
+	}
+}
@@ -0,0 +1,49 @@
+package traefik_rybbit_feeder
+
+import (
+	"sync"
+)
+
+// singleflight deduplicates concurrent calls with the same key, so only one of them hits Rybbit
+// and all callers share its result. Adapted from golang.org/x/sync/singleflight.
+type singleflight struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg    sync.WaitGroup
+	value any
+	err   error
+}
+
+// rybbitFlights is shared by all plugin instances, which are commonly configured for the same Rybbit host.
+var rybbitFlights = &singleflight{}
+
+// do calls fn, unless a call with the same key is already in flight, in which case its result is awaited and returned.
+func (g *singleflight) do(key string, fn func() (any, error)) (any, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*flightCall{}
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call.value, call.err
+	}
+
+	call := &flightCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		call.wg.Done()
+	}()
+
+	call.value, call.err = fn()
+	return call.value, call.err
+}
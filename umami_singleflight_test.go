@@ -0,0 +1,48 @@
+package traefik_rybbit_feeder
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSingleflightDeduplicates(t *testing.T) {
+	group := &singleflight{}
+	var calls atomic.Int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := group.do("health", func() (any, error) {
+				calls.Add(1)
+				<-release
+				return "ok", nil
+			})
+			if err != nil || value != "ok" {
+				t.Errorf("unexpected result %v, %v", value, err)
+			}
+		}()
+	}
+
+	// Give all callers the chance to join the flight.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Fatalf("expected 1 call, got %d", calls.Load())
+	}
+
+	// Finished flights are forgotten.
+	_, _ = group.do("health", func() (any, error) {
+		calls.Add(1)
+		return nil, nil
+	})
+	if calls.Load() != 2 {
+		t.Fatalf("expected 2 calls, got %d", calls.Load())
+	}
+}
@@ -0,0 +1,128 @@
+package traefik_rybbit_feeder
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errorSpikeEventName is the name of the custom events emitted on a spike of 5xx responses.
+const errorSpikeEventName = "error_spike"
+
+// maxSpikePaths bounds the distinct paths counted per site and window, further paths are counted as rollupOtherPath.
+// topSpikePaths is the amount of paths reported with a spike.
+const (
+	maxSpikePaths = 100
+	topSpikePaths = 5
+)
+
+// errorSpikes detects spikes of 5xx responses per site: errorSpikeThreshold errors within errorSpikeWindow.
+type errorSpikes struct {
+	mutex     sync.Mutex
+	threshold int
+	window    time.Duration
+	sites     map[string]*siteErrors
+}
+
+// siteErrors counts the 5xx responses of a site in the current window.
+type siteErrors struct {
+	started  time.Time
+	count    int
+	paths    map[string]int
+	reported bool // a spike was emitted for the window already
+}
+
+// errorSpike is a detected spike, with the count of errors in the window and the paths with most errors,
+// formatted as `path (count)`.
+type errorSpike struct {
+	count    int
+	topPath  string
+	topPaths []string
+}
+
+func newErrorSpikes(threshold int, window time.Duration) *errorSpikes {
+	return &errorSpikes{threshold: threshold, window: window, sites: map[string]*siteErrors{}}
+}
+
+// add counts an error for path of siteID, and returns the spike once the threshold is reached within a window.
+// A spike is returned only once per window.
+func (s *errorSpikes) add(siteID string, path string, now time.Time) (errorSpike, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	site, ok := s.sites[siteID]
+	if !ok || now.Sub(site.started) >= s.window {
+		site = &siteErrors{started: now, paths: map[string]int{}}
+		s.sites[siteID] = site
+	}
+
+	if _, ok := site.paths[path]; !ok {
+		if len(site.paths) >= maxSpikePaths {
+			path = rollupOtherPath
+		} else {
+			// The path outlives the request.
+			path = strings.Clone(path)
+		}
+	}
+	site.paths[path]++
+	site.count++
+
+	if site.reported || site.count < s.threshold {
+		return errorSpike{}, false
+	}
+	site.reported = true
+
+	paths := make([]string, 0, len(site.paths))
+	for path := range site.paths {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if site.paths[paths[i]] != site.paths[paths[j]] {
+			return site.paths[paths[i]] > site.paths[paths[j]]
+		}
+		return paths[i] < paths[j]
+	})
+	if len(paths) > topSpikePaths {
+		paths = paths[:topSpikePaths]
+	}
+
+	spike := errorSpike{count: site.count, topPath: paths[0], topPaths: make([]string, len(paths))}
+	for i, path := range paths {
+		spike.topPaths[i] = fmt.Sprintf("%s (%d)", path, site.paths[path])
+	}
+	return spike, true
+}
+
+// recordError counts a 5xx response, and enqueues an error_spike custom event with `count`, `window_s` and
+// `top_paths` properties once it completes a spike.
+func (h *UmamiFeeder) recordError(req *http.Request) {
+	hostname := parseDomainFromHost(req.Host)
+	websiteId, ok := h.lookupWebsite(hostname)
+	if !ok {
+		return
+	}
+
+	spike, ok := h.errorSpikes.add(websiteId, h.reportedPath(req.URL.Path), time.Now())
+	if !ok {
+		return
+	}
+	h.debug("5xx spike of %d errors on %s", spike.count, hostname)
+
+	event := acquireEvent()
+	*event = RybbitEvent{
+		SiteID:    websiteId,
+		Type:      eventTypeCustom,
+		Pathname:  strings.Clone(spike.topPath),
+		Hostname:  strings.Clone(hostname),
+		EventName: errorSpikeEventName,
+		Properties: h.encodeProperties(map[string]any{
+			"count":     spike.count,
+			"window_s":  int(h.errorSpikes.window.Seconds()),
+			"top_paths": strings.Join(spike.topPaths, ", "),
+		}),
+	}
+	h.enqueue(event)
+}
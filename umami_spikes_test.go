@@ -0,0 +1,59 @@
+package traefik_rybbit_feeder
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestErrorSpikes(t *testing.T) {
+	spikes := newErrorSpikes(3, time.Minute)
+	start := time.Now()
+
+	for i, path := range []string{"/a", "/b"} {
+		if _, ok := spikes.add("1", path, start.Add(time.Duration(i)*time.Second)); ok {
+			t.Fatal("expected no spike below the threshold")
+		}
+	}
+	if _, ok := spikes.add("2", "/a", start); ok {
+		t.Fatal("expected errors to be counted per site")
+	}
+
+	spike, ok := spikes.add("1", "/b", start.Add(2*time.Second))
+	if !ok || spike.count != 3 || spike.topPath != "/b" || len(spike.topPaths) != 2 || spike.topPaths[0] != "/b (2)" {
+		t.Fatalf("expected a spike with /b on top, got %v %+v", ok, spike)
+	}
+	if _, ok := spikes.add("1", "/b", start.Add(3*time.Second)); ok {
+		t.Fatal("expected a single spike per window")
+	}
+
+	// Errors of a previous window do not count.
+	for i := 0; i < 2; i++ {
+		if _, ok := spikes.add("1", "/c", start.Add(time.Minute+time.Duration(i)*time.Second)); ok {
+			t.Fatal("expected the count to be reset in a new window")
+		}
+	}
+}
+
+func TestRecordErrorEmitsSpike(t *testing.T) {
+	feeder := &UmamiFeeder{
+		websites:    map[string]string{"localhost": "1"},
+		queue:       newEventQueue(queueTypeChannel, 10, 1),
+		errorSpikes: newErrorSpikes(2, time.Minute),
+	}
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/checkout", nil)
+		feeder.recordError(req)
+	}
+
+	if feeder.queue.len() != 1 {
+		t.Fatalf("expected a single spike event, got %d", feeder.queue.len())
+	}
+	event := feeder.queue.shards[0].pop()
+	if event.EventName != errorSpikeEventName || event.Pathname != "/checkout" ||
+		event.Properties != `{"count":2,"top_paths":"/checkout (2)","window_s":60}` {
+		t.Fatalf("unexpected event %q %s %s", event.EventName, event.Pathname, event.Properties)
+	}
+}
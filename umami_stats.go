@@ -0,0 +1,127 @@
+package traefik_rybbit_feeder
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// healthEventName is the name of the custom events reporting the health of the plugin.
+const healthEventName = "feeder_health"
+
+// tenantStats counts what happened to the events of a tenant since it was created, by the workers of the tenant.
+// Events dropped as the queue was full are counted by the queue.
+type tenantStats struct {
+	sent        atomic.Uint64
+	dropped     atomic.Uint64 // lost with a failed request, or while shutting down
+	sendErrors  atomic.Uint64
+	quarantined atomic.Uint64 // dropped as their shape is quarantined
+}
+
+// Stats is a snapshot of the state and counters of a plugin instance. Counters are totals of the tenants of the
+// instance since they were created, including the events of other instances sharing them.
+type Stats struct {
+	// Enabled is false while the plugin is not connected to Rybbit or disabled by a configuration error.
+	Enabled bool `json:"enabled"`
+	// Failure is the error disabling the plugin, if any.
+	Failure string `json:"failure,omitempty"`
+	// Sent is the amount of events submitted to Rybbit.
+	Sent uint64 `json:"sent"`
+	// Dropped is the amount of events lost, as the queue was full or their submission failed.
+	Dropped uint64 `json:"dropped"`
+	// SendErrors is the amount of failed submissions to Rybbit.
+	SendErrors uint64 `json:"sendErrors"`
+	// Quarantined is the amount of events dropped as Rybbit rejected events of the same shape repeatedly,
+	// QuarantinedShapes the amount of shapes currently quarantined.
+	Quarantined       uint64 `json:"quarantined"`
+	QuarantinedShapes int    `json:"quarantinedShapes"`
+	// QueueDepth is the amount of events waiting in the queues of all tenants.
+	QueueDepth int `json:"queueDepth"`
+	// QueueCapacity is the amount of events the queues of all tenants can hold.
+	QueueCapacity int `json:"queueCapacity"`
+	// SampleRate is the current load shedding rate, 1 in SampleRate events are kept.
+	SampleRate uint32 `json:"sampleRate"`
+}
+
+// Stats returns a snapshot of the state and counters of the plugin. It is safe for concurrent use, every value
+// is read atomically.
+func (h *UmamiFeeder) Stats() Stats {
+	failure, _ := h.failure.Load().(string)
+	stats := Stats{
+		Enabled:    !h.isDisabled.Load(),
+		Failure:    failure,
+		SampleRate: h.sampleRate.Load(),
+	}
+	// Without a top-level host, the queue of the websites without a tenant is not one of a tenant.
+	if len(h.tenants) == 0 || h.queue != h.tenants[0].queue {
+		stats.Dropped += h.queue.dropped.Load()
+	}
+
+	seen := make(map[*tenant]bool, len(h.tenants))
+	for _, t := range h.tenants {
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+
+		stats.Sent += t.stats.sent.Load()
+		stats.Dropped += t.stats.dropped.Load() + t.queue.dropped.Load()
+		stats.SendErrors += t.stats.sendErrors.Load()
+		stats.Quarantined += t.stats.quarantined.Load()
+		stats.QueueDepth += t.queue.len()
+		stats.QueueCapacity += t.queue.cap()
+		if t.quarantine != nil {
+			stats.QuarantinedShapes += int(t.quarantine.size.Load())
+		}
+	}
+	return stats
+}
+
+// queueFill returns the fill level of the fullest tenant queue, between 0 and 1.
+func (h *UmamiFeeder) queueFill() float64 {
+	fill := 0.0
+	for _, t := range h.tenants {
+		fill = math.Max(fill, float64(t.queue.len())/float64(t.queue.cap()))
+	}
+	return fill
+}
+
+// emitHealth reports the health of the plugin to metaSiteID every metaInterval, until ctx is canceled.
+func (h *UmamiFeeder) emitHealth(ctx context.Context) {
+	ticker := time.NewTicker(h.metaInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.enqueue(h.healthEvent())
+		}
+	}
+}
+
+// healthEvent returns a custom event with the stats since the previous one.
+// It is submitted through the top-level host.
+func (h *UmamiFeeder) healthEvent() *RybbitEvent {
+	stats, reported := h.Stats(), h.reported
+	h.reported = stats
+
+	event := acquireEvent()
+	*event = RybbitEvent{
+		SiteID:    h.metaSiteID,
+		Type:      eventTypeCustom,
+		Pathname:  "/",
+		EventName: healthEventName,
+		Properties: h.encodeProperties(map[string]any{
+			"instance":       h.name,
+			"sent":           stats.Sent - reported.Sent,
+			"dropped":        stats.Dropped - reported.Dropped,
+			"send_errors":    stats.SendErrors - reported.SendErrors,
+			"queue_fill_pct": int(h.queueFill() * 100),
+			"sample_rate":    stats.SampleRate,
+		}),
+	}
+	return event
+}
@@ -0,0 +1,62 @@
+package traefik_rybbit_feeder
+
+import (
+	"testing"
+)
+
+func TestHealthEvent(t *testing.T) {
+	queue := newEventQueue(queueTypeChannel, 2, 1)
+	feeder := &UmamiFeeder{
+		name:       "rybbit",
+		queue:      queue,
+		tenants:    []*tenant{{queue: queue}},
+		metaSiteID: "meta",
+	}
+	feeder.sampleRate.Store(1)
+
+	for i := 0; i < 3; i++ {
+		feeder.enqueue(&RybbitEvent{SiteID: "1"})
+	}
+	feeder.tenants[0].stats.sent.Add(5)
+	feeder.tenants[0].stats.sendErrors.Add(1)
+
+	event := feeder.healthEvent()
+	expected := `{"dropped":1,"instance":"rybbit","queue_fill_pct":100,"sample_rate":1,"send_errors":1,"sent":5}`
+	if event.SiteID != "meta" || event.EventName != healthEventName || event.Properties != expected {
+		t.Fatalf("unexpected event %s %q %s", event.SiteID, event.EventName, event.Properties)
+	}
+
+	if event = feeder.healthEvent(); event.Properties != `{"dropped":0,"instance":"rybbit","queue_fill_pct":100,"sample_rate":1,"send_errors":0,"sent":0}` {
+		t.Fatalf("expected stats to be reset, got %s", event.Properties)
+	}
+}
+
+func TestStats(t *testing.T) {
+	queue := newEventQueue(queueTypeChannel, 4, 1)
+	tn := &tenant{queue: queue}
+	feeder := &UmamiFeeder{queue: queue, tenants: []*tenant{tn, tn}}
+	feeder.sampleRate.Store(2)
+	feeder.failure.Store("invalid configuration")
+	feeder.isDisabled.Store(true)
+
+	feeder.enqueue(&RybbitEvent{SiteID: "1"})
+	tn.stats.sent.Add(3)
+	tn.stats.dropped.Add(2)
+
+	expected := Stats{Failure: "invalid configuration", Sent: 3, Dropped: 2, QueueDepth: 1, QueueCapacity: 4, SampleRate: 2}
+	if stats := feeder.Stats(); stats != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+
+	// Health reports do not reset the totals.
+	feeder.healthEvent()
+	if stats := feeder.Stats(); stats.Sent != 3 || stats.Dropped != 2 {
+		t.Fatalf("expected totals to be kept, got %+v", stats)
+	}
+
+	// The counters of a shared tenant include the events submitted by the workers of any instance.
+	other := &UmamiFeeder{queue: queue, tenants: []*tenant{tn}}
+	if stats := other.Stats(); stats.Sent != 3 || stats.Dropped != 2 {
+		t.Fatalf("expected the counters of the shared tenant, got %+v", stats)
+	}
+}
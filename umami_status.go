@@ -0,0 +1,63 @@
+package traefik_rybbit_feeder
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// statusRange is an inclusive range of response status codes.
+type statusRange struct {
+	min int
+	max int
+}
+
+// parseStatusRanges parses the entries of the setting name: a status code `200`, a range `301-308`, or a bound
+// `>=500` or `<=299`.
+func parseStatusRanges(name string, entries []string) ([]statusRange, error) {
+	var ranges []statusRange
+	for _, entry := range entries {
+		statusRange, ok := parseStatusRange(strings.TrimSpace(entry))
+		if !ok {
+			return nil, fmt.Errorf("invalid %s entry %s, expected a status code, a range like 301-308 or a bound like >=500", name, entry)
+		}
+		ranges = append(ranges, statusRange)
+	}
+	return ranges, nil
+}
+
+func parseStatusRange(entry string) (statusRange, bool) {
+	var r statusRange
+	var err error
+	switch {
+	case strings.HasPrefix(entry, ">="):
+		r.min, err = strconv.Atoi(entry[2:])
+		r.max = 599
+	case strings.HasPrefix(entry, "<="):
+		r.min = 100
+		r.max, err = strconv.Atoi(entry[2:])
+	case strings.Contains(entry, "-"):
+		from, to, _ := strings.Cut(entry, "-")
+		if r.min, err = strconv.Atoi(from); err == nil {
+			r.max, err = strconv.Atoi(to)
+		}
+	default:
+		r.min, err = strconv.Atoi(entry)
+		r.max = r.min
+	}
+
+	if err != nil || r.min < 100 || r.max > 599 || r.min > r.max {
+		return statusRange{}, false
+	}
+	return r, true
+}
+
+// matchStatus reports whether statusCode is within any of the ranges.
+func matchStatus(ranges []statusRange, statusCode int) bool {
+	for _, r := range ranges {
+		if statusCode >= r.min && statusCode <= r.max {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package traefik_rybbit_feeder
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseStatusRanges(t *testing.T) {
+	ranges, err := parseStatusRanges("trackStatusCodes", []string{"200", "301-308", ">=500", "<=101"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for status, expected := range map[int]bool{100: true, 102: false, 200: true, 204: false, 302: true, 404: false, 503: true} {
+		if matchStatus(ranges, status) != expected {
+			t.Errorf("%d: expected %v", status, expected)
+		}
+	}
+
+	for _, entry := range []string{"", "abc", "99", "308-301", ">=600", "2xx"} {
+		if _, err := parseStatusRanges("trackStatusCodes", []string{entry}); err == nil {
+			t.Errorf("expected an error for %q", entry)
+		}
+	}
+}
+
+func TestShouldTrackStatusCodes(t *testing.T) {
+	feeder := &UmamiFeeder{}
+	err := feeder.verifyConfig(&Config{
+		TrackStatusCodes:  []string{"200-299", ">=500"},
+		IgnoreStatusCodes: []string{"204", "503"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for status, expected := range map[int]bool{
+		http.StatusOK:                  true,
+		http.StatusNoContent:           false,
+		http.StatusFound:               false,
+		http.StatusNotFound:            false,
+		http.StatusInternalServerError: true,
+		http.StatusServiceUnavailable:  false,
+	} {
+		if track := feeder.shouldTrackStatus("localhost", status); track != expected {
+			t.Errorf("%d: expected %v, got %v", status, expected, track)
+		}
+	}
+}
+
+func TestShouldTrackStatusIgnoreRedirects(t *testing.T) {
+	feeder := &UmamiFeeder{ignoreRedirects: true}
+	for status, expected := range map[int]bool{
+		http.StatusOK:                true,
+		http.StatusMovedPermanently:  false,
+		http.StatusFound:             false,
+		http.StatusNotModified:       true,
+		http.StatusPermanentRedirect: false,
+	} {
+		if track := feeder.shouldTrackStatus("localhost", status); track != expected {
+			t.Errorf("%d: expected %v, got %v", status, expected, track)
+		}
+	}
+}
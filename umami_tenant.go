@@ -0,0 +1,313 @@
+package traefik_rybbit_feeder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tenant is a Rybbit instance with its own API key, receiving the events of its websites.
+type Tenant struct {
+	// Host is the URL of the Rybbit instance of the tenant.
+	Host string `json:"host"`
+	// APIKey is the API Key of the tenant's Rybbit instance.
+	APIKey string `json:"apiKey"`
+	// Websites is a map of domain to site-id of the tenant.
+	Websites map[string]string `json:"websites"`
+}
+
+// tenant is a Rybbit instance events are submitted to. Every tenant has its own queue and workers,
+// so a slow or failing instance does not hold back the events of the others.
+// Tenants are shared by all plugin instances submitting to the same instance with the same API key and worker
+// settings, so e.g. one middleware per router does not start a queue and workers per router. The workers only use
+// the settings of the tenant, they apply whichever instance started them.
+type tenant struct {
+	host   string
+	apiKey string
+	queue  *eventQueue
+
+	client       *http.Client
+	minWorkers   int
+	maxWorkers   int
+	batchSize    int
+	batchMaxWait time.Duration
+	quarantine   *quarantine // nil unless QuarantineThreshold is set, shared by all instances submitting to the tenant
+
+	stats         tenantStats
+	batchAccepted atomic.Bool  // the instance accepted a batch request, so it understands the array format
+	batchRetry    atomic.Int64 // unix nanoseconds until which events are sent one by one, once a batch was refused
+
+	// guarded by sharedTenantsMutex
+	key    string
+	refs   int                // plugin instances using the tenant
+	cancel context.CancelFunc // stops the workers, set once they are started
+}
+
+// sharedTenants are the tenants in use by any plugin instance, by their key.
+var (
+	sharedTenants      = map[string]*tenant{}
+	sharedTenantsMutex sync.Mutex
+)
+
+// acquireTenant returns the shared tenant for host and apiKey, creating it if no plugin instance with the same
+// worker settings uses it yet. The tenant is released once ctx is canceled.
+func acquireTenant(ctx context.Context, config *Config, host string, apiKey string) *tenant {
+	key := tenantKey(config, host, apiKey)
+
+	sharedTenantsMutex.Lock()
+	defer sharedTenantsMutex.Unlock()
+
+	t, ok := sharedTenants[key]
+	if !ok {
+		t = &tenant{
+			host:   host,
+			apiKey: apiKey,
+			queue:  newEventQueue(config.QueueType, config.QueueSize, config.QueueShards),
+
+			client:       newHTTPClient(config),
+			minWorkers:   config.MinWorkers,
+			maxWorkers:   config.MaxWorkers,
+			batchSize:    config.BatchSize,
+			batchMaxWait: config.BatchMaxWait,
+
+			key: key,
+		}
+		if config.QuarantineThreshold > 0 {
+			t.quarantine = newQuarantine(config.QuarantineThreshold, config.QuarantineDuration)
+		}
+		sharedTenants[key] = t
+	}
+	t.refs++
+
+	if done := ctx.Done(); done != nil {
+		go func() {
+			<-done
+			releaseTenant(t)
+		}()
+	}
+
+	return t
+}
+
+// tenantKey identifies the shared tenant of host and apiKey by every setting the tenant's workers depend on,
+// so instances configured differently, e.g. after a reload, do not submit with the settings of another.
+func tenantKey(config *Config, host string, apiKey string) string {
+	return fmt.Sprintf("%s|%s|%s|%d|%d|%d|%d|%d|%v|%d|%d|%v|%v|%v|%d|%v",
+		host, apiKey, config.QueueType, config.QueueSize, config.QueueShards,
+		config.MinWorkers, config.MaxWorkers, config.BatchSize, config.BatchMaxWait,
+		config.MaxIdleConns, config.MaxConnsPerHost, config.IdleConnTimeout, config.DisableHTTP2, config.Debug,
+		config.QuarantineThreshold, config.QuarantineDuration)
+}
+
+// releaseTenant stops the workers of the tenant once no plugin instance uses it anymore.
+// If the configuration was reloaded with different queue settings, the waiting events are handed off to the
+// tenant of the same instance and API key. The workers submit the remaining events before exiting.
+func releaseTenant(t *tenant) {
+	sharedTenantsMutex.Lock()
+	defer sharedTenantsMutex.Unlock()
+
+	t.refs--
+	if t.refs > 0 {
+		return
+	}
+
+	delete(sharedTenants, t.key)
+	for _, next := range sharedTenants {
+		if next.host == t.host && next.apiKey == t.apiKey {
+			t.queue.moveTo(next.queue)
+			break
+		}
+	}
+	if t.cancel != nil {
+		t.cancel()
+	}
+}
+
+// startWorkers starts the workers of the tenant, unless a plugin instance sharing it already did.
+// They run with the settings of this instance until the tenant is released.
+func (h *UmamiFeeder) startWorkers(t *tenant) {
+	sharedTenantsMutex.Lock()
+	defer sharedTenantsMutex.Unlock()
+
+	if t.cancel != nil || t.refs == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.cancel = cancel
+	for _, shard := range t.queue.shards {
+		go h.superviseWorkers(ctx, t, shard, scaleInterval)
+	}
+}
+
+// setupTenants registers the websites of the configured tenants, next to the top-level websites.
+// Their hostnames are normalized like those of requests, e.g. an internationalized domain name may be
+// configured in either form.
+func (h *UmamiFeeder) setupTenants(ctx context.Context, config *Config) error {
+	h.websites = make(map[string]string, len(config.Websites))
+	for hostname, websiteId := range config.Websites {
+		h.websites[websiteHostname(hostname)] = websiteId
+	}
+
+	if config.Host == "" && len(config.Tenants) > 0 && len(config.Websites) > 0 {
+		return fmt.Errorf("`websites` require `host` to be set, or to be configured within a tenant")
+	}
+
+	// Validate all tenants first, shared tenants are only acquired for a valid configuration.
+	for i, tenantConfig := range config.Tenants {
+		if tenantConfig.Host == "" || tenantConfig.APIKey == "" || len(tenantConfig.Websites) == 0 {
+			return fmt.Errorf("tenant #%d requires host, apiKey and websites", i+1)
+		}
+
+		for hostname, websiteId := range tenantConfig.Websites {
+			hostname = websiteHostname(hostname)
+			if _, ok := h.websites[hostname]; ok {
+				return fmt.Errorf("website %s is configured more than once", hostname)
+			}
+			h.websites[hostname] = websiteId
+		}
+	}
+
+	for hostname := range h.websites {
+		if isWebsitePattern(hostname) {
+			pattern, err := regexp.Compile(hostname)
+			if err != nil {
+				return fmt.Errorf("invalid website pattern %s: %w", hostname, err)
+			}
+			h.websitePatterns = append(h.websitePatterns, pattern)
+			continue
+		}
+
+		if !strings.Contains(hostname, "*") {
+			continue
+		}
+		if !strings.HasPrefix(hostname, "*.") || strings.Count(hostname, "*") > 1 {
+			return fmt.Errorf("invalid website %s, a wildcard is only supported as the first label, e.g. *.example.com", hostname)
+		}
+		h.hasWildcards = true
+	}
+	// Patterns are tried in a stable order.
+	sort.Slice(h.websitePatterns, func(i, j int) bool {
+		return h.websitePatterns[i].String() < h.websitePatterns[j].String()
+	})
+
+	if config.Host != "" {
+		t := acquireTenant(ctx, config, config.Host, config.APIKey)
+		h.tenants = append(h.tenants, t)
+		h.queue = t.queue
+	} else {
+		// All websites belong to tenants, nothing is submitted from this queue.
+		h.queue = newEventQueue(config.QueueType, config.QueueSize, config.QueueShards)
+	}
+
+	for _, tenantConfig := range config.Tenants {
+		t := acquireTenant(ctx, config, tenantConfig.Host, tenantConfig.APIKey)
+		h.tenants = append(h.tenants, t)
+
+		for hostname := range tenantConfig.Websites {
+			h.websiteTenants[websiteHostname(hostname)] = t
+		}
+	}
+
+	return nil
+}
+
+// queueFor returns the queue of the tenant the website hostname belongs to.
+func (h *UmamiFeeder) queueFor(hostname string) *eventQueue {
+	h.websitesMutex.RLock()
+	defer h.websitesMutex.RUnlock()
+
+	if t, ok := h.websiteTenants[h.websiteKey(hostname)]; ok {
+		return t.queue
+	}
+	return h.queue
+}
+
+// websiteKey returns the websites entry matching hostname: the hostname itself, or else the most specific
+// wildcard entry, e.g. `*.app.example.com` before `*.example.com`, or else the first matching pattern.
+// A wildcard does not match the domain itself. The caller must hold websitesMutex.
+func (h *UmamiFeeder) websiteKey(hostname string) string {
+	if _, ok := h.websites[hostname]; ok {
+		return hostname
+	}
+
+	if h.hasWildcards {
+		for domain := hostname; strings.Contains(domain, "."); {
+			domain = domain[strings.IndexByte(domain, '.')+1:]
+			if _, ok := h.websites["*."+domain]; ok {
+				return "*." + domain
+			}
+		}
+	}
+
+	for _, pattern := range h.websitePatterns {
+		if pattern.MatchString(hostname) {
+			return pattern.String()
+		}
+	}
+	return hostname
+}
+
+// isWebsitePattern reports whether a websites entry is a regular expression, which start with `^`.
+func isWebsitePattern(hostname string) bool {
+	return strings.HasPrefix(hostname, "^")
+}
+
+// websiteHostname returns the normalized hostname of a websites entry, patterns are kept as they are.
+func websiteHostname(hostname string) string {
+	if isWebsitePattern(hostname) {
+		return hostname
+	}
+	return parseDomainFromHost(hostname)
+}
+
+// maxHealthBodySize bounds the part of the health check response searched for healthBody.
+const maxHealthBodySize = 64 << 10
+
+// checkHealth verifies the Rybbit instance of the tenant is reachable, by requesting healthPath and expecting
+// healthStatus (any 2xx if 0) and a response containing healthBody.
+func (h *UmamiFeeder) checkHealth(ctx context.Context, t *tenant) error {
+	// Instances reconnecting at the same time with the same expectations share a single health check. It is not
+	// canceled with the instance which started it, the others still await it.
+	key := fmt.Sprintf("health:%s%s|%d|%s", t.host, h.healthPath, h.healthStatus, h.healthBody)
+	flightCtx := context.WithoutCancel(ctx)
+	_, err := rybbitFlights.do(key, func() (any, error) {
+		var status int
+		var body string
+
+		resp, err := sendRequest(flightCtx, h.client, t.host+h.healthPath, nil, nil)
+		if err != nil {
+			// A non-2xx status may be expected.
+			var statusErr *statusError
+			if !errors.As(err, &statusErr) || statusErr.status != h.healthStatus {
+				return nil, err
+			}
+			status, body = statusErr.status, statusErr.message
+		} else {
+			status = resp.StatusCode
+			if h.healthBody != "" {
+				bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, maxHealthBodySize))
+				body = string(bodyBytes)
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+
+		if h.healthStatus != 0 && status != h.healthStatus {
+			return nil, fmt.Errorf("health check returned status %d, expected %d", status, h.healthStatus)
+		}
+		if h.healthBody != "" && !strings.Contains(body, h.healthBody) {
+			return nil, fmt.Errorf("health check response does not contain %q", h.healthBody)
+		}
+		return nil, nil
+	})
+	return err
+}
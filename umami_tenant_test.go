@@ -0,0 +1,412 @@
+package traefik_rybbit_feeder
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTenantsRouting(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.Disabled = true
+	cfg.Host = "http://rybbit.example.com"
+	cfg.APIKey = "default"
+	cfg.Websites = map[string]string{"example.com": "1"}
+	cfg.Tenants = []Tenant{
+		{Host: "http://rybbit.customer.com", APIKey: "customer", Websites: map[string]string{"customer.com": "7"}},
+	}
+
+	handler, err := New(context.Background(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), cfg, "rybbit-feeder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	feeder := handler.(*UmamiFeeder)
+
+	if len(feeder.tenants) != 2 || feeder.tenants[1].apiKey != "customer" {
+		t.Fatalf("expected the top-level host and one tenant, got %d", len(feeder.tenants))
+	}
+
+	for _, host := range []string{"example.com", "customer.com"} {
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://"+host+"/", nil)
+		feeder.submitToFeed(req, responseInfo{status: http.StatusOK})
+	}
+
+	if feeder.tenants[0].queue.len() != 1 || feeder.tenants[1].queue.len() != 1 {
+		t.Fatalf("expected one event per tenant, got %d and %d",
+			feeder.tenants[0].queue.len(), feeder.tenants[1].queue.len())
+	}
+	if event := feeder.tenants[1].queue.shards[0].pop(); event.SiteID != "7" {
+		t.Fatalf("expected site-id 7, got %s", event.SiteID)
+	}
+}
+
+func TestTenantsDuplicateWebsite(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.Disabled = true
+	cfg.Host = "http://rybbit.example.com"
+	cfg.APIKey = "default"
+	cfg.Websites = map[string]string{"example.com": "1"}
+	cfg.Tenants = []Tenant{
+		{Host: "http://rybbit.customer.com", APIKey: "customer", Websites: map[string]string{"example.com": "7"}},
+	}
+
+	if _, err := New(context.Background(), nil, cfg, "rybbit-feeder"); err == nil {
+		t.Fatal("expected an error for a website configured twice")
+	}
+}
+
+func TestTenantsShared(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.Disabled = true
+	cfg.Host = "http://rybbit.shared.example.com"
+	cfg.APIKey = "shared"
+	cfg.Websites = map[string]string{"example.com": "1"}
+
+	next := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+
+	handler1, err := New(ctx1, next, cfg, "router-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler2, err := New(ctx2, next, cfg, "router-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shared := handler1.(*UmamiFeeder).tenants[0]
+	if handler2.(*UmamiFeeder).tenants[0] != shared || handler2.(*UmamiFeeder).queue != shared.queue {
+		t.Fatal("expected instances with the same host and API key to share the tenant")
+	}
+
+	cfg.APIKey = "other"
+	handler3, err := New(ctx1, next, cfg, "router-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handler3.(*UmamiFeeder).tenants[0] == shared {
+		t.Fatal("expected a separate tenant for another API key")
+	}
+
+	cancel1()
+	cancel2()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		sharedTenantsMutex.Lock()
+		_, ok := sharedTenants[shared.key]
+		sharedTenantsMutex.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the tenant to be released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTenantsWorkerSettings(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.Disabled = true
+	cfg.Host = "http://rybbit.settings.example.com"
+	cfg.APIKey = "settings"
+	cfg.Websites = map[string]string{"example.com": "1"}
+
+	next := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg.BatchSize = 10
+	handler1, err := New(ctx, next, cfg, "router-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.BatchSize = 50
+	handler2, err := New(ctx, next, cfg, "router-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenant1, tenant2 := handler1.(*UmamiFeeder).tenants[0], handler2.(*UmamiFeeder).tenants[0]
+	if tenant1 == tenant2 {
+		t.Fatal("expected instances with different batchSize not to share the tenant")
+	}
+	if tenant1.batchSize != 10 || tenant2.batchSize != 50 {
+		t.Fatalf("expected each tenant to submit with its own batchSize, got %d and %d", tenant1.batchSize, tenant2.batchSize)
+	}
+}
+
+func TestTenantsHandOff(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.Disabled = true
+	cfg.Host = "http://rybbit.handoff.example.com"
+	cfg.APIKey = "handoff"
+	cfg.Websites = map[string]string{"example.com": "1"}
+
+	next := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+
+	handler1, err := New(ctx1, next, cfg, "router")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := handler1.(*UmamiFeeder).tenants[0]
+	old.queue.push(&RybbitEvent{SiteID: "1", Pathname: "/in-flight"})
+
+	// The reloaded configuration changes the queue settings, so the tenant is not shared.
+	cfg.QueueSize = 2 * cfg.QueueSize
+	handler2, err := New(ctx2, next, cfg, "router")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel1()
+
+	queue := handler2.(*UmamiFeeder).queue
+	deadline := time.Now().Add(time.Second)
+	for queue.len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the waiting event to be handed off")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if event := queue.shards[0].pop(); event.Pathname != "/in-flight" {
+		t.Fatalf("expected the handed off event, got %+v", event)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/health":
+			_, _ = w.Write([]byte(`{"status":"ok"}`))
+		case "/api/auth":
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte("unauthorized"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		path    string
+		status  int
+		body    string
+		healthy bool
+	}{
+		{name: "any 2xx", path: "/api/health", healthy: true},
+		{name: "body found", path: "/api/health", body: `"ok"`, healthy: true},
+		{name: "body missing", path: "/api/health", body: "degraded", healthy: false},
+		{name: "status mismatch", path: "/api/health", status: http.StatusNoContent, healthy: false},
+		{name: "expected non-2xx", path: "/api/auth", status: http.StatusUnauthorized, body: "unauthorized", healthy: true},
+		{name: "unexpected non-2xx", path: "/missing", healthy: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			feeder := UmamiFeeder{
+				client:       server.Client(),
+				healthPath:   tt.path,
+				healthStatus: tt.status,
+				healthBody:   tt.body,
+			}
+			err := feeder.checkHealth(context.Background(), &tenant{host: server.URL})
+			if (err == nil) != tt.healthy {
+				t.Errorf("expected healthy %v, got error %v", tt.healthy, err)
+			}
+		})
+	}
+}
+
+func TestCheckHealthShared(t *testing.T) {
+	var requests atomic.Int32
+	arrived, release := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only the first check is held back, until the second one completed.
+		if requests.Add(1) == 1 {
+			close(arrived)
+			<-release
+		}
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer server.Close()
+
+	canceled, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		feeder := UmamiFeeder{client: server.Client(), healthPath: "/api/health", healthBody: "degraded"}
+		first <- feeder.checkHealth(canceled, &tenant{host: server.URL})
+	}()
+	<-arrived
+	cancel()
+
+	// A check with other expectations does not share the result of the first.
+	feeder := UmamiFeeder{client: server.Client(), healthPath: "/api/health", healthBody: `"ok"`}
+	if err := feeder.checkHealth(context.Background(), &tenant{host: server.URL}); err != nil {
+		t.Fatalf("expected a health check of its own, got %v", err)
+	}
+
+	// The first check is not aborted with its caller, it fails on the response.
+	close(release)
+	if err := <-first; err == nil || !strings.Contains(err.Error(), "does not contain") {
+		t.Fatalf("expected the first check to fail on its body, got %v", err)
+	}
+}
+
+func TestConnectChecksHealth(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer server.Close()
+
+	shared := &tenant{host: server.URL, apiKey: "key"}
+	connect := func(healthBody string) error {
+		feeder := &UmamiFeeder{
+			host:       server.URL,
+			apiKey:     "key",
+			client:     server.Client(),
+			websites:   map[string]string{"example.com": "1"},
+			tenants:    []*tenant{shared},
+			healthPath: "/api/health",
+			healthBody: healthBody,
+		}
+		return feeder.connect(context.Background(), &Config{})
+	}
+
+	if err := connect(`"ok"`); err != nil {
+		t.Fatal(err)
+	}
+	// An instance sharing the tenant checks its own expectations, and so does every reconnect.
+	if err := connect("degraded"); err == nil {
+		t.Fatal("expected the health check with other expectations to fail")
+	}
+	if err := connect(`"ok"`); err != nil || requests.Load() != 3 {
+		t.Fatalf("expected a health check per connect, got %d: %v", requests.Load(), err)
+	}
+}
+
+func TestWebsitesWildcard(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.Disabled = true
+	cfg.Host = "http://rybbit.example.com"
+	cfg.APIKey = "default"
+	cfg.Websites = map[string]string{"*.example.com": "1", "*.app.example.com": "2", "www.app.example.com": "3"}
+	cfg.Tenants = []Tenant{
+		{Host: "http://rybbit.customer.com", APIKey: "customer", Websites: map[string]string{"*.customer.com": "7"}},
+	}
+
+	handler, err := New(context.Background(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), cfg, "rybbit-feeder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	feeder := handler.(*UmamiFeeder)
+
+	tests := map[string]string{
+		"blog.example.com":      "1",
+		"a.b.example.com":       "1",
+		"eu.app.example.com":    "2",
+		"www.app.example.com":   "3",
+		"shop.customer.com":     "7",
+		"example.com":           "",
+		"blog.otherexample.com": "",
+	}
+	for hostname, expected := range tests {
+		if websiteId, _ := feeder.lookupWebsite(hostname); websiteId != expected {
+			t.Errorf("expected site-id %q for %s, got %q", expected, hostname, websiteId)
+		}
+	}
+
+	if feeder.queueFor("shop.customer.com") != feeder.tenants[1].queue {
+		t.Error("expected subdomains of a tenant's wildcard to be routed to the tenant")
+	}
+}
+
+func TestWebsitesInvalidWildcard(t *testing.T) {
+	for _, hostname := range []string{"www.*.example.com", "*example.com", "*.*.example.com"} {
+		cfg := CreateConfig()
+		cfg.Disabled = true
+		cfg.Host = "http://rybbit.example.com"
+		cfg.Websites = map[string]string{hostname: "1"}
+
+		if _, err := New(context.Background(), nil, cfg, "rybbit-feeder"); err == nil {
+			t.Errorf("expected an error for %s", hostname)
+		}
+	}
+}
+
+func TestWebsitesPattern(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.Disabled = true
+	cfg.Host = "http://rybbit.example.com"
+	cfg.APIKey = "default"
+	cfg.Websites = map[string]string{`^(app|api)\.corp\.io$`: "1", `^[a-z]+\.customers\.corp\.io$`: "2", "api.corp.io": "3"}
+
+	handler, err := New(context.Background(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), cfg, "rybbit-feeder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	feeder := handler.(*UmamiFeeder)
+
+	tests := map[string]string{
+		"app.corp.io":              "1",
+		"api.corp.io":              "3",
+		"acme.customers.corp.io":   "2",
+		"acme-1.customers.corp.io": "",
+		"www.app.corp.io":          "",
+	}
+	for hostname, expected := range tests {
+		if websiteId, _ := feeder.lookupWebsite(hostname); websiteId != expected {
+			t.Errorf("expected site-id %q for %s, got %q", expected, hostname, websiteId)
+		}
+	}
+
+	cfg.Websites = map[string]string{`^(app\.corp\.io$`: "1"}
+	if _, err := New(context.Background(), nil, cfg, "rybbit-feeder"); err == nil {
+		t.Error("expected an error for an invalid pattern")
+	}
+}
+
+func TestDefaultWebsite(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.Disabled = true
+	cfg.Host = "http://rybbit.example.com"
+	cfg.APIKey = "default"
+	cfg.Websites = map[string]string{"example.com": "1"}
+	cfg.DefaultWebsite = "99"
+	cfg.Tenants = []Tenant{
+		{Host: "http://rybbit.customer.com", APIKey: "customer", Websites: map[string]string{"customer.com": "7"}},
+	}
+
+	handler, err := New(context.Background(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), cfg, "rybbit-feeder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	feeder := handler.(*UmamiFeeder)
+
+	tests := map[string]string{"example.com": "1", "customer.com": "7", "unknown.org": "99"}
+	for hostname, expected := range tests {
+		if websiteId, ok := feeder.lookupWebsite(hostname); !ok || websiteId != expected {
+			t.Errorf("expected site-id %q for %s, got %q", expected, hostname, websiteId)
+		}
+	}
+	if feeder.queueFor("unknown.org") != feeder.tenants[0].queue {
+		t.Error("expected the default website to belong to the top-level host")
+	}
+
+	cfg.Host = ""
+	cfg.Websites = map[string]string{}
+	if _, err := New(context.Background(), nil, cfg, "rybbit-feeder"); err == nil {
+		t.Error("expected an error for defaultWebsite without host")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestTraefikUmamiFeeder(t *testing.T) {
@@ -36,17 +37,17 @@ func TestTraefikUmamiFeeder(t *testing.T) {
 func TestShouldTrackDefault(t *testing.T) {
 	feeder := UmamiFeeder{}
 
-	assertResource(t, feeder, true, "http://localhost")
-	assertResource(t, feeder, true, "http://localhost/about")
-	assertResource(t, feeder, true, "http://localhost/products.html")
-	assertResource(t, feeder, true, "http://localhost/blog.php")
-	assertResource(t, feeder, true, "http://localhost/feed.rss")
-	assertResource(t, feeder, false, "http://localhost/favicon.ico")
-	assertResource(t, feeder, false, "http://localhost/photo.jpg")
-	assertResource(t, feeder, false, "http://localhost/background.png")
+	assertResource(t, &feeder, true, "http://localhost")
+	assertResource(t, &feeder, true, "http://localhost/about")
+	assertResource(t, &feeder, true, "http://localhost/products.html")
+	assertResource(t, &feeder, true, "http://localhost/blog.php")
+	assertResource(t, &feeder, true, "http://localhost/feed.rss")
+	assertResource(t, &feeder, false, "http://localhost/favicon.ico")
+	assertResource(t, &feeder, false, "http://localhost/photo.jpg")
+	assertResource(t, &feeder, false, "http://localhost/background.png")
 }
 
-func assertResource(t *testing.T, plugin UmamiFeeder, expected bool, url string) {
+func assertResource(t *testing.T, plugin *UmamiFeeder, expected bool, url string) {
 	if expected != plugin.shouldTrackResource(url) {
 		t.Fatalf("expected %v for %s", expected, url)
 	}
@@ -63,6 +64,32 @@ func TestShouldTrackInvalidIp(t *testing.T) {
 	}
 }
 
+func TestVerifyConfigSkipsInvalidEntries(t *testing.T) {
+	feeder := UmamiFeeder{createNewWebsites: true}
+	err := feeder.verifyConfig(&Config{SkipInvalidConfig: true, IgnoreIPs: []string{"127.0.0.1-127.0.0.10", "10.0.0.0/8"}})
+	if err != nil {
+		t.Fatalf("expected invalid entries to be skipped, got %v", err)
+	}
+	if len(feeder.ignorePrefixes) != 1 {
+		t.Fatalf("expected the valid ignoreIp to be kept, got %v", feeder.ignorePrefixes)
+	}
+
+	feeder = UmamiFeeder{createNewWebsites: true}
+	err = feeder.verifyConfig(&Config{
+		SkipInvalidConfig: true,
+		IgnoreURLs:        []string{"(/admin", "^/health"},
+		AllowURLs:         []string{"["},
+	})
+	if err != nil {
+		t.Fatalf("expected invalid entries to be skipped, got %v", err)
+	}
+	if feeder.allowRegexp != nil {
+		t.Fatal("expected no allowURLs without valid patterns")
+	}
+	assertIgnorePath(t, &feeder, false, "/health")
+	assertIgnorePath(t, &feeder, true, "/admin")
+}
+
 func TestShouldTrackIps(t *testing.T) {
 	feeder := UmamiFeeder{createNewWebsites: true}
 	err := feeder.verifyConfig(&Config{
@@ -73,17 +100,44 @@ func TestShouldTrackIps(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	assertIgnoreIp(t, feeder, true, "192.168.0.1")
-	assertIgnoreIp(t, feeder, false, "127.0.0.1")
-	assertIgnoreIp(t, feeder, false, "10.0.0.1")
-	assertIgnoreIp(t, feeder, false, "10.0.0.255")
-	assertIgnoreIp(t, feeder, true, "10.0.1.1")
-	assertIgnoreIp(t, feeder, true, "10.10.10.1")
-	assertIgnoreIp(t, feeder, true, "1.1.1.1")
-	assertIgnoreIp(t, feeder, true, "8.8.8.8")
+	assertIgnoreIp(t, &feeder, true, "192.168.0.1")
+	assertIgnoreIp(t, &feeder, false, "127.0.0.1")
+	assertIgnoreIp(t, &feeder, false, "10.0.0.1")
+	assertIgnoreIp(t, &feeder, false, "10.0.0.255")
+	assertIgnoreIp(t, &feeder, true, "10.0.1.1")
+	assertIgnoreIp(t, &feeder, true, "10.10.10.1")
+	assertIgnoreIp(t, &feeder, true, "1.1.1.1")
+	assertIgnoreIp(t, &feeder, true, "8.8.8.8")
+}
+
+func TestShouldTrackIPv6Prefix(t *testing.T) {
+	feeder := UmamiFeeder{createNewWebsites: true, headerIp: "X-Real-Ip"}
+	err := feeder.verifyConfig(&Config{
+		IgnoreIPs:              []string{"2001:db8:1:2::abcd", "192.168.0.1", "2001:db8:ff::/48"},
+		IgnoreIPv6PrefixLength: 64,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertIgnoreIp(t, &feeder, false, "2001:db8:1:2::abcd")
+	assertIgnoreIp(t, &feeder, false, "2001:db8:1:2:ffff::1")
+	assertIgnoreIp(t, &feeder, true, "2001:db8:1:3::abcd")
+	assertIgnoreIp(t, &feeder, false, "2001:db8:ff:1::1")
+	assertIgnoreIp(t, &feeder, false, "192.168.0.1")
+	assertIgnoreIp(t, &feeder, true, "192.168.0.2")
+	// IPv4 addresses never match IPv6 networks, even the first /32.
+	assertIgnoreIp(t, &feeder, true, "32.1.13.184")
+
+	for _, invalid := range []string{"2001:db8::1/129", "192.168.0.1/33", "not-an-ip"} {
+		if err := (&UmamiFeeder{}).verifyConfig(&Config{IgnoreIPs: []string{invalid}}); err == nil {
+			t.Errorf("expected an error for %s", invalid)
+		}
+	}
 }
 
-func assertIgnoreIp(t *testing.T, plugin UmamiFeeder, expected bool, clientIp string) {
+func assertIgnoreIp(t *testing.T, plugin *UmamiFeeder, expected bool, clientIp string) {
 	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost", nil)
 	req.Header.Set(plugin.headerIp, clientIp)
 
@@ -102,17 +156,81 @@ func TestShouldTrackUrls(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	assertIgnoreUrl(t, feeder, false, "http://localhost/health")
-	assertIgnoreUrl(t, feeder, true, "http://localhost/user/health")
-	assertIgnoreUrl(t, feeder, true, "http://localhost/healthcheck")
-	assertIgnoreUrl(t, feeder, true, "http://localhost/")
-	assertIgnoreUrl(t, feeder, false, "http://localhost/about")
-	assertIgnoreUrl(t, feeder, false, "http://localhost/aboutus")
-	assertIgnoreUrl(t, feeder, false, "http://localhost/category/about")
-	assertIgnoreUrl(t, feeder, true, "http://localhost/hello-world")
+	assertIgnoreUrl(t, &feeder, false, "http://localhost/health")
+	assertIgnoreUrl(t, &feeder, true, "http://localhost/user/health")
+	assertIgnoreUrl(t, &feeder, true, "http://localhost/healthcheck")
+	assertIgnoreUrl(t, &feeder, true, "http://localhost/")
+	assertIgnoreUrl(t, &feeder, false, "http://localhost/about")
+	assertIgnoreUrl(t, &feeder, false, "http://localhost/aboutus")
+	assertIgnoreUrl(t, &feeder, false, "http://localhost/category/about")
+	assertIgnoreUrl(t, &feeder, true, "http://localhost/hello-world")
 }
 
-func assertIgnoreUrl(t *testing.T, plugin UmamiFeeder, expected bool, url string) {
+func TestShouldTrackUrlsQuery(t *testing.T) {
+	feeder := UmamiFeeder{createNewWebsites: true}
+	err := feeder.verifyConfig(&Config{
+		IgnoreURLs: []string{"^/health$", `[?&]preview=1\b`},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertIgnorePath(t, &feeder, false, "/health")
+	assertIgnorePath(t, &feeder, true, "/health?full=1")
+	assertIgnorePath(t, &feeder, false, "/blog?preview=1")
+	assertIgnorePath(t, &feeder, true, "/blog?page=1")
+
+	feeder.urlsPathOnly = true
+	assertIgnorePath(t, &feeder, false, "/health?full=1")
+	assertIgnorePath(t, &feeder, true, "/blog?preview=1")
+}
+
+func TestShouldTrackAllowUrls(t *testing.T) {
+	feeder := UmamiFeeder{createNewWebsites: true}
+	err := feeder.verifyConfig(&Config{
+		AllowURLs:  []string{"^/$", "^/pricing$", "^/blog/"},
+		IgnoreURLs: []string{"^/blog/drafts/"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertIgnorePath(t, &feeder, true, "/")
+	assertIgnorePath(t, &feeder, true, "/pricing")
+	assertIgnorePath(t, &feeder, true, "/blog/hello-world")
+	assertIgnorePath(t, &feeder, false, "/blog/drafts/next")
+	assertIgnorePath(t, &feeder, false, "/api/users")
+	assertIgnorePath(t, &feeder, false, "/pricing/old")
+}
+
+func TestShouldTrackMethods(t *testing.T) {
+	feeder := UmamiFeeder{createNewWebsites: true}
+	err := feeder.verifyConfig(&Config{
+		TrackMethods:  []string{"get", "HEAD", "OPTIONS"},
+		IgnoreMethods: []string{"OPTIONS"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for method, expected := range map[string]bool{
+		http.MethodGet:     true,
+		http.MethodHead:    true,
+		http.MethodPost:    false,
+		http.MethodPut:     false,
+		http.MethodOptions: false,
+	} {
+		req, _ := http.NewRequestWithContext(context.Background(), method, "http://localhost/", nil)
+		if expected != feeder.shouldTrack(req) {
+			t.Fatalf("expected %v for %s", expected, method)
+		}
+	}
+}
+
+func assertIgnoreUrl(t *testing.T, plugin *UmamiFeeder, expected bool, url string) {
 	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
 
 	if expected != plugin.shouldTrack(req) {
@@ -120,20 +238,64 @@ func assertIgnoreUrl(t *testing.T, plugin UmamiFeeder, expected bool, url string
 	}
 }
 
+// assertIgnorePath checks a request of localhost as received by Traefik, whose URL is only the path and query string.
+func assertIgnorePath(t *testing.T, plugin *UmamiFeeder, expected bool, path string) {
+	if expected != plugin.shouldTrack(newServerRequest("localhost", path)) {
+		t.Fatalf("expected %v for %s", expected, path)
+	}
+}
+
+// newServerRequest returns a request of host as received by a server, whose URL is only the path and query string.
+func newServerRequest(host string, path string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Host = host
+	return req
+}
+
 func TestShouldTrackUserAgents(t *testing.T) {
-	feeder := UmamiFeeder{createNewWebsites: true, ignoreUserAgents: []string{"Googlebot", "Uptime-Kuma"}}
+	feeder := UmamiFeeder{createNewWebsites: true}
+	err := feeder.verifyConfig(&Config{
+		IgnoreUserAgents: []string{"Googlebot", "Uptime-Kuma"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	assertIgnoreUa(t, feeder, true, "Mozilla/5.0 (Windows; Windows NT 6.0; WOW64) Gecko/20100101 Firefox/60.7")
-	assertIgnoreUa(t, feeder, true, "Mozilla/5.0 (compatible; MSIE 10.0; Windows NT 10.0; Win64; x64 Trident/6.0)")
-	assertIgnoreUa(t, feeder, true, "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36")
-	assertIgnoreUa(t, feeder, false, "Uptime-Kuma/1.18.5")
-	assertIgnoreUa(t, feeder, false, "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/90.0.4430.212 Safari/537.36 Uptime-Kuma/1.23.1")
-	assertIgnoreUa(t, feeder, true, "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36")
-	assertIgnoreUa(t, feeder, false, "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)")
-	assertIgnoreUa(t, feeder, false, "Mozilla/5.0 (Linux; Android 6.0.1; Nexus 5X Build/MMB29P) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/W.X.Y.Z Mobile Safari/537.36 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)")
+	assertIgnoreUa(t, &feeder, true, "Mozilla/5.0 (Windows; Windows NT 6.0; WOW64) Gecko/20100101 Firefox/60.7")
+	assertIgnoreUa(t, &feeder, true, "Mozilla/5.0 (compatible; MSIE 10.0; Windows NT 10.0; Win64; x64 Trident/6.0)")
+	assertIgnoreUa(t, &feeder, true, "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36")
+	assertIgnoreUa(t, &feeder, false, "Uptime-Kuma/1.18.5")
+	assertIgnoreUa(t, &feeder, false, "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/90.0.4430.212 Safari/537.36 Uptime-Kuma/1.23.1")
+	assertIgnoreUa(t, &feeder, true, "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36")
+	assertIgnoreUa(t, &feeder, false, "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)")
+	assertIgnoreUa(t, &feeder, false, "Mozilla/5.0 (Linux; Android 6.0.1; Nexus 5X Build/MMB29P) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/W.X.Y.Z Mobile Safari/537.36 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)")
 }
 
-func assertIgnoreUa(t *testing.T, plugin UmamiFeeder, expected bool, ua string) {
+func TestShouldTrackUserAgentsRegex(t *testing.T) {
+	feeder := UmamiFeeder{createNewWebsites: true}
+	err := feeder.verifyConfig(&Config{
+		IgnoreUserAgents:      []string{"Uptime-Kuma"},
+		IgnoreUserAgentsRegex: []string{`(?i)(bot|spider|crawler)`, `^Java/\d+`},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertIgnoreUa(t, &feeder, true, "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36")
+	assertIgnoreUa(t, &feeder, false, "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)")
+	assertIgnoreUa(t, &feeder, false, "Sogou web SPIDER/4.0")
+	assertIgnoreUa(t, &feeder, false, "Java/17.0.2")
+	assertIgnoreUa(t, &feeder, true, "MyApp Java/17.0.2")
+	assertIgnoreUa(t, &feeder, false, "Uptime-Kuma/1.23.1")
+
+	if err := (&UmamiFeeder{}).verifyConfig(&Config{IgnoreUserAgentsRegex: []string{"(bot"}}); err == nil {
+		t.Fatal("expected an error for an invalid pattern")
+	}
+}
+
+func assertIgnoreUa(t *testing.T, plugin *UmamiFeeder, expected bool, ua string) {
 	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/", nil)
 	req.Header.Set("User-Agent", ua)
 
@@ -141,3 +303,253 @@ func assertIgnoreUa(t *testing.T, plugin UmamiFeeder, expected bool, ua string)
 		t.Fatalf("expected %v for %s", expected, ua)
 	}
 }
+
+func TestShouldTrackIpsRemoteAddr(t *testing.T) {
+	feeder := UmamiFeeder{createNewWebsites: true, headerIp: "X-Real-Ip"}
+	err := feeder.verifyConfig(&Config{
+		IgnoreIPs: []string{"127.0.0.1", "::1"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertIgnoreRemoteAddr(t, &feeder, false, "127.0.0.1:54321")
+	assertIgnoreRemoteAddr(t, &feeder, false, "[::1]:54321")
+	assertIgnoreRemoteAddr(t, &feeder, true, "192.168.0.1:54321")
+	assertIgnoreRemoteAddr(t, &feeder, true, "[2001:db8::1]:443")
+}
+
+func assertIgnoreRemoteAddr(t *testing.T, plugin *UmamiFeeder, expected bool, remoteAddr string) {
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = remoteAddr
+
+	if expected != plugin.shouldTrack(req) {
+		t.Fatalf("expected %v for %s", expected, remoteAddr)
+	}
+}
+
+func TestNewInvalidBatching(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	for name, modify := range map[string]func(*Config){
+		"zero queueSize":     func(c *Config) { c.QueueSize = 0 },
+		"negative batchSize": func(c *Config) { c.BatchSize = -1 },
+		"batch over queue":   func(c *Config) { c.QueueSize = 10; c.BatchSize = 20 },
+		"zero batchMaxWait":  func(c *Config) { c.BatchMaxWait = 0 },
+		"huge batchMaxWait":  func(c *Config) { c.BatchMaxWait = 24 * time.Hour },
+	} {
+		cfg := CreateConfig()
+		cfg.Disabled = true
+		modify(cfg)
+
+		if _, err := New(context.Background(), next, cfg, "umami-feeder"); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestNewInvalidOptions(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	// Rejected before connecting, so the router fails instead of the plugin being disabled silently.
+	for name, modify := range map[string]func(*Config){
+		"abortedRequests":        func(c *Config) { c.AbortedRequests = "drop" },
+		"queryMode":              func(c *Config) { c.QueryMode = "all" },
+		"queryAllowlist missing": func(c *Config) { c.QueryMode = queryAllowlist },
+		"dedup":                  func(c *Config) { c.Dedup = "sometimes" },
+		"dedupCookie missing":    func(c *Config) { c.Dedup = dedupCookie },
+		"ignoreIPv6PrefixLength": func(c *Config) { c.IgnoreIPv6PrefixLength = 129 },
+		"minBotScore":            func(c *Config) { c.MinBotScore = 100 },
+		"botScoreHeader missing": func(c *Config) { c.MinBotScore = 30; c.BotScoreHeader = "" },
+	} {
+		cfg := CreateConfig()
+		cfg.Disabled = true
+		modify(cfg)
+
+		if _, err := New(context.Background(), next, cfg, "umami-feeder"); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func BenchmarkShouldTrackNoFilters(b *testing.B) {
+	feeder := UmamiFeeder{websites: map[string]string{"localhost": "1"}}
+	if err := feeder.verifyConfig(&Config{}); err != nil {
+		b.Fatal(err)
+	}
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/about", nil)
+	req.RemoteAddr = "192.168.0.1:54321"
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !feeder.shouldTrack(req) {
+			b.Fatal("expected request to be tracked")
+		}
+	}
+}
+
+func BenchmarkShouldTrackFilters(b *testing.B) {
+	feeder := UmamiFeeder{websites: map[string]string{"localhost": "1"}, headerIp: "X-Real-Ip"}
+	err := feeder.verifyConfig(&Config{
+		IgnoreIPs:        []string{"10.0.0.1/24"},
+		IgnoreUserAgents: []string{"Googlebot", "Uptime-Kuma"},
+		IgnoreURLs:       []string{"^/health$", "^/api/"},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/about", nil)
+	req.RemoteAddr = "192.168.0.1:54321"
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !feeder.shouldTrack(req) {
+			b.Fatal("expected request to be tracked")
+		}
+	}
+}
+
+func TestServeHTTPTracksOnceWhenChained(t *testing.T) {
+	newFeeder := func(next http.Handler) *UmamiFeeder {
+		feeder := &UmamiFeeder{
+			next:     next,
+			websites: map[string]string{"localhost": "1"},
+			queue:    newEventQueue(queueTypeChannel, 10, 1),
+		}
+		feeder.sampleRate.Store(1)
+		return feeder
+	}
+
+	inner := newFeeder(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	outer := newFeeder(inner)
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/", nil)
+	outer.ServeHTTP(httptest.NewRecorder(), req)
+
+	if outer.queue.len() != 1 || inner.queue.len() != 0 {
+		t.Fatalf("expected only the outer middleware to track, got %d and %d", outer.queue.len(), inner.queue.len())
+	}
+}
+
+func TestShouldTrackBotScore(t *testing.T) {
+	feeder := UmamiFeeder{createNewWebsites: true}
+	err := feeder.verifyConfig(&Config{
+		MinBotScore:        30,
+		IgnoreVerifiedBots: true,
+		BotScoreHeader:     "Cf-Bot-Score",
+		VerifiedBotHeader:  "Cf-Verified-Bot",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for headers, expected := range map[[2]string]bool{
+		{"", ""}:        true,
+		{"99", "false"}: true,
+		{"30", ""}:      true,
+		{"29", ""}:      false,
+		{"1", "true"}:   false,
+		{"", "true"}:    false,
+	} {
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/", nil)
+		req.Header.Set("Cf-Bot-Score", headers[0])
+		req.Header.Set("Cf-Verified-Bot", headers[1])
+
+		if expected != feeder.shouldTrack(req) {
+			t.Fatalf("expected %v for %v", expected, headers)
+		}
+	}
+}
+
+func TestShouldTrackDedupNoJS(t *testing.T) {
+	feeder := UmamiFeeder{createNewWebsites: true, dedup: dedupNoJS}
+	if err := feeder.verifyConfig(&Config{Dedup: dedupNoJS}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertIgnoreUa(t, &feeder, false, "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36")
+	assertIgnoreUa(t, &feeder, true, "Lynx/2.9.0dev.10 libwww-FM/2.14 SSL-MM/1.4.1 GNUTLS/3.7.1")
+	assertIgnoreUa(t, &feeder, true, "curl/8.5.0")
+	assertIgnoreUa(t, &feeder, true, "Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)")
+}
+
+func TestShouldTrackDedupCookie(t *testing.T) {
+	feeder := UmamiFeeder{createNewWebsites: true, dedup: dedupCookie, dedupCookie: "rybbit_js"}
+	if err := feeder.verifyConfig(&Config{Dedup: dedupCookie, DedupCookie: "rybbit_js"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for cookie, expected := range map[string]bool{"": true, "rybbit_js=1": false, "session=abc": true} {
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/", nil)
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+
+		if expected != feeder.shouldTrack(req) {
+			t.Fatalf("expected %v for cookie %q", expected, cookie)
+		}
+	}
+}
+
+func TestServeHTTPFailClosed(t *testing.T) {
+	rybbit := httptest.NewServer(http.NotFoundHandler())
+	rybbit.Close()
+
+	cfg := CreateConfig()
+	cfg.Host = rybbit.URL
+	cfg.APIKey = "key"
+	cfg.Websites = map[string]string{"localhost": "1"}
+	cfg.FailMode = failClosed
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler, err := New(ctx, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), cfg, "rybbit-feeder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	feeder := handler.(*UmamiFeeder)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for failure, _ := feeder.failure.Load().(string); failure == ""; failure, _ = feeder.failure.Load().(string) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the connection to fail")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://localhost/", nil))
+	if recorder.Header().Get(failureHeader) != "disabled" {
+		t.Fatalf("expected the %s header", failureHeader)
+	}
+}
+
+func TestShouldTrackDoNotTrack(t *testing.T) {
+	feeder := UmamiFeeder{createNewWebsites: true}
+	if err := feeder.verifyConfig(&Config{RespectDoNotTrack: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	for header, expected := range map[[2]string]bool{
+		{"", ""}:         true,
+		{"DNT", "0"}:     true,
+		{"DNT", "1"}:     false,
+		{"Sec-GPC", "1"}: false,
+	} {
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/", nil)
+		if header[0] != "" {
+			req.Header.Set(header[0], header[1])
+		}
+
+		if expected != feeder.shouldTrack(req) {
+			t.Fatalf("expected %v for %v", expected, header)
+		}
+	}
+}
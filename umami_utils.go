@@ -1,29 +1,154 @@
 package traefik_rybbit_feeder
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
-func sendRequest(ctx context.Context, url string, body interface{}, headers http.Header) (*http.Response, error) {
+// newHTTPClient creates the client used to talk to Rybbit, with its transport tuned by config.
+func newHTTPClient(config *Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = config.MaxIdleConns
+	// All requests go to the same Rybbit host, so its idle connections are limited by MaxIdleConns alone.
+	transport.MaxIdleConnsPerHost = config.MaxIdleConns
+	transport.MaxConnsPerHost = config.MaxConnsPerHost
+	transport.IdleConnTimeout = config.IdleConnTimeout
+	transport.ForceAttemptHTTP2 = !config.DisableHTTP2
+	if config.DisableHTTP2 {
+		// A non-nil empty map disables the HTTP/2 upgrade over TLS.
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	return &http.Client{Timeout: 10 * time.Second, Transport: transport}
+}
+
+// bufferPool holds the buffers request bodies are encoded into.
+var bufferPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// pooledBody is a request body that returns its buffer to bufferPool once the transport closed it.
+type pooledBody struct {
+	*bytes.Reader
+	buf  *bytes.Buffer
+	once sync.Once
+}
+
+func (b *pooledBody) Close() error {
+	b.once.Do(func() {
+		b.buf.Reset()
+		bufferPool.Put(b.buf)
+	})
+	return nil
+}
+
+// newJSONBody encodes value into a pooled buffer.
+func newJSONBody(value interface{}) (*pooledBody, error) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(value); err != nil {
+		buf.Reset()
+		bufferPool.Put(buf)
+		return nil, err
+	}
+
+	return &pooledBody{Reader: bytes.NewReader(buf.Bytes()), buf: buf}, nil
+}
+
+// batchBody is a JSON array of events streamed by newBatchBody.
+type batchBody struct {
+	*io.PipeReader
+	poisoned atomic.Bool   // encoding an event panicked, the array is incomplete
+	done     chan struct{} // closed once the events are not read anymore
+}
+
+// newBatchBody stream-encodes the payloads of events as a JSON array, without materializing the whole batch in memory.
+// The returned body must be released, which stops the encoding if the request is aborted early.
+func newBatchBody(events []*SendBody) *batchBody {
+	reader, writer := io.Pipe()
+	body := &batchBody{PipeReader: reader, done: make(chan struct{})}
+
+	go func() {
+		defer close(body.done)
+		// A panic must not crash Traefik from this goroutine, the body fails to be read instead.
+		defer func() {
+			if panicVal := recover(); panicVal != nil {
+				body.poisoned.Store(true)
+				_ = writer.CloseWithError(&panicError{value: panicVal})
+			}
+		}()
+
+		buffered := bufio.NewWriter(writer)
+		encoder := json.NewEncoder(buffered)
+
+		err := buffered.WriteByte('[')
+		for i, value := range events {
+			if err != nil {
+				break
+			}
+			if i > 0 {
+				err = buffered.WriteByte(',')
+			}
+			if err == nil {
+				err = encoder.Encode(value.Payload)
+			}
+		}
+		if err == nil {
+			err = buffered.WriteByte(']')
+		}
+		if err == nil {
+			err = buffered.Flush()
+		}
+
+		_ = writer.CloseWithError(err)
+	}()
+
+	return body
+}
+
+// release closes the body and waits for the encoding to stop, so the events can be returned to their pools.
+// The transport may return before having read the whole body, e.g. as the request failed.
+func (b *batchBody) release() {
+	_ = b.Close()
+	<-b.done
+}
+
+// sendRequest sends body as JSON, or as it is if it is an io.Reader, or a GET request if body is nil.
+func sendRequest(ctx context.Context, client *http.Client, url string, body interface{}, headers http.Header) (*http.Response, error) {
 	var req *http.Request
 	var err error
 
-	if body != nil {
-		bodyJson, err := json.Marshal(body)
+	if reader, ok := body.(io.Reader); ok {
+		// Streamed body of unknown length, it is sent chunked.
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, url, reader)
+	} else if body != nil {
+		jsonBody, err := newJSONBody(body)
 		if err != nil {
 			return nil, err
 		}
 
-		req, err = http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(bodyJson))
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, url, jsonBody)
+		if err != nil {
+			_ = jsonBody.Close()
+			return nil, err
+		}
+		req.ContentLength = int64(jsonBody.Len())
 	} else {
 		req, err = http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	}
@@ -40,7 +165,6 @@ func sendRequest(ctx context.Context, url string, body interface{}, headers http
 		req.Header.Set("Content-Type", "application/json")
 	}
 
-	client := &http.Client{Timeout: 10 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
@@ -54,16 +178,35 @@ func sendRequest(ctx context.Context, url string, body interface{}, headers http
 
 		respBody, err := io.ReadAll(resp.Body)
 		if err != nil {
-			return nil, fmt.Errorf("request failed with status %d (failed to read body: %v)", status, err)
+			return nil, &statusError{status: status, message: fmt.Sprintf("failed to read body: %v", err)}
 		}
-		return nil, fmt.Errorf("request failed with status %d (%v)", status, string(respBody))
+		return nil, &statusError{status: status, message: string(respBody)}
 	}
 
 	return resp, nil
 }
 
-func sendRequestAndParse(ctx context.Context, url string, body interface{}, headers http.Header, value interface{}) error {
-	resp, err := sendRequest(ctx, url, body, headers)
+// statusError is returned by sendRequest for responses with a non-2xx status.
+type statusError struct {
+	status  int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("request failed with status %d (%s)", e.status, e.message)
+}
+
+// panicError is a recovered panic, returned so a single event is dropped instead of failing the worker.
+type panicError struct {
+	value any
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
+
+func sendRequestAndParse(ctx context.Context, client *http.Client, url string, body interface{}, headers http.Header, value interface{}) error {
+	resp, err := sendRequest(ctx, client, url, body, headers)
 	if err != nil {
 		return err
 	}
@@ -84,57 +227,419 @@ func sendRequestAndParse(ctx context.Context, url string, body interface{}, head
 	return nil
 }
 
+// compileAlternation compiles patterns into a single regexp matching any of them,
+// so a value is checked against all patterns in one pass.
+func compileAlternation(patterns []string) (*regexp.Regexp, error) {
+	groups := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		// Compile separately first, so an error points to the offending pattern.
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("%s: %w", pattern, err)
+		}
+		groups = append(groups, "(?:"+pattern+")")
+	}
+
+	return regexp.Compile(strings.Join(groups, "|"))
+}
+
+// normalizeAPIPath replaces path segments that look like identifiers (numbers, UUIDs, long hex strings) with `:id`,
+// so e.g. `/api/users/42` and `/api/users/43` are reported as the same endpoint.
+func normalizeAPIPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if isIdentifierSegment(segment) {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func isIdentifierSegment(segment string) bool {
+	if segment == "" {
+		return false
+	}
+
+	digits, hex := true, true
+	for _, c := range segment {
+		isDigit := c >= '0' && c <= '9'
+		digits = digits && isDigit
+		hex = hex && (isDigit || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F') || c == '-')
+	}
+
+	// UUIDs are 36 characters, other hex identifiers (e.g. object ids) at least 16.
+	return digits || (hex && len(segment) >= 16)
+}
+
+// hashIdentity returns a short salted SHA-256 hash of identity, stable enough to count distinct users.
+func hashIdentity(salt string, identity string) string {
+	sum := sha256.Sum256([]byte(salt + identity))
+	return hex.EncodeToString(sum[:8])
+}
+
+// parseServerTiming returns the durations in milliseconds of the metrics of Server-Timing header values, e.g.
+// `db;dur=53, cache;desc="Cache Read";dur=23.2`, limited to the given metrics. Metrics without duration are skipped.
+func parseServerTiming(values []string, metrics []string) map[string]float64 {
+	durations := map[string]float64{}
+	for _, value := range values {
+		for _, metric := range splitQuoted(value, ',') {
+			params := splitQuoted(metric, ';')
+			name := strings.ToLower(strings.TrimSpace(params[0]))
+			if !containsFold(metrics, name) {
+				continue
+			}
+
+			for _, param := range params[1:] {
+				key, duration, ok := strings.Cut(strings.TrimSpace(param), "=")
+				if !ok || !strings.EqualFold(strings.TrimSpace(key), "dur") {
+					continue
+				}
+				if ms, err := strconv.ParseFloat(strings.Trim(strings.TrimSpace(duration), `"`), 64); err == nil && ms >= 0 {
+					durations[name] = ms
+				}
+				break
+			}
+		}
+	}
+	return durations
+}
+
+// containsFold reports whether values contains value, compared case-insensitively.
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitQuoted splits value at each sep outside of double quotes.
+func splitQuoted(value string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '"':
+			quoted = !quoted
+		case '\\':
+			// Skip the escaped character within a quoted string.
+			if quoted {
+				i++
+			}
+		case sep:
+			if !quoted {
+				parts = append(parts, value[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, value[start:])
+}
+
+// fingerprintHeaders are the headers whose values are part of the request fingerprint, next to the header names.
+var fingerprintHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language"}
+
+// requestFingerprint returns a short hash of the header names and the fingerprintHeaders values of the request,
+// which differ between client implementations but rarely between requests of the same client.
+// Go does not keep the order of headers, so the sorted names are used.
+func requestFingerprint(req *http.Request) string {
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hash := sha256.New()
+	_, _ = io.WriteString(hash, strings.Join(names, ","))
+	for _, name := range fingerprintHeaders {
+		_, _ = io.WriteString(hash, "\n"+req.Header.Get(name))
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:8])
+}
+
+// truncate shortens value to at most maxLength bytes, ending with "…" if it was cut. 0 means no limit.
+func truncate(value string, maxLength int) string {
+	const ellipsis = "…"
+	if maxLength <= 0 || len(value) <= maxLength {
+		return value
+	}
+
+	cut := maxLength - len(ellipsis)
+	if cut < 0 {
+		cut = 0
+	}
+	// Do not split a multibyte character.
+	for cut > 0 && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
+	return value[:cut] + ellipsis
+}
+
+// parseDomainFromHost returns the lower-cased hostname of a Host header value,
+// without port, IPv6 brackets or trailing dot, and in Unicode form for internationalized domain names.
 func parseDomainFromHost(host string) string {
-	// check if the host has a port
-	if strings.Contains(host, ":") {
-		host = strings.Split(host, ":")[0]
+	host = strings.TrimSpace(host)
+	if host == "" {
+		return ""
 	}
-	if strings.HasSuffix(host, ".") {
-		host = strings.TrimSuffix(host, ".")
+
+	// check if the host has a port, e.g. "example.com:8443" or "[::1]:8443"
+	if strings.Contains(host, ":") {
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		} else if strings.Count(host, ":") == 1 {
+			// a trailing colon without a port, e.g. "example.com:"
+			host = host[:strings.Index(host, ":")]
+		}
 	}
-	return strings.ToLower(host)
+
+	host = strings.TrimRight(host, ".")
+	return normalizeIDN(strings.ToLower(host))
 }
 
 const parseAcceptLanguagePattern = `([a-zA-Z\-]+)(?:;q=\d\.\d)?(?:,\s)?`
 
 var parseAcceptLanguageRegexp = regexp.MustCompile(parseAcceptLanguagePattern)
 
+// maxAcceptLanguageLength bounds the part of the header that is inspected, only the first language is of interest.
+const maxAcceptLanguageLength = 256
+
 func parseAcceptLanguage(acceptLanguage string) string {
-	matches := parseAcceptLanguageRegexp.FindAllStringSubmatch(acceptLanguage, -1)
-	if len(matches) == 0 {
+	if len(acceptLanguage) > maxAcceptLanguageLength {
+		acceptLanguage = acceptLanguage[:maxAcceptLanguageLength]
+	}
+
+	match := parseAcceptLanguageRegexp.FindStringSubmatch(acceptLanguage)
+	if len(match) < 2 {
+		return ""
+	}
+	return match[1]
+}
+
+// parseIP parses an IP address that may carry a port and/or IPv6 brackets,
+// e.g. "10.0.0.1:1234", "[::1]:443" or "[::1]".
+func parseIP(value string) (netip.Addr, error) {
+	value = strings.TrimSpace(value)
+
+	if addrPort, err := netip.ParseAddrPort(value); err == nil {
+		return addrPort.Addr().Unmap(), nil
+	}
+
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	return addr.Unmap(), nil
+}
+
+// parseIgnoreIP parses an IP address or CIDR of IgnoreIPs. A bare IPv4 address matches exactly,
+// a bare IPv6 address its network of ipv6PrefixLength bits, or exactly if 0.
+func parseIgnoreIP(value string, ipv6PrefixLength int) (netip.Prefix, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := parseIP(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	bits := addr.BitLen()
+	if addr.Is6() && ipv6PrefixLength > 0 {
+		bits = ipv6PrefixLength
+	}
+	return addr.Prefix(bits)
+}
+
+// hashIP returns a salted hash of an IP address, formatted as an address of the unique local range fd00::/8,
+// so it is accepted as an IP address and still distinguishes visitors without revealing their address.
+// Values which are not an IP address are dropped.
+func hashIP(salt string, value string) string {
+	addr, err := parseIP(value)
+	if err != nil {
 		return ""
 	}
-	return matches[0][1]
+
+	sum := sha256.Sum256([]byte(salt + addr.String()))
+	var hashed [16]byte
+	copy(hashed[:], sum[:16])
+	hashed[0] = 0xfd
+	return netip.AddrFrom16(hashed).String()
+}
+
+// newSecret returns a random hex-encoded secret.
+func newSecret() string {
+	secret := make([]byte, 16)
+	_, _ = rand.Read(secret)
+	return hex.EncodeToString(secret)
+}
+
+// newEventID returns a short random hex-encoded ID for an event.
+func newEventID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// anonymizeIP zeroes the last octet of an IPv4 address and the last 80 bits of an IPv6 address.
+// Values which are not an IP address are dropped, as they can not be anonymized.
+func anonymizeIP(value string) string {
+	addr, err := parseIP(value)
+	if err != nil {
+		return ""
+	}
+
+	bits := 24
+	if addr.Is6() {
+		bits = 48
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix.Addr().String()
+}
+
+// normalizeIP returns the bare IP address of value, or value unchanged if it can not be parsed.
+func normalizeIP(value string) string {
+	addr, err := parseIP(value)
+	if err != nil {
+		return strings.TrimSpace(value)
+	}
+	return addr.String()
+}
+
+// nonScriptingAgents are lower-cased user-agent fragments of clients with a Mozilla-like user-agent,
+// that do not run JavaScript: text browsers, crawlers and command line tools.
+var nonScriptingAgents = []string{"lynx", "w3m", "links", "bot", "crawler", "spider", "curl", "wget"}
+
+// runsScripts reports whether the client is likely a browser running JavaScript, and thus the Rybbit client script.
+func runsScripts(req *http.Request) bool {
+	userAgent := req.UserAgent()
+	if !strings.HasPrefix(userAgent, "Mozilla/") {
+		return false
+	}
+
+	userAgent = strings.ToLower(userAgent)
+	for _, agent := range nonScriptingAgents {
+		if strings.Contains(userAgent, agent) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestScheme returns the scheme the client used, `http` or `https`, taken from the first X-Forwarded-Proto
+// if Traefik is behind another proxy.
+func requestScheme(req *http.Request) string {
+	if proto := req.Header.Get("X-Forwarded-Proto"); proto != "" {
+		proto, _, _ = strings.Cut(proto, ",")
+		switch strings.ToLower(strings.TrimSpace(proto)) {
+		case "https", "wss":
+			return "https"
+		case "http", "ws":
+			return "http"
+		}
+	}
+
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// clientIP returns the IP address of the client. With trustedProxies, it is taken from the X-Forwarded-For chain,
+// otherwise from the well-known headers of proxies and CDNs.
+func (h *UmamiFeeder) clientIP(req *http.Request) string {
+	if len(h.trustedProxies) > 0 {
+		return forwardedIP(req, h.trustedProxies)
+	}
+	return extractRemoteIP(req)
+}
+
+// forwardedIP returns the first hop of the X-Forwarded-For chain, read from the right, that is not one of the
+// trusted proxies. The header is ignored for requests not coming from a trusted proxy, as clients can set it freely.
+func forwardedIP(req *http.Request, trustedProxies []netip.Prefix) string {
+	remote, err := parseIP(req.RemoteAddr)
+	if err != nil || !containsIP(trustedProxies, remote) {
+		return normalizeIP(req.RemoteAddr)
+	}
+
+	hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := parseIP(hops[i])
+		if err != nil {
+			// Anything left of an invalid hop can not be trusted either.
+			break
+		}
+		client = addr
+		if !containsIP(trustedProxies, addr) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// containsIP reports whether any of the prefixes contains ip.
+func containsIP(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestProtocol returns the HTTP version of the request, `HTTP/1.0`, `HTTP/1.1`, `HTTP/2` or `HTTP/3`.
+// If altUsed is set, requests with an Alt-Used header, sent by clients using an alternative service, are
+// considered HTTP/3, the protocol alternative services are commonly advertised for.
+func requestProtocol(req *http.Request, altUsed bool) string {
+	switch {
+	case req.ProtoMajor == 3 || altUsed && req.Header.Get("Alt-Used") != "":
+		return "HTTP/3"
+	case req.ProtoMajor == 2:
+		return "HTTP/2"
+	case req.ProtoMajor == 1 && req.ProtoMinor == 0:
+		return "HTTP/1.0"
+	}
+	return "HTTP/1.1"
 }
 
 func extractRemoteIP(req *http.Request) string {
 	if ip := req.Header.Get("CF-Connecting-IP"); ip != "" {
-		return ip
+		return normalizeIP(ip)
 	}
 
 	if ip := req.Header.Get("x-vercel-ip"); ip != "" {
-		return ip
+		return normalizeIP(ip)
 	}
 
 	// Standard proxy headers
 	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
 		ips := strings.Split(xff, ",")
 		if len(ips) > 0 {
-			return strings.TrimSpace(ips[0])
+			return normalizeIP(ips[0])
 		}
 	}
 
 	if xrip := req.Header.Get("X-Real-IP"); xrip != "" {
-		return xrip
+		return normalizeIP(xrip)
 	}
 
 	// Direct connection
 	if req.RemoteAddr != "" {
 		ip, _, err := net.SplitHostPort(req.RemoteAddr)
 		if err == nil {
-			return ip
+			return normalizeIP(ip)
 		}
-		return req.RemoteAddr
+		return normalizeIP(req.RemoteAddr)
 	}
 
 	return ""
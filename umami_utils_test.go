@@ -0,0 +1,376 @@
+package traefik_rybbit_feeder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseDomainFromHost(t *testing.T) {
+	tests := map[string]string{
+		"":                  "",
+		"example.com":       "example.com",
+		"Example.COM":       "example.com",
+		"example.com.":      "example.com",
+		"example.com:8443":  "example.com",
+		"example.com.:8443": "example.com",
+		"example.com:":      "example.com",
+		"127.0.0.1:80":      "127.0.0.1",
+		"[::1]":             "::1",
+		"[::1]:8443":        "::1",
+		"[2001:DB8::1]:443": "2001:db8::1",
+		"2001:db8::1":       "2001:db8::1",
+		"XN--MNCHEN-3YA.de": "münchen.de",
+		"münchen.de:443":    "münchen.de",
+	}
+
+	for host, expected := range tests {
+		if actual := parseDomainFromHost(host); actual != expected {
+			t.Errorf("expected %q for %q, got %q", expected, host, actual)
+		}
+	}
+}
+
+func TestParseAcceptLanguage(t *testing.T) {
+	tests := map[string]string{
+		"":                                   "",
+		"*":                                  "",
+		"de-CH":                              "de-CH",
+		"en-US,en;q=0.9":                     "en-US",
+		"fr-CH, fr;q=0.9, en;q=0.8, *;q=0.5": "fr-CH",
+	}
+
+	for header, expected := range tests {
+		if actual := parseAcceptLanguage(header); actual != expected {
+			t.Errorf("expected %q for %q, got %q", expected, header, actual)
+		}
+	}
+}
+
+func FuzzParseAcceptLanguage(f *testing.F) {
+	f.Add("en-US,en;q=0.9")
+	f.Add("*;q=0.5")
+	f.Add(";;;,,,q=")
+
+	f.Fuzz(func(t *testing.T, header string) {
+		language := parseAcceptLanguage(header)
+		if len(language) > maxAcceptLanguageLength {
+			t.Fatalf("language %q exceeds %d bytes", language, maxAcceptLanguageLength)
+		}
+	})
+}
+
+func FuzzParseDomainFromHost(f *testing.F) {
+	f.Add("example.com:8443")
+	f.Add("[::1]:443")
+	f.Add("[")
+	f.Add("]:")
+	f.Add(":::")
+	f.Add("..")
+
+	f.Fuzz(func(t *testing.T, host string) {
+		domain := parseDomainFromHost(host)
+		if strings.HasSuffix(domain, ".") {
+			t.Fatalf("domain %q of %q has a trailing dot", domain, host)
+		}
+		if domain != strings.ToLower(domain) {
+			t.Fatalf("domain %q of %q is not lower-cased", domain, host)
+		}
+	})
+}
+
+func FuzzExtractRemoteIP(f *testing.F) {
+	f.Add("10.0.0.1:1234", "1.1.1.1, 2.2.2.2")
+	f.Add("[::1]:443", "[2001:db8::1]:80")
+	f.Add("", ",,,")
+	f.Add("[", "]")
+
+	f.Fuzz(func(t *testing.T, remoteAddr string, forwardedFor string) {
+		req := &http.Request{RemoteAddr: remoteAddr, Header: http.Header{}}
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+
+		ip := extractRemoteIP(req)
+		if addr, err := parseIP(ip); err == nil && !addr.IsValid() {
+			t.Fatalf("invalid address parsed from %q", ip)
+		}
+	})
+}
+
+func TestSendRequestJSONBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.ContentLength <= 0 || req.Header.Get("Content-Type") != "application/json" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = io.Copy(rw, req.Body)
+	}))
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		var echoed RybbitEvent
+		sent := &RybbitEvent{SiteID: "1", Type: "pageview", Pathname: "/page/" + strconv.Itoa(i)}
+
+		err := sendRequestAndParse(context.Background(), server.Client(), server.URL, sent, http.Header{}, &echoed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if echoed != *sent {
+			t.Fatalf("expected %+v, got %+v", *sent, echoed)
+		}
+	}
+}
+
+func TestNewBatchBody(t *testing.T) {
+	batch := []*SendBody{
+		{Payload: &RybbitEvent{SiteID: "1", Type: "pageview", Pathname: "/"}},
+		{Payload: &RybbitEvent{SiteID: "1", Type: "pageview", Pathname: "/about"}},
+	}
+
+	body := newBatchBody(batch)
+	defer body.release()
+
+	var decoded []RybbitEvent
+	if err := json.NewDecoder(body).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded) != 2 || decoded[0] != *batch[0].Payload || decoded[1] != *batch[1].Payload {
+		t.Fatalf("unexpected batch %+v", decoded)
+	}
+}
+
+func TestNewBatchBodyEmpty(t *testing.T) {
+	body := newBatchBody(nil)
+	encoded, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(encoded) != "[]" {
+		t.Fatalf("expected empty array, got %q", encoded)
+	}
+}
+
+func TestNewHTTPClient(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MaxIdleConns = 10
+	cfg.MaxConnsPerHost = 20
+	cfg.DisableHTTP2 = true
+
+	transport := newHTTPClient(cfg).Transport.(*http.Transport)
+	if transport.MaxIdleConns != 10 || transport.MaxIdleConnsPerHost != 10 || transport.MaxConnsPerHost != 20 {
+		t.Fatalf("unexpected connection limits %d/%d/%d",
+			transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.MaxConnsPerHost)
+	}
+	if transport.ForceAttemptHTTP2 || transport.TLSNextProto == nil {
+		t.Fatal("expected HTTP/2 to be disabled")
+	}
+}
+
+func TestNormalizeAPIPath(t *testing.T) {
+	tests := map[string]string{
+		"/api/users":            "/api/users",
+		"/api/users/42":         "/api/users/:id",
+		"/api/users/42/posts/7": "/api/users/:id/posts/:id",
+		"/api/orders/3f2b8c4e-9d1a-4b6e-8f0a-2c7d5e9b1a3f": "/api/orders/:id",
+		"/api/objects/507f1f77bcf86cd799439011/":           "/api/objects/:id/",
+		"/api/v2/feed":                                     "/api/v2/feed",
+		"/api/cafe":                                        "/api/cafe",
+	}
+
+	for path, expected := range tests {
+		if actual := normalizeAPIPath(path); actual != expected {
+			t.Errorf("expected %q for %q, got %q", expected, path, actual)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		value     string
+		maxLength int
+		expected  string
+	}{
+		{"short", 10, "short"},
+		{"exactly10!", 10, "exactly10!"},
+		{"much too long", 10, "much to…"},
+		{"unlimited", 0, "unlimited"},
+		{"grüße aus köln", 8, "grü…"},
+	}
+	for _, test := range tests {
+		if got := truncate(test.value, test.maxLength); got != test.expected {
+			t.Errorf("truncate(%q, %d) = %q, expected %q", test.value, test.maxLength, got, test.expected)
+		}
+		if got := truncate(test.value, test.maxLength); test.maxLength > 0 && len(got) > test.maxLength {
+			t.Errorf("truncate(%q, %d) returned %d bytes", test.value, test.maxLength, len(got))
+		}
+	}
+}
+
+func TestRequestScheme(t *testing.T) {
+	tests := map[string]string{
+		"":            "http",
+		"https":       "https",
+		"HTTPS, http": "https",
+		"http":        "http",
+		"wss":         "https",
+		"gopher":      "http",
+	}
+	for proto, expected := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+		if proto != "" {
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+		if got := requestScheme(req); got != expected {
+			t.Errorf("requestScheme(%q) = %s, expected %s", proto, got, expected)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "https://localhost/", nil)
+	if got := requestScheme(req); got != "https" {
+		t.Errorf("expected https for a TLS request, got %s", got)
+	}
+}
+
+func TestForwardedIP(t *testing.T) {
+	trustedProxies := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")}
+
+	tests := []struct {
+		remoteAddr   string
+		forwardedFor string
+		expected     string
+	}{
+		{remoteAddr: "1.2.3.4:1234", forwardedFor: "5.6.7.8", expected: "1.2.3.4"},
+		{remoteAddr: "10.0.0.1:1234", forwardedFor: "", expected: "10.0.0.1"},
+		{remoteAddr: "10.0.0.1:1234", forwardedFor: "5.6.7.8", expected: "5.6.7.8"},
+		{remoteAddr: "10.0.0.1:1234", forwardedFor: "9.9.9.9, 5.6.7.8, 10.0.0.2", expected: "5.6.7.8"},
+		{remoteAddr: "10.0.0.1:1234", forwardedFor: "10.0.0.3, 10.0.0.2", expected: "10.0.0.3"},
+		{remoteAddr: "10.0.0.1:1234", forwardedFor: "5.6.7.8, garbage, 10.0.0.2", expected: "10.0.0.2"},
+		{remoteAddr: "[2001:db8::1]:443", forwardedFor: "2a00:1450::1", expected: "2a00:1450::1"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		}
+		if got := forwardedIP(req, trustedProxies); got != tt.expected {
+			t.Errorf("forwardedIP(%s, %q) = %s, expected %s", tt.remoteAddr, tt.forwardedFor, got, tt.expected)
+		}
+	}
+}
+
+func TestHashIP(t *testing.T) {
+	hashed := hashIP("salt", "203.0.113.42")
+	addr, err := netip.ParseAddr(hashed)
+	if err != nil || !netip.MustParsePrefix("fd00::/8").Contains(addr) {
+		t.Fatalf("expected a unique local address, got %s", hashed)
+	}
+
+	if hashIP("salt", "203.0.113.42:1234") != hashed {
+		t.Error("expected the same hash regardless of the port")
+	}
+	if hashIP("other", "203.0.113.42") == hashed || hashIP("salt", "203.0.113.43") == hashed {
+		t.Error("expected another hash for another salt or address")
+	}
+	if hashIP("salt", "unknown") != "" {
+		t.Error("expected no hash for an invalid address")
+	}
+}
+
+func TestRequestProtocol(t *testing.T) {
+	tests := []struct {
+		major, minor int
+		altUsed      string
+		heuristic    bool
+		expected     string
+	}{
+		{major: 1, minor: 0, expected: "HTTP/1.0"},
+		{major: 1, minor: 1, expected: "HTTP/1.1"},
+		{major: 2, expected: "HTTP/2"},
+		{major: 3, expected: "HTTP/3"},
+		{major: 2, altUsed: "example.com:443", expected: "HTTP/2"},
+		{major: 1, minor: 1, altUsed: "example.com:443", heuristic: true, expected: "HTTP/3"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+		req.ProtoMajor, req.ProtoMinor = tt.major, tt.minor
+		if tt.altUsed != "" {
+			req.Header.Set("Alt-Used", tt.altUsed)
+		}
+		if got := requestProtocol(req, tt.heuristic); got != tt.expected {
+			t.Errorf("requestProtocol(%d.%d, %q) = %s, expected %s", tt.major, tt.minor, tt.altUsed, got, tt.expected)
+		}
+	}
+}
+
+func TestRequestFingerprint(t *testing.T) {
+	newRequest := func(headers map[string]string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		return req
+	}
+
+	browser := map[string]string{"User-Agent": "Mozilla/5.0", "Accept": "text/html", "Accept-Language": "en-US", "Cookie": "a=1"}
+	fingerprint := requestFingerprint(newRequest(browser))
+	if len(fingerprint) != 16 {
+		t.Fatalf("expected a 16 character hash, got %q", fingerprint)
+	}
+
+	// The values of other headers, e.g. a rotating user-agent, do not matter.
+	browser["User-Agent"], browser["Cookie"] = "Mozilla/5.0 (rotated)", "a=2"
+	if requestFingerprint(newRequest(browser)) != fingerprint {
+		t.Error("expected the same fingerprint for other user-agent and cookie values")
+	}
+
+	browser["Accept"] = "*/*"
+	if requestFingerprint(newRequest(browser)) == fingerprint {
+		t.Error("expected another fingerprint for another Accept value")
+	}
+
+	delete(browser, "Cookie")
+	browser["Accept"] = "text/html"
+	if requestFingerprint(newRequest(browser)) == fingerprint {
+		t.Error("expected another fingerprint for other header names")
+	}
+}
+
+func TestParseServerTiming(t *testing.T) {
+	values := []string{
+		`db;dur=53, app;dur=47.2, cache;desc="Cache Read, fast";dur=23.2`,
+		`Render;dur="12", miss, total;dur=invalid`,
+	}
+
+	durations := parseServerTiming(values, []string{"db", "cache", "render", "miss", "total"})
+	expected := map[string]float64{"db": 53, "cache": 23.2, "render": 12}
+	if len(durations) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, durations)
+	}
+	for name, duration := range expected {
+		if durations[name] != duration {
+			t.Errorf("expected %v for %s, got %v", duration, name, durations[name])
+		}
+	}
+}
+
+func TestNewBatchBodyPanic(t *testing.T) {
+	// A nil envelope panics while encoding.
+	body := newBatchBody([]*SendBody{{Payload: &RybbitEvent{SiteID: "1"}}, nil})
+	_, err := io.ReadAll(body)
+
+	var panicErr *panicError
+	if !errors.As(err, &panicErr) || !body.poisoned.Load() {
+		t.Fatalf("expected the panic to fail the body, got %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package traefik_rybbit_feeder
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// maxCreatedWebsites bounds the websites created by an instance, as the Host header is chosen by clients.
+// createWebsiteTimeout is the time given to Rybbit to create a website, createWebsiteRetry the time before
+// the creation of a website is attempted again after a failure.
+const (
+	maxCreatedWebsites   = 100
+	createWebsiteTimeout = 10 * time.Second
+	createWebsiteRetry   = time.Minute
+)
+
+// createdWebsite is the response of Rybbit to the creation of a website.
+type createdWebsite struct {
+	SiteID any `json:"siteId"`
+}
+
+// createWebsite creates a website for hostname in the organization of the top-level host in the background, and
+// registers its site-id once created. Events of the hostname are not tracked until then.
+func (h *UmamiFeeder) createWebsite(hostname string) {
+	if !isWebsiteDomain(hostname) {
+		h.debug("not creating a website for %s, not a domain", hostname)
+		return
+	}
+
+	h.websitesMutex.Lock()
+	if _, ok := h.pendingWebsites[hostname]; ok {
+		h.websitesMutex.Unlock()
+		return
+	}
+	if failed, ok := h.failedWebsites[hostname]; ok && time.Since(failed) < createWebsiteRetry {
+		h.websitesMutex.Unlock()
+		return
+	}
+	if h.createdWebsites >= maxCreatedWebsites {
+		h.websitesMutex.Unlock()
+		h.debug("not creating a website for %s, %d websites were created already", hostname, maxCreatedWebsites)
+		return
+	}
+	// The slot is reserved before the request, so a burst of hostnames cannot exceed maxCreatedWebsites.
+	if h.pendingWebsites == nil {
+		h.pendingWebsites = map[string]struct{}{}
+	}
+	h.pendingWebsites[hostname] = struct{}{}
+	h.createdWebsites++
+	h.websitesMutex.Unlock()
+
+	go func() {
+		created, err := h.postWebsite(hostname)
+
+		h.websitesMutex.Lock()
+		delete(h.pendingWebsites, hostname)
+		if !created {
+			h.createdWebsites--
+		}
+		if err != nil {
+			if h.failedWebsites == nil {
+				h.failedWebsites = map[string]time.Time{}
+			}
+			h.failedWebsites[hostname] = time.Now()
+		}
+		h.websitesMutex.Unlock()
+
+		if err != nil {
+			h.error("failed to create website " + hostname + ": " + err.Error())
+		}
+	}()
+}
+
+// postWebsite creates a website for hostname and registers its site-id, unless it was registered meanwhile.
+// It reports whether the website was created.
+func (h *UmamiFeeder) postWebsite(hostname string) (bool, error) {
+	if _, ok := h.lookupWebsite(hostname); ok {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), createWebsiteTimeout)
+	defer cancel()
+
+	var created createdWebsite
+	url := fmt.Sprintf("%s/api/organizations/%s/sites", h.host, h.organizationID)
+	body := map[string]any{"domain": hostname, "name": hostname}
+	headers := http.Header{"Authorization": {"Bearer " + h.adminAPIKey}}
+	if err := sendRequestAndParse(ctx, h.client, url, body, headers, &created); err != nil {
+		return false, err
+	}
+
+	websiteId := fmt.Sprint(created.SiteID)
+	if created.SiteID == nil || websiteId == "" {
+		return false, fmt.Errorf("no siteId in the response")
+	}
+
+	h.websitesMutex.Lock()
+	h.websites[hostname] = websiteId
+	delete(h.failedWebsites, hostname)
+	h.websitesMutex.Unlock()
+
+	// Cached decisions depend on the websites.
+	h.decisions.reset()
+	h.debug("created website %s with site-id %s", hostname, websiteId)
+	return true, nil
+}
+
+// isWebsiteDomain reports whether hostname is a domain a website can be created for, not an IP address or
+// a single label such as `localhost`.
+func isWebsiteDomain(hostname string) bool {
+	if _, err := netip.ParseAddr(hostname); err == nil {
+		return false
+	}
+	return strings.Contains(hostname, ".") && !strings.ContainsAny(hostname, "/*^ ")
+}
+
+// organizationSites is the response of Rybbit listing the websites of an organization.
+type organizationSites struct {
+	Sites []struct {
+		SiteID any    `json:"siteId"`
+		Domain string `json:"domain"`
+	} `json:"sites"`
+}
+
+// loadWebsites fetches the websites of the organization from the top-level host, and registers their domains
+// next to the configured websites. Resolved websites which were removed from the organization are dropped.
+func (h *UmamiFeeder) loadWebsites(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, createWebsiteTimeout)
+	defer cancel()
+
+	var sites organizationSites
+	url := fmt.Sprintf("%s/api/organizations/%s/sites", h.host, h.organizationID)
+	headers := http.Header{"Authorization": {"Bearer " + h.adminAPIKey}}
+	if err := sendRequestAndParse(ctx, h.client, url, nil, headers, &sites); err != nil {
+		return err
+	}
+
+	resolved := make(map[string]string, len(sites.Sites))
+	for _, site := range sites.Sites {
+		hostname := parseDomainFromHost(site.Domain)
+		if site.SiteID == nil || hostname == "" {
+			continue
+		}
+		resolved[hostname] = fmt.Sprint(site.SiteID)
+	}
+
+	h.websitesMutex.Lock()
+	for hostname := range h.resolvedWebsites {
+		if _, ok := resolved[hostname]; !ok {
+			delete(h.websites, hostname)
+			delete(h.resolvedWebsites, hostname)
+		}
+	}
+	if h.resolvedWebsites == nil {
+		h.resolvedWebsites = make(map[string]struct{}, len(resolved))
+	}
+	for hostname, websiteId := range resolved {
+		_, wasResolved := h.resolvedWebsites[hostname]
+		if _, ok := h.websites[hostname]; ok && !wasResolved {
+			// Configured or created by this instance.
+			continue
+		}
+		h.websites[hostname] = websiteId
+		h.resolvedWebsites[hostname] = struct{}{}
+	}
+	count := len(h.resolvedWebsites)
+	h.websitesMutex.Unlock()
+
+	// Cached decisions depend on the websites.
+	h.decisions.reset()
+	h.debug("resolved %d website(s) of organization %s", count, h.organizationID)
+	return nil
+}
+
+// refreshWebsites fetches the websites of the organization every resolveInterval, until ctx is canceled.
+// The websites resolved last are kept while Rybbit is unavailable.
+func (h *UmamiFeeder) refreshWebsites(ctx context.Context) {
+	ticker := time.NewTicker(h.resolveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := h.loadWebsites(ctx); err != nil {
+				h.error("failed to refresh websites: " + err.Error())
+			}
+		}
+	}
+}
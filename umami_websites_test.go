@@ -0,0 +1,165 @@
+package traefik_rybbit_feeder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCreateWebsite(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		var body map[string]any
+		_ = json.NewDecoder(req.Body).Decode(&body)
+		if req.URL.Path != "/api/organizations/org-1/sites" || req.Header.Get("Authorization") != "Bearer admin" ||
+			body["domain"] != "new.example.com" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = rw.Write([]byte(`{"siteId":42,"domain":"new.example.com"}`))
+	}))
+	defer server.Close()
+
+	feeder := &UmamiFeeder{
+		host:              server.URL,
+		client:            server.Client(),
+		websites:          map[string]string{},
+		queue:             newEventQueue(queueTypeChannel, 1, 1),
+		createNewWebsites: true,
+		organizationID:    "org-1",
+		adminAPIKey:       "admin",
+	}
+
+	submit := func(host string) {
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://"+host+"/", nil)
+		feeder.submitToFeed(req, responseInfo{status: http.StatusOK})
+	}
+
+	submit("new.example.com")
+	submit("localhost")
+	submit("192.0.2.1")
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if websiteId, ok := feeder.lookupWebsite("new.example.com"); ok {
+			if websiteId != "42" {
+				t.Fatalf("expected site-id 42, got %s", websiteId)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the website to be created")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if requests.Load() != 1 {
+		t.Fatalf("expected a single request creating new.example.com, got %d", requests.Load())
+	}
+
+	submit("new.example.com")
+	if event := feeder.queue.shards[0].pop(); event == nil || event.SiteID != "42" {
+		t.Fatalf("expected an event for the created website, got %+v", event)
+	}
+}
+
+func TestLoadWebsites(t *testing.T) {
+	sites := `{"sites":[{"siteId":1,"domain":"a.example.com"},{"siteId":2,"domain":"b.example.com"}]}`
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet || req.URL.Path != "/api/organizations/org-1/sites" ||
+			req.Header.Get("Authorization") != "Bearer admin" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = rw.Write([]byte(sites))
+	}))
+	defer server.Close()
+
+	feeder := &UmamiFeeder{
+		host:            server.URL,
+		client:          server.Client(),
+		websites:        map[string]string{"b.example.com": "configured"},
+		resolveWebsites: true,
+		organizationID:  "org-1",
+		adminAPIKey:     "admin",
+	}
+
+	if err := feeder.loadWebsites(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if websiteId, _ := feeder.lookupWebsite("a.example.com"); websiteId != "1" {
+		t.Errorf("expected a.example.com to be resolved to 1, got %q", websiteId)
+	}
+	if websiteId, _ := feeder.lookupWebsite("b.example.com"); websiteId != "configured" {
+		t.Errorf("expected the configured website to take precedence, got %q", websiteId)
+	}
+
+	sites = `{"sites":[{"siteId":3,"domain":"c.example.com"}]}`
+	if err := feeder.loadWebsites(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := feeder.lookupWebsite("a.example.com"); ok {
+		t.Error("expected the removed website to be dropped")
+	}
+	if websiteId, _ := feeder.lookupWebsite("c.example.com"); websiteId != "3" {
+		t.Errorf("expected the added website to be resolved, got %q", websiteId)
+	}
+	if _, ok := feeder.lookupWebsite("b.example.com"); !ok {
+		t.Error("expected the configured website to be kept")
+	}
+}
+
+func TestCreateWebsiteLimit(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		<-release
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	feeder := &UmamiFeeder{
+		host:           server.URL,
+		client:         server.Client(),
+		websites:       map[string]string{},
+		organizationID: "org-1",
+		adminAPIKey:    "admin",
+	}
+
+	// A burst of hostnames arrives while the first creations are still pending.
+	for i := 0; i < maxCreatedWebsites+10; i++ {
+		feeder.createWebsite(fmt.Sprintf("site-%d.example.com", i))
+	}
+	feeder.createWebsite("site-0.example.com")
+
+	deadline := time.Now().Add(time.Second)
+	for requests.Load() < maxCreatedWebsites && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+	if requests.Load() != maxCreatedWebsites {
+		t.Fatalf("expected %d websites to be created, got %d", maxCreatedWebsites, requests.Load())
+	}
+
+	// Failed creations release their slot.
+	deadline = time.Now().Add(time.Second)
+	for {
+		feeder.websitesMutex.RLock()
+		created := feeder.createdWebsites
+		feeder.websitesMutex.RUnlock()
+		if created == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the failed creations to release their slot, got %d", created)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
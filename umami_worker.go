@@ -2,16 +2,36 @@ package traefik_rybbit_feeder
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// shutdownFlushTimeout is the time given to submit the remaining batch once the worker is canceled.
+const shutdownFlushTimeout = 5 * time.Second
+
+// Event types supported by the Rybbit track API.
+const (
+	eventTypePageview = "pageview"
+	eventTypeCustom   = "custom_event"
+)
+
+// RybbitEvent is the payload of the Rybbit track API. Custom events carry an EventName,
+// Properties is a JSON-encoded object for both types.
 type RybbitEvent struct {
 	SiteID     string `json:"site_id"`
 	Type       string `json:"type"`
 	Pathname   string `json:"pathname"`
+	Query      string `json:"querystring,omitempty"`
 	Hostname   string `json:"hostname,omitempty"`
 	IP         string `json:"ip_address,omitempty"`
 	UserAgent  string `json:"user_agent,omitempty"`
@@ -21,107 +41,957 @@ type RybbitEvent struct {
 	Properties string `json:"properties,omitempty"`
 }
 
+// The optional fields of events, which can be excluded by SendFields.
+const (
+	fieldIP         = "ip"
+	fieldUserAgent  = "user_agent"
+	fieldLanguage   = "language"
+	fieldReferrer   = "referrer"
+	fieldProperties = "properties"
+)
+
+// stripFields clears the fields of the event excluded by SendFields, the IP is never set if excluded.
+func (h *UmamiFeeder) stripFields(event *RybbitEvent) {
+	if h.omitUserAgent {
+		event.UserAgent = ""
+	}
+	if h.omitLanguage {
+		event.Language = ""
+	}
+	if h.omitReferrer {
+		event.Referrer = ""
+	}
+	if h.omitProperties {
+		event.Properties = ""
+	}
+}
+
 type SendBody struct {
 	Payload *RybbitEvent `json:"payload"`
 	Type    string       `json:"type"`
 	ApiKey  string
+
+	reported bool // submitted or dropped by reportEventsToUmami, so it is not requeued after a panic
+}
+
+// Events and their envelopes are allocated for every tracked request, pool them to reduce the garbage produced.
+var (
+	eventPool    = sync.Pool{New: func() any { return new(RybbitEvent) }}
+	sendBodyPool = sync.Pool{New: func() any { return new(SendBody) }}
+)
+
+func acquireEvent() *RybbitEvent {
+	return eventPool.Get().(*RybbitEvent)
+}
+
+func releaseEvent(event *RybbitEvent) {
+	*event = RybbitEvent{}
+	eventPool.Put(event)
+}
+
+func acquireSendBody() *SendBody {
+	return sendBodyPool.Get().(*SendBody)
 }
 
-func (h *UmamiFeeder) submitToFeed(req *http.Request, code int) {
+// releaseBatch returns the envelopes of a reported batch and their events to the pools.
+func releaseBatch(batch []*SendBody) {
+	for i, value := range batch {
+		releaseEvent(value.Payload)
+		*value = SendBody{}
+		sendBodyPool.Put(value)
+		batch[i] = nil
+	}
+}
+
+// submitToFeed enqueues the events for the completed request. It returns their summary if requests are captured,
+// see summarizeEvents.
+func (h *UmamiFeeder) submitToFeed(req *http.Request, resp responseInfo) (payload string) {
 	hostname := parseDomainFromHost(req.Host)
-	websiteId, ok := h.websites[hostname]
+	websiteId, ok := h.lookupWebsite(hostname)
 
+	if !ok && h.createNewWebsites {
+		h.createWebsite(hostname)
+		return ""
+	}
 	if !ok {
 		h.error("tracking skipped, site-id is unknown: " + hostname)
-		return
+		return ""
+	}
+
+	if h.canaryPercent > 0 && rand.Intn(100) < h.canaryPercent {
+		websiteId = h.canarySiteID
+	}
+
+	// In rollup mode the request is only counted, see flushRollup. Counting is cheap, so it is never sampled.
+	if h.rollup != nil {
+		aborted := req.Context().Err() != nil && h.abortedRequests == abortedIgnore
+		if !resp.skipPageview && !aborted {
+			h.rollup.add(rollupKey{
+				siteID:   websiteId,
+				hostname: strings.Clone(hostname),
+				path:     strings.Clone(h.reportedPath(req.URL.Path)),
+				status:   resp.status,
+			}, 1)
+		}
+		return ""
 	}
 
-	rEvent := &RybbitEvent{
+	properties := h.commonProperties(req, resp)
+
+	// Under load shedding only 1 in sampleRate events is kept, the rate is reported so counts can be corrected.
+	if sampleRate := h.sampleRate.Load(); sampleRate > 1 {
+		if h.sampleCounter.Add(1)%sampleRate != 0 {
+			return ""
+		}
+		properties["sample_rate"] = sampleRate
+	}
+
+	// The client disconnected before the response was written.
+	if req.Context().Err() != nil {
+		switch h.abortedRequests {
+		case abortedIgnore:
+			h.debug("ignoring aborted request %s", req.URL.Path)
+			return ""
+		case abortedTag:
+			properties["aborted"] = true
+		}
+	}
+
+	// Events wait in the queue for a while, copy the strings so they don't pin the memory of the request.
+	rEvent := acquireEvent()
+	*rEvent = RybbitEvent{
 		SiteID:    websiteId,
-		Type:      "pageview",
-		Pathname:  req.URL.Path,
-		Hostname:  hostname,
-		IP:        extractRemoteIP(req),
-		UserAgent: req.Header.Get("User-Agent"),
-		Referrer:  req.Referer(),
-		Language:  parseAcceptLanguage(req.Header.Get("Accept-Language")),
-	}
-
-	select {
-	case h.queue <- rEvent:
-	default:
+		Type:      eventTypePageview,
+		Pathname:  strings.Clone(h.reportedPath(req.URL.Path)),
+		Query:     strings.Clone(truncate(h.querystring(req), h.maxPathLength)),
+		Hostname:  strings.Clone(hostname),
+		IP:        strings.Clone(h.eventIP(req)),
+		UserAgent: strings.Clone(truncate(req.Header.Get("User-Agent"), h.maxUserAgentLength)),
+		Referrer:  strings.Clone(truncate(req.Referer(), h.maxReferrerLength)),
+		Language:  strings.Clone(h.language(req)),
+	}
+
+	if h.isAPIRequest(req.URL.Path) {
+		rEvent.Type = eventTypeCustom
+		rEvent.EventName = req.Method + " " + normalizeAPIPath(req.URL.Path)
+		properties["status"] = resp.status
+		properties["latency_ms"] = resp.duration.Milliseconds()
+	}
+
+	if rule := h.pathEvent(req); rule != nil {
+		rEvent.Type = eventTypeCustom
+		rEvent.EventName = rule.Name
+		for name, value := range rule.Properties {
+			properties[name] = value
+		}
+	}
+
+	// Tracked errors are told apart from the pages they were returned for.
+	if h.errorEvent != "" && resp.status >= 400 && rEvent.Type == eventTypePageview {
+		rEvent.Type = eventTypeCustom
+		rEvent.EventName = h.errorEvent
+		properties["path"] = rEvent.Pathname
+		properties["status"] = resp.status
+	}
+
+	searchTerm := h.searchTerm(req)
+	if searchTerm != "" {
+		properties["search_term"] = searchTerm
+	}
+
+	// Copied before enqueueing, the worker may release rEvent as soon as it is in the queue.
+	var searchEvent *RybbitEvent
+	if searchTerm != "" && h.searchEvents {
+		searchProperties := h.commonProperties(req, resp)
+		searchProperties["search_term"] = searchTerm
+		searchEvent = h.newCustomEvent(rEvent, "site_search", searchProperties)
+	}
+
+	conversionEvent := h.conversionEvent(req, resp, rEvent)
+	statusEvent := h.statusEvent(req, resp, rEvent)
+
+	if resp.skipPageview {
+		releaseEvent(rEvent)
+		rEvent = nil
+	} else {
+		rEvent.Properties = h.encodeProperties(properties)
+	}
+	// Summarized before enqueueing, the worker may release the events as soon as they are in the queue.
+	if h.captures != nil {
+		payload = summarizeEvents(rEvent, searchEvent, conversionEvent, statusEvent)
+	}
+
+	if rEvent != nil {
+		h.enqueue(rEvent)
+	}
+
+	if searchEvent != nil {
+		h.enqueue(searchEvent)
+	}
+	if conversionEvent != nil {
+		h.enqueue(conversionEvent)
+	}
+	if statusEvent != nil {
+		h.enqueue(statusEvent)
+	}
+	return payload
+}
+
+// newCustomEvent creates a custom event named name for the request of pageview, sharing its site, visitor and path.
+func (h *UmamiFeeder) newCustomEvent(pageview *RybbitEvent, name string, properties map[string]any) *RybbitEvent {
+	event := acquireEvent()
+	*event = *pageview
+	event.Type = eventTypeCustom
+	event.EventName = name
+	event.Properties = h.encodeProperties(properties)
+	return event
+}
+
+// statusEvent returns the custom event statusEvents map the response status to, or nil if there is none.
+func (h *UmamiFeeder) statusEvent(req *http.Request, resp responseInfo, pageview *RybbitEvent) *RybbitEvent {
+	eventName, ok := h.statusEvents[resp.status]
+	if !ok {
+		return nil
+	}
+
+	properties := h.commonProperties(req, resp)
+	if pageview.IP != "" {
+		properties["ip"] = pageview.IP
+	}
+	properties["path"] = pageview.Pathname
+	properties["status"] = resp.status
+
+	return h.newCustomEvent(pageview, eventName, properties)
+}
+
+// conversionEvent returns a custom event based on pageview for the first conversionRules matching the request,
+// or nil if none matches.
+func (h *UmamiFeeder) conversionEvent(req *http.Request, resp responseInfo, pageview *RybbitEvent) *RybbitEvent {
+	for _, rule := range h.conversionRules {
+		if rule.Method != "" && !strings.EqualFold(rule.Method, req.Method) {
+			continue
+		}
+		if rule.Status != 0 && rule.Status != resp.status || rule.Status == 0 && (resp.status < 200 || resp.status >= 300) {
+			continue
+		}
+		if !rule.path.MatchString(req.URL.Path) {
+			continue
+		}
+
+		properties := h.commonProperties(req, resp)
+		if rule.AmountHeader != "" && resp.header != nil {
+			if amount, err := strconv.ParseFloat(resp.header.Get(rule.AmountHeader), 64); err == nil {
+				properties["amount"] = amount
+			}
+		}
+		if rule.Currency != "" {
+			properties["currency"] = rule.Currency
+		}
+
+		return h.newCustomEvent(pageview, rule.Name, properties)
+	}
+
+	return nil
+}
+
+// pathEvent returns the first of the events matching the request, or nil if there is none.
+func (h *UmamiFeeder) pathEvent(req *http.Request) *pathEventRule {
+	for i, rule := range h.pathEvents {
+		if rule.Method != "" && !strings.EqualFold(rule.Method, req.Method) {
+			continue
+		}
+		if rule.path.MatchString(req.URL.Path) {
+			return &h.pathEvents[i]
+		}
+	}
+	return nil
+}
+
+// isEventPath reports whether the path matches any of the events, regardless of their method.
+func (h *UmamiFeeder) isEventPath(path string) bool {
+	for _, rule := range h.pathEvents {
+		if rule.path.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// clickIDParams are the query parameters ad networks append to identify a click.
+var clickIDParams = []string{"gclid", "fbclid", "msclkid", "ttclid"}
+
+// utmParams are the query parameters of UTM campaign links.
+var utmParams = []string{"utm_source", "utm_medium", "utm_campaign", "utm_term", "utm_content"}
+
+// commonProperties returns the properties attached to every event of the request.
+func (h *UmamiFeeder) commonProperties(req *http.Request, resp responseInfo) map[string]any {
+	properties := map[string]any{}
+
+	if h.dedup == dedupTag {
+		properties["source"] = "server"
+	}
+
+	if h.statusClass {
+		properties["status_class"] = statusClass(resp.status)
+	}
+
+	if h.trackMiddleware {
+		properties["middleware"] = h.name
+	}
+
+	if h.trackScheme {
+		properties["scheme"] = requestScheme(req)
+	}
+
+	if h.trackProtocol {
+		properties["protocol"] = requestProtocol(req, h.protocolAltUsed)
+	}
+
+	if h.trackFingerprint {
+		properties["fingerprint"] = requestFingerprint(req)
+	}
+
+	if variant := h.variant(req); variant != "" {
+		properties["variant"] = variant
+	}
+
+	if h.identityHeader != "" {
+		if identity := strings.TrimSpace(req.Header.Get(h.identityHeader)); identity != "" {
+			properties["identity"] = hashIdentity(h.identitySalt, strings.ToLower(identity))
+		}
+	}
+
+	if h.groupsHeader != "" {
+		if groups := strings.TrimSpace(req.Header.Get(h.groupsHeader)); groups != "" {
+			properties["groups"] = strings.Clone(groups)
+		}
+	}
+
+	if h.eventIDHeader != "" {
+		if eventID := req.Header.Get(h.eventIDHeader); eventID != "" {
+			properties["event_id"] = strings.Clone(eventID)
+		}
+	}
+
+	if len(h.serverTiming) > 0 && resp.header != nil {
+		for name, duration := range parseServerTiming(resp.header.Values("Server-Timing"), h.serverTiming) {
+			properties["timing_"+name] = duration
+		}
+	}
+
+	if (h.trackClickIDs || h.trackUTM) && req.URL.RawQuery != "" {
+		query := req.URL.Query()
+		if h.trackClickIDs {
+			for _, name := range clickIDParams {
+				if clickID := query.Get(name); clickID != "" {
+					properties[name] = clickID
+				}
+			}
+		}
+		if h.trackUTM {
+			for _, name := range utmParams {
+				if value := query.Get(name); value != "" {
+					properties[name] = value
+				}
+			}
+		}
+	}
+
+	return properties
+}
+
+// statusClasses are the values of the `status_class` property, by the first digit of the status.
+var statusClasses = [...]string{"", "1xx", "2xx", "3xx", "4xx", "5xx"}
+
+// statusClass returns the class of status, e.g. `4xx` for 404.
+func statusClass(status int) string {
+	if class := status / 100; class > 0 && class < len(statusClasses) {
+		return statusClasses[class]
+	}
+	return strconv.Itoa(status)
+}
+
+// variant returns the experiment variant of the request, taken from variantHeader or else variantCookie.
+func (h *UmamiFeeder) variant(req *http.Request) string {
+	if h.variantHeader != "" {
+		if variant := req.Header.Get(h.variantHeader); variant != "" {
+			return strings.Clone(variant)
+		}
+	}
+
+	if h.variantCookie != "" {
+		if cookie, err := req.Cookie(h.variantCookie); err == nil {
+			return strings.Clone(cookie.Value)
+		}
+	}
+
+	return ""
+}
+
+// eventIP returns the client IP attached to events, hashed or anonymized if hashIP or anonymizeIP are enabled,
+// or nothing if sendIP is disabled.
+func (h *UmamiFeeder) eventIP(req *http.Request) string {
+	if h.omitIP {
+		return ""
+	}
+
+	ip := h.clientIP(req)
+	if h.hashIP {
+		return hashIP(h.currentIPSalt(time.Now()), ip)
+	}
+	if h.anonymizeIP {
+		return anonymizeIP(ip)
+	}
+	return ip
+}
+
+// dailyIPSecret is the random part of the daily salt of hashed IPs, shared by all plugin instances,
+// so a visitor is hashed alike by every router.
+var dailyIPSecret = newSecret()
+
+// currentIPSalt returns the salt of hashed IPs, ipSalt if set, or else a random salt rotated every day.
+func (h *UmamiFeeder) currentIPSalt(now time.Time) string {
+	if h.ipSalt != "" {
+		return h.ipSalt
+	}
+	return dailyIPSecret + now.UTC().Format(time.DateOnly)
+}
+
+// language returns the language of the visitor, taken from languageCookie or else the Accept-Language header.
+func (h *UmamiFeeder) language(req *http.Request) string {
+	if h.languageCookie != "" {
+		if cookie, err := req.Cookie(h.languageCookie); err == nil {
+			// Locales like `de_DE` are common in applications, Rybbit expects language tags.
+			if language := parseAcceptLanguage(strings.ReplaceAll(cookie.Value, "_", "-")); language != "" {
+				return language
+			}
+		}
+	}
+
+	return parseAcceptLanguage(req.Header.Get("Accept-Language"))
+}
+
+// reportedPath returns the path reported with events, rewritten by pathRewrites and truncated to maxPathLength.
+func (h *UmamiFeeder) reportedPath(path string) string {
+	for _, rewrite := range h.pathRewrites {
+		path = rewrite.regex.ReplaceAllString(path, rewrite.replacement)
+	}
+	return truncate(path, h.maxPathLength)
+}
+
+// querystring returns the query string of the request reported with events, including the leading `?`, as
+// configured by queryMode. In the allowlist mode, the allowed parameters are kept in their original order.
+// Click ids captured by trackClickIDs are stripped, they are reported as properties already.
+func (h *UmamiFeeder) querystring(req *http.Request) string {
+	if req.URL.RawQuery == "" || h.queryMode == queryDrop || h.queryMode == "" {
+		return ""
+	}
+	if h.queryMode == queryKeep && !h.trackClickIDs {
+		return "?" + req.URL.RawQuery
+	}
+
+	var kept []string
+	for _, param := range strings.Split(req.URL.RawQuery, "&") {
+		name, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if h.trackClickIDs && isClickID(name) {
+			continue
+		}
+		if h.queryMode == queryKeep || h.queryAllowed(name) {
+			kept = append(kept, param)
+		}
+	}
+	if len(kept) == 0 {
+		return ""
+	}
+	return "?" + strings.Join(kept, "&")
+}
+
+// isClickID reports whether the query parameter name is one of clickIDParams.
+func isClickID(name string) bool {
+	for _, clickID := range clickIDParams {
+		if name == clickID {
+			return true
+		}
+	}
+	return false
+}
+
+// queryAllowed reports whether the query parameter name is in queryAllowlist.
+func (h *UmamiFeeder) queryAllowed(name string) bool {
+	for _, allowed := range h.queryAllowlist {
+		if prefix, ok := strings.CutSuffix(allowed, "*"); ok && strings.HasPrefix(name, prefix) || allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// searchTerm returns the value of the first searchParamNames query parameter present in the request.
+func (h *UmamiFeeder) searchTerm(req *http.Request) string {
+	if len(h.searchParamNames) == 0 || req.URL.RawQuery == "" {
+		return ""
+	}
+
+	query := req.URL.Query()
+	for _, name := range h.searchParamNames {
+		if term := strings.TrimSpace(query.Get(name)); term != "" {
+			return term
+		}
+	}
+	return ""
+}
+
+// encodeProperties returns properties as the JSON string expected by Rybbit, or an empty string if there are none.
+// Properties exceeding maxPropertiesLength are replaced by an indicator, cutting the JSON would make it invalid.
+func (h *UmamiFeeder) encodeProperties(properties map[string]any) string {
+	if len(properties) == 0 {
+		return ""
+	}
+
+	encoded, err := json.Marshal(properties)
+	if err != nil {
+		h.error("failed to encode properties: " + err.Error())
+		return ""
+	}
+	if h.maxPropertiesLength > 0 && len(encoded) > h.maxPropertiesLength {
+		h.debug("truncating properties of %d bytes", len(encoded))
+		return `{"truncated":true}`
+	}
+	return string(encoded)
+}
+
+// enqueue adds the event to the queue, or returns it to the pool if the queue is full.
+func (h *UmamiFeeder) enqueue(event *RybbitEvent) {
+	h.stripFields(event)
+	queue := h.queueFor(event.Hostname)
+	if !queue.push(event) {
+		releaseEvent(event)
+		queue.dropped.Add(1)
 		h.error("failed to submit event: queue full")
 	}
 }
 
-func (h *UmamiFeeder) startWorker(ctx context.Context) {
+// Load shedding thresholds, relative to the queue capacity, and the highest sample rate applied.
+const (
+	sheddingHighWatermark = 0.9
+	sheddingLowWatermark  = 0.5
+	maxSampleRate         = 64
+)
+
+// adjustSampling doubles the sample rate every scaleInterval while the queue stays saturated
+// and halves it again once the queue drained, until all events are kept again.
+func (h *UmamiFeeder) adjustSampling(ctx context.Context) {
+	ticker := time.NewTicker(scaleInterval)
+	defer ticker.Stop()
+
 	for {
-		err := h.umamiEventFeeder(ctx)
-		if err != nil {
-			h.error("worker failed: " + err.Error())
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			// The fullest tenant queue decides.
+			fill := h.queueFill()
+			sampleRate := h.sampleRate.Load()
+
+			switch {
+			case fill >= sheddingHighWatermark && sampleRate < maxSampleRate:
+				sampleRate *= 2
+			case fill < sheddingLowWatermark && sampleRate > 1:
+				sampleRate /= 2
+			default:
+				continue
+			}
+
+			h.sampleRate.Store(sampleRate)
+			h.debug("queue at %.0f%%, sampling 1 in %d events", fill*100, sampleRate)
+		}
+	}
+}
+
+// Autoscaling of workers, a shard is checked every scaleInterval and scaled once the same condition held scaleChecks times.
+const (
+	scaleInterval = time.Second
+	scaleChecks   = 3
+)
+
+// superviseWorkers runs between minWorkers and maxWorkers workers for the queue shard, depending on its sustained depth
+// checked every interval: a worker is added while the shard is at least half full, and removed again while it is empty.
+func (h *UmamiFeeder) superviseWorkers(ctx context.Context, t *tenant, queue *queueShard, interval time.Duration) {
+	// A worker is retired by closing its channel, the shard is drained only once ctx is canceled.
+	var workers []chan struct{}
+	startWorker := func() {
+		retire := make(chan struct{})
+		workers = append(workers, retire)
+		go h.startWorker(ctx, t, queue, retire)
+	}
+
+	for len(workers) < t.minWorkers {
+		startWorker()
+	}
+
+	if t.maxWorkers <= t.minWorkers {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	filled, empty := 0, 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			depth := queue.len()
+			switch {
+			case depth*2 >= queue.cap():
+				filled, empty = filled+1, 0
+			case depth == 0:
+				filled, empty = 0, empty+1
+			default:
+				filled, empty = 0, 0
+			}
+
+			if filled >= scaleChecks && len(workers) < t.maxWorkers {
+				startWorker()
+				filled = 0
+				h.debug("scaled up to %d workers, queue depth %d", len(workers), depth)
+			} else if empty >= scaleChecks && len(workers) > t.minWorkers {
+				// A retired worker flushes its batch before exiting, its siblings keep consuming the shard.
+				close(workers[len(workers)-1])
+				workers = workers[:len(workers)-1]
+				empty = 0
+				h.debug("scaled down to %d workers", len(workers))
+			}
+		}
+	}
+}
+
+// startWorker consumes the given queue shard until ctx is canceled or retire is closed, restarting the consumer if
+// it fails.
+func (h *UmamiFeeder) startWorker(ctx context.Context, t *tenant, queue *queueShard, retire <-chan struct{}) {
+	const maxRestartDelay = time.Minute
+	restartAttempt := 0
+	for {
+		started := time.Now()
+		err := h.umamiEventFeeder(ctx, t, queue, retire)
+		if err == nil {
+			return
+		}
+		h.error("worker failed: " + err.Error())
+
+		// A worker that ran for a while before failing is not in a restart loop.
+		if time.Since(started) > maxRestartDelay {
+			restartAttempt = 0
+		}
+
+		delay := time.Duration(math.Pow(2, float64(restartAttempt))) * time.Second
+		if delay > maxRestartDelay {
+			delay = maxRestartDelay
 		} else {
+			restartAttempt++
+		}
+		h.debug("restarting worker in %v", delay)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		case <-retire:
 			return
 		}
 	}
 }
 
-func (h *UmamiFeeder) umamiEventFeeder(ctx context.Context) (err error) {
+// umamiEventFeeder batches and submits the events of the queue shard. Once ctx is canceled, the shard is drained;
+// once retire is closed, only the batch of this worker is flushed.
+func (h *UmamiFeeder) umamiEventFeeder(ctx context.Context, t *tenant, queue *queueShard, retire <-chan struct{}) (err error) {
+	batch := make([]*SendBody, 0, t.batchSize)
+
 	defer func() {
 		// Recover from panic.
 		panicVal := recover()
 		if panicVal != nil {
-			h.error("panic: " + fmt.Sprint(panicVal))
+			err = fmt.Errorf("panic: %v", panicVal)
+			h.requeue(t, queue, batch)
 		}
 	}()
 
-	batch := make([]*SendBody, 0, h.batchSize)
-	timeout := time.NewTimer(h.batchMaxWait)
+	timeout := time.NewTimer(t.batchMaxWait)
+	defer timeout.Stop()
+
+	addToBatch := func(event *RybbitEvent) {
+		if h.dropQuarantined(t, event) {
+			return
+		}
+		body := acquireSendBody()
+		body.Payload, body.Type, body.ApiKey = event, "event", t.apiKey
+		batch = append(batch, body)
+		if len(batch) >= t.batchSize {
+			h.reportEventsToUmami(ctx, t, batch)
+			releaseBatch(batch)
+			batch = batch[:0]
+			resetTimer(timeout, t.batchMaxWait)
+		}
+	}
 
 	for {
 		// Wait for event.
 		select {
 		case <-ctx.Done():
 			h.debug("worker shutting down (canceled)")
+			h.drain(ctx, t, queue, batch)
+			return nil
+
+		case <-retire:
+			h.debug("worker retiring")
 			if len(batch) > 0 {
-				h.reportEventsToUmami(ctx, batch)
+				h.reportEventsToUmami(ctx, t, batch)
+				releaseBatch(batch)
+				batch = batch[:0]
 			}
 			return nil
 
-		case event := <-h.queue:
-			batch = append(batch, &SendBody{Payload: event, Type: "event", ApiKey: h.apiKey})
-			if len(batch) >= h.batchSize {
-				h.reportEventsToUmami(ctx, batch)
-				batch = make([]*SendBody, 0, h.batchSize)
-				timeout.Reset(h.batchMaxWait)
+		// Only one of the following two is set, depending on the queue type.
+		case event := <-queue.events:
+			addToBatch(event)
+
+		case <-queue.ready:
+			for event := queue.pop(); event != nil; event = queue.pop() {
+				addToBatch(event)
 			}
 
 		case <-timeout.C:
+			// The channel has been drained by this receive, so the timer can be reset directly.
 			if len(batch) > 0 {
-				h.reportEventsToUmami(ctx, batch)
-				batch = make([]*SendBody, 0, h.batchSize)
+				h.reportEventsToUmami(ctx, t, batch)
+				releaseBatch(batch)
+				batch = batch[:0]
 			}
-			timeout.Reset(h.batchMaxWait)
+			timeout.Reset(t.batchMaxWait)
 		}
 	}
 }
 
-func (h *UmamiFeeder) reportEventsToUmami(ctx context.Context, events []*SendBody) {
-	h.debug("reporting %d events", len(events))
+// drain submits the batch and the events left in the queue shard once the worker is canceled, e.g. as the
+// configuration was reloaded, so events in flight are not discarded. Events not submitted within
+// shutdownFlushTimeout are dropped.
+func (h *UmamiFeeder) drain(ctx context.Context, t *tenant, queue *queueShard, batch []*SendBody) {
+	// ctx is already canceled, flush with a detached context of its own.
+	flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownFlushTimeout)
+	defer cancel()
+
+	for {
+		for len(batch) < t.batchSize {
+			event := queue.pop()
+			if event == nil {
+				break
+			}
+			if h.dropQuarantined(t, event) {
+				continue
+			}
+			body := acquireSendBody()
+			body.Payload, body.Type, body.ApiKey = event, "event", t.apiKey
+			batch = append(batch, body)
+		}
+		if len(batch) == 0 {
+			return
+		}
+
+		if flushCtx.Err() != nil {
+			dropped := len(batch)
+			releaseBatch(batch)
+			for event := queue.pop(); event != nil; event = queue.pop() {
+				releaseEvent(event)
+				dropped++
+			}
+			t.stats.dropped.Add(uint64(dropped))
+			h.error(fmt.Sprintf("failed to submit %d events while shutting down: %v", dropped, flushCtx.Err()))
+			return
+		}
+
+		h.reportEventsToUmami(flushCtx, t, batch)
+		releaseBatch(batch)
+		batch = batch[:0]
+	}
+}
+
+// resetTimer stops and drains t before resetting it, as required by the time.Timer semantics;
+// otherwise a tick that already fired would cause a spurious flush right after the reset.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// requeue puts the events of an unfinished batch back into the queue, so they survive a worker restart.
+// Events already submitted or dropped are not requeued, so they are not sent twice.
+func (h *UmamiFeeder) requeue(t *tenant, queue *queueShard, batch []*SendBody) {
+	dropped := 0
+	for _, value := range batch {
+		if value.reported {
+			continue
+		}
+		if !queue.push(value.Payload) {
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		t.stats.dropped.Add(uint64(dropped))
+		h.error(fmt.Sprintf("failed to requeue %d events: queue full", dropped))
+	}
+}
+
+// markReported marks events as submitted or dropped, see requeue.
+func markReported(events []*SendBody) {
 	for _, value := range events {
-		headers := map[string][]string{
-			"Authorization": {"Bearer " + value.ApiKey},
+		value.reported = true
+	}
+}
+
+// batchRetryInterval is how long events are sent one by one after an instance refused a batch, before batches
+// are tried again, e.g. once the instance was upgraded.
+const batchRetryInterval = time.Hour
+
+// reportEventsToUmami submits events to the Rybbit instance of the tenant, in a single request if the instance
+// accepts batches, or else one by one.
+func (h *UmamiFeeder) reportEventsToUmami(ctx context.Context, t *tenant, events []*SendBody) {
+	h.debug("reporting %d events", len(events))
+	if len(events) > 1 && time.Now().UnixNano() >= t.batchRetry.Load() {
+		err := h.reportBatch(ctx, t, events)
+		if err == nil {
+			markReported(events)
+			t.batchAccepted.Store(true)
+			t.stats.sent.Add(uint64(len(events)))
+			if t.quarantine != nil {
+				for _, value := range events {
+					t.quarantine.accept(quarantineKeyOf(value.Payload))
+				}
+			}
+			return
+		}
+
+		// Only a refused payload means the array format may not be understood, then the events are sent one by one.
+		// So are the events of a batch which failed to encode, so only the failing event is dropped.
+		var statusErr *statusError
+		var panicErr *panicError
+		refused := errors.As(err, &statusErr) &&
+			(statusErr.status == http.StatusBadRequest || statusErr.status == http.StatusUnsupportedMediaType)
+		poisoned := errors.As(err, &panicErr)
+		if !refused && !poisoned {
+			markReported(events)
+			t.stats.sendErrors.Add(1)
+			t.stats.dropped.Add(uint64(len(events)))
+			h.error("failed to send tracking batch to " + t.host + ": " + err.Error())
+			return
+		}
+		// An instance which accepted batches before rather refused an event of this one.
+		if poisoned {
+			h.debug("failed to encode batch for %s, sending its events one by one: %v", t.host, err)
+		} else if t.batchAccepted.Load() {
+			h.debug("batch rejected by %s, sending its events one by one: %v", t.host, err)
+		} else {
+			h.debug("batch refused by %s, sending events one by one for %v: %v", t.host, batchRetryInterval, err)
+			t.batchRetry.Store(time.Now().Add(batchRetryInterval).UnixNano())
+		}
+	}
+
+	for i, value := range events {
+		err := h.reportEvent(ctx, t, value)
+		var panicErr *panicError
+		// An event failing to encode is dropped, the others are still submitted.
+		if errors.As(err, &panicErr) {
+			value.reported = true
+			t.stats.sendErrors.Add(1)
+			t.stats.dropped.Add(1)
+			h.error("dropping event failing to encode: " + err.Error())
+			continue
+		}
+		// With the quarantine, a rejected event is counted for its shape and the others are still submitted.
+		if statusErr, ok := isRejection(err); ok && t.quarantine != nil {
+			value.reported = true
+			t.stats.sendErrors.Add(1)
+			t.stats.dropped.Add(1)
+			h.rejectEvent(t, value.Payload, statusErr)
+			continue
 		}
-		resp, err := sendRequest(ctx, h.host+"/api/track", value.Payload, headers)
 		if err != nil {
-			h.error("failed to send tracking: " + err.Error())
+			markReported(events[i:])
+			t.stats.sendErrors.Add(1)
+			t.stats.dropped.Add(uint64(len(events) - i))
+			h.error("failed to send tracking to " + t.host + ": " + err.Error())
 			return
 		}
-		if h.isDebug {
-			bodyBytes, _ := io.ReadAll(resp.Body)
-			h.debug("%v: %s", resp.Status, string(bodyBytes))
+
+		value.reported = true
+		t.stats.sent.Add(1)
+		if t.quarantine != nil {
+			t.quarantine.accept(quarantineKeyOf(value.Payload))
+		}
+	}
+}
+
+// reportEvent submits a single event. A panic encoding or submitting it is returned as a *panicError.
+func (h *UmamiFeeder) reportEvent(ctx context.Context, t *tenant, value *SendBody) (err error) {
+	defer func() {
+		if panicVal := recover(); panicVal != nil {
+			err = &panicError{value: panicVal}
 		}
-		defer func() {
+	}()
+
+	headers := map[string][]string{
+		"Authorization": {"Bearer " + value.ApiKey},
+	}
+	resp, err := sendRequest(ctx, t.client, t.host+"/api/track", value.Payload, headers)
+	if err != nil {
+		return err
+	}
+	if h.isDebug {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		h.debug("%v: %s", resp.Status, string(bodyBytes))
+	}
+
+	// Drain and close right away, so the connection can be reused for the next event.
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	return nil
+}
+
+// reportBatch submits events in a single request, as a JSON array streamed by newBatchBody. It returns a *panicError
+// if encoding an event panicked.
+func (h *UmamiFeeder) reportBatch(ctx context.Context, t *tenant, events []*SendBody) error {
+	headers := map[string][]string{
+		"Authorization": {"Bearer " + t.apiKey},
+	}
+
+	body := newBatchBody(events)
+	resp, err := sendRequest(ctx, t.client, t.host+"/api/track", body, headers)
+	body.release()
+	// The incomplete array fails the request, or is refused by Rybbit.
+	if body.poisoned.Load() {
+		if err == nil {
 			_ = resp.Body.Close()
-		}()
+		}
+		return &panicError{value: "encoding the batch failed"}
+	}
+	if err != nil {
+		return err
 	}
+	if h.isDebug {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		h.debug("%v: %s", resp.Status, string(bodyBytes))
+	}
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	return nil
 }
@@ -0,0 +1,822 @@
+package traefik_rybbit_feeder
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func BenchmarkSubmitToFeed(b *testing.B) {
+	feeder := &UmamiFeeder{
+		websites: map[string]string{"localhost": "1"},
+		queue:    newEventQueue(queueTypeRing, 1024, 1),
+	}
+	feeder.sampleRate.Store(1)
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/about", nil)
+	req.RemoteAddr = "192.168.0.1:54321"
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36")
+	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
+	req.Header.Set("Referer", "https://example.com/")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		feeder.submitToFeed(req, responseInfo{status: http.StatusOK})
+	}
+}
+
+func TestSubmitToFeedCopiesRequestData(t *testing.T) {
+	feeder := &UmamiFeeder{
+		websites: map[string]string{"localhost": "1"},
+		queue:    newEventQueue(queueTypeChannel, 1, 1),
+	}
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/about", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	req.Header.Set("Referer", "https://example.com/")
+
+	feeder.submitToFeed(req, responseInfo{status: http.StatusOK})
+	event := feeder.queue.shards[0].pop()
+
+	for name, pair := range map[string][2]string{
+		"path":       {event.Pathname, req.URL.Path},
+		"user-agent": {event.UserAgent, req.Header.Get("User-Agent")},
+		"referrer":   {event.Referrer, req.Referer()},
+	} {
+		if pair[0] != pair[1] {
+			t.Fatalf("%s: expected %q, got %q", name, pair[1], pair[0])
+		}
+		if unsafe.StringData(pair[0]) == unsafe.StringData(pair[1]) {
+			t.Fatalf("%s: event shares memory with the request", name)
+		}
+	}
+}
+
+func TestSubmitToFeedAPIEvent(t *testing.T) {
+	feeder := &UmamiFeeder{
+		websites:         map[string]string{"localhost": "1"},
+		queue:            newEventQueue(queueTypeChannel, 1, 1),
+		apiEventPrefixes: []string{"/api/"},
+	}
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "http://localhost/api/users/42", nil)
+	feeder.submitToFeed(req, responseInfo{status: http.StatusCreated, duration: 15 * time.Millisecond})
+	event := feeder.queue.shards[0].pop()
+
+	if event.Type != "custom_event" || event.EventName != "POST /api/users/:id" {
+		t.Fatalf("unexpected event %s %q", event.Type, event.EventName)
+	}
+	if event.Properties != `{"latency_ms":15,"status":201}` {
+		t.Fatalf("unexpected properties %s", event.Properties)
+	}
+}
+
+func TestSubmitToFeedSearch(t *testing.T) {
+	feeder := &UmamiFeeder{
+		websites:         map[string]string{"localhost": "1"},
+		queue:            newEventQueue(queueTypeChannel, 2, 1),
+		searchParamNames: []string{"q", "s"},
+		searchEvents:     true,
+	}
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/search?page=2&s=traefik+plugin", nil)
+	feeder.submitToFeed(req, responseInfo{status: http.StatusOK})
+
+	pageview, search := feeder.queue.shards[0].pop(), feeder.queue.shards[0].pop()
+	if pageview.Type != "pageview" || pageview.Properties != `{"search_term":"traefik plugin"}` {
+		t.Fatalf("unexpected pageview %s %s", pageview.Type, pageview.Properties)
+	}
+	if search == nil || search.EventName != "site_search" || search.Pathname != "/search" {
+		t.Fatalf("unexpected search event %+v", search)
+	}
+}
+
+func TestSubmitToFeedConversion(t *testing.T) {
+	feeder := &UmamiFeeder{
+		websites: map[string]string{"localhost": "1"},
+		queue:    newEventQueue(queueTypeChannel, 2, 1),
+	}
+	err := feeder.verifyConfig(&Config{ConversionEvents: []ConversionEvent{{
+		Name:         "purchase",
+		Method:       http.MethodPost,
+		Path:         "^/checkout/complete$",
+		AmountHeader: "X-Order-Total",
+		Currency:     "EUR",
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, "http://localhost/checkout/complete", nil)
+	feeder.submitToFeed(req, responseInfo{status: http.StatusOK, header: http.Header{"X-Order-Total": {"49.90"}}})
+
+	if feeder.queue.len() != 2 {
+		t.Fatalf("expected pageview and conversion, got %d events", feeder.queue.len())
+	}
+	_ = feeder.queue.shards[0].pop()
+	conversion := feeder.queue.shards[0].pop()
+	if conversion.EventName != "purchase" || conversion.Properties != `{"amount":49.9,"currency":"EUR"}` {
+		t.Fatalf("unexpected conversion %q %s", conversion.EventName, conversion.Properties)
+	}
+
+	// A failed checkout is no conversion.
+	feeder.submitToFeed(req, responseInfo{status: http.StatusBadRequest})
+	if feeder.queue.len() != 1 {
+		t.Fatalf("expected only the pageview, got %d events", feeder.queue.len())
+	}
+}
+
+func TestSubmitToFeedVariant(t *testing.T) {
+	feeder := &UmamiFeeder{
+		websites:      map[string]string{"localhost": "1"},
+		queue:         newEventQueue(queueTypeChannel, 2, 1),
+		variantHeader: "X-Variant",
+		variantCookie: "ab_variant",
+	}
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/", nil)
+	req.AddCookie(&http.Cookie{Name: "ab_variant", Value: "b"})
+	feeder.submitToFeed(req, responseInfo{status: http.StatusOK})
+
+	req.Header.Set("X-Variant", "checkout-v2")
+	feeder.submitToFeed(req, responseInfo{status: http.StatusOK})
+
+	for _, expected := range []string{`{"variant":"b"}`, `{"variant":"checkout-v2"}`} {
+		if event := feeder.queue.shards[0].pop(); event.Properties != expected {
+			t.Fatalf("expected %s, got %s", expected, event.Properties)
+		}
+	}
+}
+
+func TestSubmitToFeedClickIDs(t *testing.T) {
+	feeder := &UmamiFeeder{
+		websites:      map[string]string{"localhost": "1"},
+		queue:         newEventQueue(queueTypeChannel, 1, 1),
+		trackClickIDs: true,
+	}
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/landing?gclid=abc123&utm_source=google", nil)
+	feeder.submitToFeed(req, responseInfo{status: http.StatusOK})
+
+	event := feeder.queue.shards[0].pop()
+	if event.Properties != `{"gclid":"abc123"}` || event.Pathname != "/landing" {
+		t.Fatalf("unexpected event %s %s", event.Pathname, event.Properties)
+	}
+}
+
+func TestSubmitToFeedUTM(t *testing.T) {
+	feeder := &UmamiFeeder{
+		websites: map[string]string{"localhost": "1"},
+		queue:    newEventQueue(queueTypeChannel, 1, 1),
+		trackUTM: true,
+	}
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet,
+		"http://localhost/landing?gclid=abc123&utm_source=news&utm_campaign=spring%20sale&token=secret", nil)
+	feeder.submitToFeed(req, responseInfo{status: http.StatusOK})
+
+	event := feeder.queue.shards[0].pop()
+	if event.Properties != `{"utm_campaign":"spring sale","utm_source":"news"}` || event.Pathname != "/landing" {
+		t.Fatalf("unexpected event %s %s", event.Pathname, event.Properties)
+	}
+}
+
+func TestSubmitToFeedIdentity(t *testing.T) {
+	feeder := &UmamiFeeder{
+		websites:       map[string]string{"localhost": "1"},
+		queue:          newEventQueue(queueTypeChannel, 1, 1),
+		identityHeader: "X-Auth-Request-Email",
+		groupsHeader:   "X-Auth-Request-Groups",
+		identitySalt:   "salt",
+	}
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/", nil)
+	req.Header.Set("X-Auth-Request-Email", "Jane@Example.com")
+	req.Header.Set("X-Auth-Request-Groups", "admins,devs")
+	feeder.submitToFeed(req, responseInfo{status: http.StatusOK})
+
+	expected := `{"groups":"admins,devs","identity":"` + hashIdentity("salt", "jane@example.com") + `"}`
+	if event := feeder.queue.shards[0].pop(); event.Properties != expected {
+		t.Fatalf("expected %s, got %s", expected, event.Properties)
+	}
+	if strings.Contains(expected, "jane") {
+		t.Fatal("identity must not be reported in plain text")
+	}
+}
+
+func TestSubmitToFeedCanary(t *testing.T) {
+	for percent, expected := range map[int]string{0: "1", 100: "canary"} {
+		feeder := &UmamiFeeder{
+			websites:      map[string]string{"localhost": "1"},
+			queue:         newEventQueue(queueTypeChannel, 1, 1),
+			canarySiteID:  "canary",
+			canaryPercent: percent,
+		}
+
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/", nil)
+		feeder.submitToFeed(req, responseInfo{status: http.StatusOK})
+
+		if event := feeder.queue.shards[0].pop(); event.SiteID != expected {
+			t.Fatalf("%d%%: expected site-id %s, got %s", percent, expected, event.SiteID)
+		}
+	}
+}
+
+func TestSubmitToFeedLanguageCookie(t *testing.T) {
+	tests := map[string]string{
+		"":      "en-US",
+		"de-DE": "de-DE",
+		"fr_FR": "fr-FR",
+		"\"\"":  "en-US",
+	}
+	for cookie, expected := range tests {
+		feeder := &UmamiFeeder{
+			websites:       map[string]string{"localhost": "1"},
+			queue:          newEventQueue(queueTypeChannel, 1, 1),
+			languageCookie: "locale",
+		}
+
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/", nil)
+		req.Header.Set("Accept-Language", "en-US,en;q=0.5")
+		if cookie != "" {
+			req.Header.Set("Cookie", "locale="+cookie)
+		}
+		feeder.submitToFeed(req, responseInfo{status: http.StatusOK})
+
+		if event := feeder.queue.shards[0].pop(); event.Language != expected {
+			t.Fatalf("%s: expected language %s, got %s", cookie, expected, event.Language)
+		}
+	}
+}
+
+func TestSubmitToFeedTruncates(t *testing.T) {
+	feeder := &UmamiFeeder{
+		websites:            map[string]string{"localhost": "1"},
+		queue:               newEventQueue(queueTypeChannel, 1, 1),
+		maxUserAgentLength:  32,
+		maxPropertiesLength: 32,
+		variantHeader:       "X-Variant",
+	}
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/", nil)
+	req.Header.Set("User-Agent", strings.Repeat("A", 4096))
+	req.Header.Set("X-Variant", strings.Repeat("B", 4096))
+	feeder.submitToFeed(req, responseInfo{status: http.StatusOK})
+
+	event := feeder.queue.shards[0].pop()
+	if len(event.UserAgent) != 32 || !strings.HasSuffix(event.UserAgent, "…") {
+		t.Fatalf("expected truncated user-agent, got %q", event.UserAgent)
+	}
+	if event.Properties != `{"truncated":true}` {
+		t.Fatalf("expected truncated properties, got %s", event.Properties)
+	}
+}
+
+func TestSubmitToFeedStatusClass(t *testing.T) {
+	feeder := &UmamiFeeder{
+		websites:    map[string]string{"localhost": "1"},
+		queue:       newEventQueue(queueTypeChannel, 2, 1),
+		statusClass: true,
+	}
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/", nil)
+	feeder.submitToFeed(req, responseInfo{status: http.StatusNotModified})
+	feeder.submitToFeed(req, responseInfo{status: http.StatusServiceUnavailable})
+
+	for _, expected := range []string{`{"status_class":"3xx"}`, `{"status_class":"5xx"}`} {
+		if event := feeder.queue.shards[0].pop(); event.Properties != expected {
+			t.Fatalf("expected %s, got %s", expected, event.Properties)
+		}
+	}
+}
+
+func TestReportEventsToUmamiBatches(t *testing.T) {
+	for name, acceptsBatches := range map[string]bool{"batch": true, "fallback": false} {
+		var requests, events int
+		rybbit := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			requests++
+			body, _ := io.ReadAll(req.Body)
+			if bytes.HasPrefix(body, []byte("[")) {
+				if !acceptsBatches {
+					http.Error(rw, "invalid payload", http.StatusBadRequest)
+					return
+				}
+				events += bytes.Count(body, []byte(`"site_id"`))
+				return
+			}
+			events++
+		}))
+
+		feeder := &UmamiFeeder{}
+		tn := &tenant{host: rybbit.URL, apiKey: "key", client: rybbit.Client()}
+		for i := 0; i < 2; i++ {
+			batch := []*SendBody{
+				{Payload: &RybbitEvent{SiteID: "1"}, ApiKey: "key"},
+				{Payload: &RybbitEvent{SiteID: "1"}, ApiKey: "key"},
+				{Payload: &RybbitEvent{SiteID: "1"}, ApiKey: "key"},
+			}
+			feeder.reportEventsToUmami(context.Background(), tn, batch)
+		}
+		rybbit.Close()
+
+		// Without batch support, the first batch is rejected once and every event sent on its own.
+		expectedRequests := map[bool]int{true: 2, false: 7}[acceptsBatches]
+		if requests != expectedRequests || events != 6 || tn.stats.sent.Load() != 6 {
+			t.Fatalf("%s: expected %d requests with 6 events, got %d requests with %d events (%d sent)",
+				name, expectedRequests, requests, events, tn.stats.sent.Load())
+		}
+	}
+}
+
+func TestReportEventsToUmamiBatchRetry(t *testing.T) {
+	var status, requests int
+	rybbit := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		body, _ := io.ReadAll(req.Body)
+		if bytes.HasPrefix(body, []byte("[")) && status != http.StatusOK {
+			http.Error(rw, "failed", status)
+		}
+	}))
+	defer rybbit.Close()
+
+	feeder := &UmamiFeeder{}
+	tn := &tenant{host: rybbit.URL, apiKey: "key", client: rybbit.Client()}
+	report := func(responseStatus int) {
+		status, requests = responseStatus, 0
+		feeder.reportEventsToUmami(context.Background(), tn, []*SendBody{
+			{Payload: &RybbitEvent{SiteID: "1"}, ApiKey: "key"},
+			{Payload: &RybbitEvent{SiteID: "1"}, ApiKey: "key"},
+		})
+	}
+
+	// A failing instance does not refuse the format.
+	report(http.StatusServiceUnavailable)
+	if requests != 1 || tn.batchRetry.Load() != 0 || tn.stats.dropped.Load() != 2 {
+		t.Fatalf("expected the batch to be dropped, got %d requests", requests)
+	}
+
+	report(http.StatusUnsupportedMediaType)
+	if requests != 3 || tn.batchRetry.Load() <= time.Now().UnixNano() {
+		t.Fatalf("expected the events to be sent one by one and batches retried later, got %d requests", requests)
+	}
+	report(http.StatusOK)
+	if requests != 2 {
+		t.Fatalf("expected the events to be sent one by one until the retry, got %d requests", requests)
+	}
+
+	tn.batchRetry.Store(time.Now().UnixNano())
+	report(http.StatusOK)
+	if requests != 1 || !tn.batchAccepted.Load() {
+		t.Fatalf("expected batches to be retried, got %d requests", requests)
+	}
+
+	// Once batches were accepted, a rejected batch rather holds an invalid event.
+	report(http.StatusBadRequest)
+	if requests != 3 || tn.batchRetry.Load() > time.Now().UnixNano() {
+		t.Fatalf("expected only the rejected batch to be sent one by one, got %d requests", requests)
+	}
+}
+
+func TestReportBatchFailsEarly(t *testing.T) {
+	// The instance fails before reading the body, so the batch is still being encoded when the request returns.
+	rybbit := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer rybbit.Close()
+
+	feeder := &UmamiFeeder{}
+	tn := &tenant{host: rybbit.URL, apiKey: "key", client: rybbit.Client()}
+	for i := 0; i < 10; i++ {
+		batch := make([]*SendBody, 0, 1000)
+		for j := 0; j < cap(batch); j++ {
+			value := acquireSendBody()
+			value.Payload = acquireEvent()
+			value.Payload.SiteID, value.Payload.Pathname = "1", "/"+strings.Repeat("a", 1000)
+			batch = append(batch, value)
+		}
+
+		if err := feeder.reportBatch(context.Background(), tn, batch); err == nil {
+			t.Fatal("expected the batch to fail")
+		}
+		// Racing with the encoding otherwise.
+		releaseBatch(batch)
+	}
+}
+
+// roundTripFunc is an http.RoundTripper calling itself.
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestReportEventsToUmamiPanic(t *testing.T) {
+	var sent int
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		body, _ := io.ReadAll(req.Body)
+		if bytes.Contains(body, []byte("poison")) {
+			panic("poison")
+		}
+		sent++
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(""))}, nil
+	})}
+
+	feeder := &UmamiFeeder{}
+	tn := &tenant{host: "http://rybbit", apiKey: "key", client: client}
+	tn.batchRetry.Store(time.Now().Add(time.Hour).UnixNano())
+	batch := []*SendBody{
+		{Payload: &RybbitEvent{SiteID: "1"}, ApiKey: "key"},
+		{Payload: &RybbitEvent{SiteID: "poison"}, ApiKey: "key"},
+		{Payload: &RybbitEvent{SiteID: "1"}, ApiKey: "key"},
+	}
+	feeder.reportEventsToUmami(context.Background(), tn, batch)
+
+	if sent != 2 || tn.stats.sent.Load() != 2 || tn.stats.dropped.Load() != 1 {
+		t.Fatalf("expected only the poisoned event to be dropped, got %d sent", sent)
+	}
+	for _, value := range batch {
+		if !value.reported {
+			t.Fatalf("expected every event to be reported, got %+v", value.Payload)
+		}
+	}
+}
+
+func TestRequeue(t *testing.T) {
+	feeder := &UmamiFeeder{}
+	tn := &tenant{queue: newEventQueue(queueTypeChannel, 2, 1)}
+	batch := []*SendBody{
+		{Payload: &RybbitEvent{SiteID: "sent"}, reported: true},
+		{Payload: &RybbitEvent{SiteID: "unsent"}},
+	}
+	feeder.requeue(tn, tn.queue.shards[0], batch)
+
+	if event := tn.queue.shards[0].pop(); event == nil || event.SiteID != "unsent" || tn.queue.len() != 0 {
+		t.Fatalf("expected only the unsent event to be requeued, got %+v", event)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	var events atomic.Int32
+	rybbit := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		events.Add(int32(bytes.Count(body, []byte(`"site_id"`))))
+	}))
+	defer rybbit.Close()
+
+	feeder := &UmamiFeeder{}
+	tn := &tenant{host: rybbit.URL, apiKey: "key", queue: newEventQueue(queueTypeChannel, 5, 1), client: rybbit.Client(), batchSize: 2}
+	for i := 0; i < 3; i++ {
+		tn.queue.push(&RybbitEvent{SiteID: "1"})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	batch := []*SendBody{{Payload: &RybbitEvent{SiteID: "1"}, ApiKey: "key"}}
+	feeder.drain(ctx, tn, tn.queue.shards[0], batch)
+
+	if events.Load() != 4 || tn.queue.len() != 0 {
+		t.Fatalf("expected the batch and the 3 waiting events to be submitted, got %d", events.Load())
+	}
+}
+
+// syncBuffer is a buffer safe for concurrent use, e.g. by a logger and a test.
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+func TestSuperviseWorkers(t *testing.T) {
+	var received atomic.Int32
+	rybbit := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// Slower than the producer, so the shard fills up.
+		time.Sleep(5 * time.Millisecond)
+		body, _ := io.ReadAll(req.Body)
+		received.Add(int32(bytes.Count(body, []byte(`"site_id"`))))
+	}))
+	defer rybbit.Close()
+
+	logs := &syncBuffer{}
+	feeder := &UmamiFeeder{logHandler: log.New(logs, "", 0), isDebug: true}
+	tn := &tenant{
+		host: rybbit.URL, apiKey: "key", client: rybbit.Client(), queue: newEventQueue(queueTypeChannel, 20, 1),
+		batchSize: 2, batchMaxWait: 10 * time.Millisecond, minWorkers: 1, maxWorkers: 2,
+	}
+	tn.batchAccepted.Store(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go feeder.superviseWorkers(ctx, tn, tn.queue.shards[0], 10*time.Millisecond)
+
+	waitFor := func(condition func() bool, what string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !condition(); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+	push := func(events int) {
+		for i := 0; i < events; i++ {
+			for !tn.queue.push(&RybbitEvent{SiteID: "1"}) {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+
+	push(200)
+	waitFor(func() bool { return strings.Contains(logs.String(), "scaled up to 2 workers") }, "scaling up")
+	waitFor(func() bool { return strings.Contains(logs.String(), "scaled down to 1 workers") }, "scaling down")
+	push(20)
+	waitFor(func() bool { return tn.stats.sent.Load()+tn.stats.dropped.Load() == 220 }, "every event")
+
+	if tn.stats.dropped.Load() != 0 || received.Load() != 220 {
+		t.Fatalf("expected no event to be lost, got %d received and %d dropped", received.Load(), tn.stats.dropped.Load())
+	}
+}
+
+func TestSubmitToFeedDedupTag(t *testing.T) {
+	feeder := &UmamiFeeder{
+		websites: map[string]string{"localhost": "1"},
+		queue:    newEventQueue(queueTypeChannel, 1, 1),
+		dedup:    dedupTag,
+	}
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/", nil)
+	feeder.submitToFeed(req, responseInfo{status: http.StatusOK})
+
+	if event := feeder.queue.shards[0].pop(); event.Properties != `{"source":"server"}` {
+		t.Fatalf("expected the source property, got %s", event.Properties)
+	}
+}
+
+func TestSubmitToFeedMiddleware(t *testing.T) {
+	feeder := &UmamiFeeder{
+		name:            "blog-router@file",
+		websites:        map[string]string{"localhost": "1"},
+		queue:           newEventQueue(queueTypeChannel, 1, 1),
+		trackMiddleware: true,
+	}
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/", nil)
+	feeder.submitToFeed(req, responseInfo{status: http.StatusOK})
+
+	if event := feeder.queue.shards[0].pop(); event.Properties != `{"middleware":"blog-router@file"}` {
+		t.Fatalf("expected the middleware property, got %s", event.Properties)
+	}
+}
+
+func TestSubmitToFeedAnonymizeIP(t *testing.T) {
+	tests := map[string]string{
+		"203.0.113.42":       "203.0.113.0",
+		"2001:db8:1:2:3::4":  "2001:db8:1::",
+		"::ffff:192.0.2.128": "192.0.2.0",
+		"unknown":            "",
+	}
+	for ip, expected := range tests {
+		feeder := &UmamiFeeder{
+			websites:    map[string]string{"localhost": "1"},
+			queue:       newEventQueue(queueTypeChannel, 1, 1),
+			anonymizeIP: true,
+		}
+
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/", nil)
+		req.Header.Set("X-Real-IP", ip)
+		feeder.submitToFeed(req, responseInfo{status: http.StatusOK})
+
+		if event := feeder.queue.shards[0].pop(); event.IP != expected {
+			t.Fatalf("%s: expected IP %s, got %s", ip, expected, event.IP)
+		}
+	}
+}
+
+func TestSubmitToFeedOmitIP(t *testing.T) {
+	feeder := &UmamiFeeder{
+		websites:     map[string]string{"localhost": "1"},
+		queue:        newEventQueue(queueTypeChannel, 2, 1),
+		omitIP:       true,
+		statusEvents: map[int]string{http.StatusUnauthorized: "auth_failed"},
+	}
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/", nil)
+	req.Header.Set("X-Real-IP", "203.0.113.42")
+	feeder.submitToFeed(req, responseInfo{status: http.StatusUnauthorized})
+
+	for i := 0; i < 2; i++ {
+		event := feeder.queue.shards[0].pop()
+		if event.IP != "" || strings.Contains(event.Properties, "203.0.113.42") {
+			t.Fatalf("expected no IP in %+v", event)
+		}
+	}
+}
+
+func TestSubmitToFeedSendFields(t *testing.T) {
+	feeder := &UmamiFeeder{
+		websites:       map[string]string{"localhost": "1"},
+		queue:          newEventQueue(queueTypeChannel, 1, 1),
+		omitUserAgent:  true,
+		omitReferrer:   true,
+		omitProperties: true,
+		trackProtocol:  true,
+	}
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	req.Header.Set("Referer", "https://example.com/")
+	req.Header.Set("Accept-Language", "en-US")
+	feeder.submitToFeed(req, responseInfo{status: http.StatusOK})
+
+	event := feeder.queue.shards[0].pop()
+	if event.UserAgent != "" || event.Referrer != "" || event.Properties != "" {
+		t.Fatalf("expected no user agent, referrer and properties in %+v", event)
+	}
+	if event.Language != "en-US" {
+		t.Errorf("expected the language to be sent, got %q", event.Language)
+	}
+}
+
+func TestSubmitToFeedPathEvents(t *testing.T) {
+	feeder := &UmamiFeeder{
+		websites: map[string]string{"localhost": "1"},
+		queue:    newEventQueue(queueTypeChannel, 2, 1),
+	}
+	err := feeder.verifyConfig(&Config{
+		Events: []PathEvent{
+			{Name: "file_download", Method: http.MethodGet, Path: `^/downloads/.*\.zip$`, Properties: map[string]string{"kind": "archive"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if feeder.locationReason("localhost", "/downloads/app.zip") != "" {
+		t.Fatal("expected the download to be tracked regardless of its resource type")
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		req, _ := http.NewRequestWithContext(context.Background(), method, "http://localhost/downloads/app.zip", nil)
+		feeder.submitToFeed(req, responseInfo{status: http.StatusOK})
+	}
+
+	event := feeder.queue.shards[0].pop()
+	if event.Type != eventTypeCustom || event.EventName != "file_download" || event.Properties != `{"kind":"archive"}` {
+		t.Fatalf("expected a file_download event, got %+v", event)
+	}
+	if event := feeder.queue.shards[0].pop(); event.Type != eventTypePageview {
+		t.Fatalf("expected a pageview for another method, got %+v", event)
+	}
+}
+
+func TestSubmitToFeedPathRewrites(t *testing.T) {
+	feeder := &UmamiFeeder{
+		websites: map[string]string{"localhost": "1"},
+		queue:    newEventQueue(queueTypeChannel, 1, 1),
+	}
+	err := feeder.verifyConfig(&Config{
+		PathRewrites: []PathRewrite{
+			{Regex: `^/users/\d+`, Replacement: "/users/:id"},
+			{Regex: `/[0-9a-f]{8}-[0-9a-f-]{27}(/|$)`, Replacement: "/:uuid$1"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet,
+		"http://localhost/users/42/files/0b6a3f7e-1c2d-4e5f-8a9b-0c1d2e3f4a5b/edit", nil)
+	feeder.submitToFeed(req, responseInfo{status: http.StatusOK})
+
+	if event := feeder.queue.shards[0].pop(); event.Pathname != "/users/:id/files/:uuid/edit" {
+		t.Fatalf("expected the rewritten path, got %s", event.Pathname)
+	}
+}
+
+func TestQuerystring(t *testing.T) {
+	query := "utm_source=news&token=secret&page=2&utm_medium=email"
+	for _, test := range []struct {
+		mode      string
+		allowlist []string
+		expected  string
+		clickID   string
+	}{
+		{queryDrop, nil, "", ""},
+		{queryKeep, nil, "?" + query, ""},
+		{queryAllowlist, []string{"utm_*", "page"}, "?utm_source=news&page=2&utm_medium=email", ""},
+		{queryAllowlist, []string{"q"}, "", ""},
+		// Captured click ids are not forwarded twice.
+		{queryKeep, nil, "?utm_source=news&token=secret&page=2&utm_medium=email", "gclid=abc&"},
+		{queryAllowlist, []string{"utm_*", "gclid"}, "?utm_source=news&utm_medium=email", "gclid=abc&"},
+	} {
+		feeder := &UmamiFeeder{
+			websites:       map[string]string{"localhost": "1"},
+			queue:          newEventQueue(queueTypeChannel, 1, 1),
+			queryMode:      test.mode,
+			queryAllowlist: test.allowlist,
+			trackClickIDs:  test.clickID != "",
+		}
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/?"+test.clickID+query, nil)
+		feeder.submitToFeed(req, responseInfo{status: http.StatusOK})
+
+		if event := feeder.queue.shards[0].pop(); event.Query != test.expected || event.Pathname != "/" {
+			t.Errorf("%s %v: expected query %q, got %q", test.mode, test.allowlist, test.expected, event.Query)
+		}
+	}
+}
+
+func TestCurrentIPSalt(t *testing.T) {
+	day := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	feeder := &UmamiFeeder{}
+	if feeder.currentIPSalt(day) != feeder.currentIPSalt(day.Add(time.Hour)) {
+		t.Error("expected the same salt within a day")
+	}
+	if feeder.currentIPSalt(day) == feeder.currentIPSalt(day.Add(24*time.Hour)) {
+		t.Error("expected the salt to rotate every day")
+	}
+
+	feeder.ipSalt = "configured"
+	if feeder.currentIPSalt(day) != "configured" || feeder.currentIPSalt(day.Add(24*time.Hour)) != "configured" {
+		t.Error("expected the configured salt to be used")
+	}
+}
+
+func TestSubmitToFeedServerTiming(t *testing.T) {
+	feeder := &UmamiFeeder{
+		websites:     map[string]string{"localhost": "1"},
+		queue:        newEventQueue(queueTypeChannel, 1, 1),
+		serverTiming: []string{"db"},
+	}
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/", nil)
+	header := http.Header{"Server-Timing": []string{"db;dur=12.5, app;dur=40"}}
+	feeder.submitToFeed(req, responseInfo{status: http.StatusOK, header: header})
+
+	if event := feeder.queue.shards[0].pop(); event.Properties != `{"timing_db":12.5}` {
+		t.Fatalf("unexpected properties %s", event.Properties)
+	}
+}
+
+func TestSubmitToFeedErrorEvent(t *testing.T) {
+	feeder := &UmamiFeeder{
+		websites:   map[string]string{"localhost": "1"},
+		queue:      newEventQueue(queueTypeChannel, 2, 1),
+		errorEvent: "http_error",
+	}
+
+	for _, status := range []int{http.StatusNotFound, http.StatusOK} {
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/missing", nil)
+		feeder.submitToFeed(req, responseInfo{status: status})
+	}
+
+	event := feeder.queue.shards[0].pop()
+	if event.Type != eventTypeCustom || event.EventName != "http_error" || event.Properties != `{"path":"/missing","status":404}` {
+		t.Fatalf("expected an http_error event, got %+v", event)
+	}
+	if event := feeder.queue.shards[0].pop(); event.Type != eventTypePageview {
+		t.Fatalf("expected a pageview for a successful response, got %+v", event)
+	}
+}
+
+func TestEventIDHeader(t *testing.T) {
+	var eventID string
+	feeder := &UmamiFeeder{
+		next: http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+			eventID = req.Header.Get("X-Rybbit-Event-Id")
+		}),
+		websites:      map[string]string{"localhost": "1"},
+		queue:         newEventQueue(queueTypeChannel, 1, 1),
+		eventIDHeader: "X-Rybbit-Event-Id",
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.Header.Set("X-Rybbit-Event-Id", "spoofed")
+	feeder.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(eventID) != 16 {
+		t.Fatalf("expected a new event ID in the request header, got %q", eventID)
+	}
+	if event := feeder.queue.shards[0].pop(); event.Properties != `{"event_id":"`+eventID+`"}` {
+		t.Fatalf("expected the event ID as a property, got %s", event.Properties)
+	}
+}